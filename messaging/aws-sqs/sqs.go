@@ -2,10 +2,12 @@ package aws_sqs
 
 // Queue processing functionalities
 import (
+	"context"
 	"fmt"
 	"github.com/aws/aws-sdk-go/aws"
 	"github.com/aws/aws-sdk-go/aws/session"
 	"github.com/aws/aws-sdk-go/service/sqs"
+	"github.com/harphies/go.microservices.io/utils"
 )
 
 type Queue struct {
@@ -56,15 +58,35 @@ func getQueueUrl(sess *session.Session, queueName string) (*sqs.GetQueueUrlOutpu
 // SendMessage push messages to Queue
 
 func (q *Queue) SendMessage(messageBody string) error {
+	return q.SendMessageWithContext(context.Background(), messageBody)
+}
 
-	_, err := q.client.SendMessage(&sqs.SendMessageInput{
+// SendMessageWithContext is SendMessage with the request ID in ctx sent as the
+// X-Request-ID message attribute.
+func (q *Queue) SendMessageWithContext(ctx context.Context, messageBody string) error {
+	input := &sqs.SendMessageInput{
 		QueueUrl:    &q.URL,
 		MessageBody: aws.String(messageBody),
-	})
+	}
+	if id := utils.RequestIDFromContext(ctx); id != "" {
+		input.MessageAttributes = map[string]*sqs.MessageAttributeValue{
+			utils.RequestIDHeader: {DataType: aws.String("String"), StringValue: aws.String(id)},
+		}
+	}
+
+	_, err := q.client.SendMessageWithContext(ctx, input)
 
 	return err
 }
 
+// RequestIDFromMessage returns the X-Request-ID attribute of a received message, or "".
+func RequestIDFromMessage(message *sqs.Message) string {
+	if v, ok := message.MessageAttributes[utils.RequestIDHeader]; ok && v.StringValue != nil {
+		return *v.StringValue
+	}
+	return ""
+}
+
 // DeleteMessage Deletes a message in the queue
 
 func (q *Queue) DeleteMessage(messageHandle *string) {
@@ -82,9 +104,10 @@ func (q *Queue) DeleteMessage(messageHandle *string) {
 func (q *Queue) ProcessMessages(chn chan<- *sqs.Message) {
 	for {
 		result, err := q.client.ReceiveMessage(&sqs.ReceiveMessageInput{
-			QueueUrl:            aws.String(q.URL),
-			MaxNumberOfMessages: aws.Int64(2),
-			WaitTimeSeconds:     aws.Int64(15),
+			QueueUrl:              aws.String(q.URL),
+			MaxNumberOfMessages:   aws.Int64(2),
+			MessageAttributeNames: aws.StringSlice([]string{utils.RequestIDHeader}),
+			WaitTimeSeconds:       aws.Int64(15),
 		})
 
 		if err != nil {
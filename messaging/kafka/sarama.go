@@ -2,9 +2,11 @@ package kafka
 
 import (
 	"bytes"
+	"context"
 	"crypto/tls"
 	"encoding/json"
 	"github.com/IBM/sarama"
+	"github.com/harphies/go.microservices.io/utils"
 	"go.uber.org/zap"
 	"log"
 	"strings"
@@ -68,10 +70,26 @@ func NewKafkaStream(logger *zap.Logger, brokerEndpoints, saslScramUsername, sasl
 
 // Publish publishes a message indicating a record was created.
 func (c *BrokerClient) Publish(eventPayload interface{}, topicName, eventType string) error {
-	return c.publish(eventType, eventPayload, topicName)
+	return c.publish(context.Background(), eventType, eventPayload, topicName)
 }
 
-func (c *BrokerClient) publish(eventType string, eventPayload interface{}, topicName string) error {
+// PublishWithContext is Publish with the request ID in ctx sent as the X-Request-ID
+// message header.
+func (c *BrokerClient) PublishWithContext(ctx context.Context, eventPayload interface{}, topicName, eventType string) error {
+	return c.publish(ctx, eventType, eventPayload, topicName)
+}
+
+// RequestIDFromHeaders returns the X-Request-ID header of a consumed message, or "".
+func RequestIDFromHeaders(headers []*sarama.RecordHeader) string {
+	for _, h := range headers {
+		if h != nil && string(h.Key) == utils.RequestIDHeader {
+			return string(h.Value)
+		}
+	}
+	return ""
+}
+
+func (c *BrokerClient) publish(ctx context.Context, eventType string, eventPayload interface{}, topicName string) error {
 
 	//
 	producer, err := sarama.NewSyncProducer(c.brokers, c.saramaConfig)
@@ -99,6 +117,9 @@ func (c *BrokerClient) publish(eventType string, eventPayload interface{}, topic
 			Key:   sarama.StringEncoder(eventType),
 			Value: sarama.ByteEncoder(b.Bytes()),
 		}
+		if id := utils.RequestIDFromContext(ctx); id != "" {
+			msg.Headers = []sarama.RecordHeader{{Key: []byte(utils.RequestIDHeader), Value: []byte(id)}}
+		}
 
 		// Send the message
 		partition, offset, err := producer.SendMessage(msg)
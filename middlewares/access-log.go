@@ -0,0 +1,216 @@
+package middlewares
+
+import (
+	"math/rand/v2"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/harphies/go.microservices.io/observability/logging"
+	"github.com/harphies/go.microservices.io/utils"
+	"go.opentelemetry.io/otel/trace"
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+)
+
+/*
+Access logs: one structured entry per request, written once the handler returned.
+
+	access := middlewares.NewAccessLogger(logger, middlewares.AccessLogConfig{
+		SampleRate:  0.1, // 10% of successful requests, every 4xx/5xx
+		Headers:     []string{"Referer", "Authorization"},
+		RedactQuery: []string{"token"},
+		SkipPaths:   []string{"/healthz", "/metrics"},
+	})
+	handler := access.Handler(mux)
+
+Handlers get a logger carrying the request ID and trace IDs from logging.LoggerFromContext.
+Entries and the handler logger extend the context logger of outer middlewares, such as a
+RequestIDPropagator or GeoIP, so they carry the same fields; logger is used when there is
+none. Without a RequestIDPropagator, the entry still carries a valid X-Request-ID header.
+*/
+
+const redacted = "[REDACTED]"
+
+// defaultRedactHeaders are always redacted, since they carry credentials.
+var defaultRedactHeaders = []string{"Authorization", "Proxy-Authorization", "Cookie", "Set-Cookie", "X-Api-Key"}
+
+// AccessLogConfig configures an AccessLogger.
+type AccessLogConfig struct {
+	// SampleRate is the fraction of successful (1xx-3xx) requests logged. Zero logs every
+	// request; 4xx and 5xx responses are always logged.
+	SampleRate float64
+	// Headers are the request headers added to each entry, "*" for all of them.
+	Headers []string
+	// RedactHeaders are logged with their value replaced, in addition to Authorization,
+	// Proxy-Authorization, Cookie, Set-Cookie and X-Api-Key.
+	RedactHeaders []string
+	// RedactQuery are query parameters logged with their value replaced.
+	RedactQuery []string
+	// SkipPaths are paths never logged unless the response is a 5xx, e.g. probes.
+	SkipPaths []string
+	// Route returns the route template of a request, RouteTemplate by default.
+	Route func(r *http.Request) string
+}
+
+// AccessLogger is the access-log middleware created by NewAccessLogger.
+type AccessLogger struct {
+	logger        *zap.Logger
+	sampleRate    float64
+	allHeaders    bool
+	headers       []string
+	redactHeaders map[string]bool
+	redactQuery   map[string]bool
+	skipPaths     map[string]bool
+	route         func(r *http.Request) string
+}
+
+// NewAccessLogger returns an access logger writing to logger.
+func NewAccessLogger(logger *zap.Logger, cfg AccessLogConfig) *AccessLogger {
+	a := &AccessLogger{
+		logger:        logger,
+		sampleRate:    cfg.SampleRate,
+		redactHeaders: map[string]bool{},
+		redactQuery:   map[string]bool{},
+		skipPaths:     map[string]bool{},
+		route:         cfg.Route,
+	}
+	if a.sampleRate <= 0 || a.sampleRate > 1 {
+		a.sampleRate = 1
+	}
+	if a.route == nil {
+		a.route = RouteTemplate
+	}
+	for _, h := range cfg.Headers {
+		if h == "*" {
+			a.allHeaders = true
+			continue
+		}
+		a.headers = append(a.headers, http.CanonicalHeaderKey(h))
+	}
+	for _, h := range append(defaultRedactHeaders, cfg.RedactHeaders...) {
+		a.redactHeaders[http.CanonicalHeaderKey(h)] = true
+	}
+	for _, q := range cfg.RedactQuery {
+		a.redactQuery[q] = true
+	}
+	for _, p := range cfg.SkipPaths {
+		a.skipPaths[p] = true
+	}
+	return a
+}
+
+// Handler returns the access-log middleware.
+func (a *AccessLogger) Handler(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		rw := NewResponseWriter(w)
+
+		// a context logger already carries the request ID of an outer RequestIDPropagator;
+		// without an outer one, an inner one adds the ID to the handler logger
+		requestID := utils.RequestIDFromContext(r.Context())
+		logger, ok := logging.ContextLogger(r.Context())
+		if !ok {
+			logger = a.logger
+			if requestID != "" {
+				logger = logger.With(zap.String("request_id", requestID))
+			}
+		}
+		if sc := trace.SpanContextFromContext(r.Context()); sc.IsValid() {
+			logger = logger.With(zap.String("trace_id", sc.TraceID().String()), zap.String("span_id", sc.SpanID().String()))
+		}
+
+		serveWithContext(logging.ContextWithLogger(r.Context(), logger), next, rw, r)
+
+		status := rw.Status()
+		if status == 0 {
+			status = http.StatusOK
+		}
+		if !a.shouldLog(r, status) {
+			return
+		}
+
+		entry := []zap.Field{
+			zap.String("method", r.Method),
+			zap.String("route", a.route(r)),
+			zap.String("path", r.URL.Path),
+			zap.Int("status", status),
+			zap.Int64("bytes", rw.BytesWritten()),
+			zap.Duration("duration", time.Since(start)),
+			zap.String("client_ip", GetUserIP(r)),
+			zap.String("user_agent", r.UserAgent()),
+			zap.String("proto", r.Proto),
+		}
+		if id := r.Header.Get(utils.RequestIDHeader); requestID == "" && utils.ValidRequestID(id) {
+			entry = append(entry, zap.String("request_id", id))
+		}
+		if r.URL.RawQuery != "" {
+			entry = append(entry, zap.String("query", a.redactedQuery(r.URL.Query())))
+		}
+		if headers := a.loggedHeaders(r.Header); len(headers) > 0 {
+			entry = append(entry, zap.Any("headers", headers))
+		}
+		logger.Log(accessLogLevel(status), "http request", entry...)
+	})
+}
+
+func (a *AccessLogger) shouldLog(r *http.Request, status int) bool {
+	switch {
+	case status >= http.StatusInternalServerError:
+		return true
+	case a.skipPaths[r.URL.Path]:
+		return false
+	case status >= http.StatusBadRequest:
+		return true
+	}
+	return a.sampleRate >= 1 || rand.Float64() < a.sampleRate
+}
+
+func (a *AccessLogger) redactedQuery(q url.Values) string {
+	for k, v := range q {
+		if a.redactQuery[k] {
+			for i := range v {
+				v[i] = redacted
+			}
+		}
+	}
+	// Encode escapes the brackets, which are only cosmetic in logs
+	return strings.ReplaceAll(q.Encode(), url.QueryEscape(redacted), redacted)
+}
+
+func (a *AccessLogger) loggedHeaders(h http.Header) map[string]string {
+	logged := map[string]string{}
+	add := func(k string, v []string) {
+		if len(v) == 0 {
+			return
+		}
+		if a.redactHeaders[k] {
+			logged[k] = redacted
+			return
+		}
+		logged[k] = strings.Join(v, ", ")
+	}
+	if a.allHeaders {
+		for k, v := range h {
+			add(k, v)
+		}
+		return logged
+	}
+	for _, k := range a.headers {
+		add(k, h[k])
+	}
+	return logged
+}
+
+// accessLogLevel logs server errors as errors and client errors as warnings.
+func accessLogLevel(status int) zapcore.Level {
+	switch {
+	case status >= http.StatusInternalServerError:
+		return zapcore.ErrorLevel
+	case status >= http.StatusBadRequest:
+		return zapcore.WarnLevel
+	default:
+		return zapcore.InfoLevel
+	}
+}
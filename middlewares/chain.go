@@ -0,0 +1,155 @@
+package middlewares
+
+import (
+	"context"
+	"net/http"
+	"strings"
+
+	"github.com/harphies/go.microservices.io/observability/logging"
+	"github.com/harphies/go.microservices.io/utils"
+	"go.uber.org/zap"
+)
+
+/*
+Middlewares share one signature so they can be stacked and declared in one place:
+
+	base := middlewares.NewChain(middlewares.ClientInfoMiddleware(logger), middlewares.CorsMiddleware)
+
+	mux := http.NewServeMux()
+	api := middlewares.NewGroup(mux, middlewares.RateLimit)
+	api.HandleFunc("GET /health", health)
+
+	v1 := api.Group("/v1", authn.Handler)
+	v1.HandleFunc("GET /orders/{id}", getOrder)
+	v1.HandleFunc("POST /orders", createOrder, idempotency.Handler) // route only
+
+	srv := httpserver.NewServer(logger, base.Then(mux))
+
+Ordering: the first middleware of a chain is the outermost, i.e. it sees the request first
+and the response last. For grouped routes the parent group's middlewares run before the
+child group's, which run before the route's own.
+Refs
+https://github.com/justinas/alice
+*/
+
+// Middleware wraps a handler with extra behaviour, e.g. logging or authentication.
+type Middleware func(http.Handler) http.Handler
+
+// Chain is an ordered list of middlewares. Chains are immutable, so a chain can be shared
+// and extended without affecting other users.
+type Chain struct {
+	middlewares []Middleware
+}
+
+// NewChain returns a chain of middlewares, the first being the outermost.
+func NewChain(middlewares ...Middleware) Chain {
+	return Chain{middlewares: append([]Middleware(nil), middlewares...)}
+}
+
+// Append returns a new chain with middlewares added after, i.e. inside, the existing ones.
+func (c Chain) Append(middlewares ...Middleware) Chain {
+	m := make([]Middleware, 0, len(c.middlewares)+len(middlewares))
+	m = append(m, c.middlewares...)
+	return Chain{middlewares: append(m, middlewares...)}
+}
+
+// Extend returns a new chain with the middlewares of other added after the existing ones.
+func (c Chain) Extend(other Chain) Chain {
+	return c.Append(other.middlewares...)
+}
+
+// Then wraps h with the chain. A nil h is http.DefaultServeMux.
+func (c Chain) Then(h http.Handler) http.Handler {
+	if h == nil {
+		h = http.DefaultServeMux
+	}
+	for i := len(c.middlewares) - 1; i >= 0; i-- {
+		h = c.middlewares[i](h)
+	}
+	return h
+}
+
+// ThenFunc wraps fn with the chain.
+func (c Chain) ThenFunc(fn http.HandlerFunc) http.Handler {
+	if fn == nil {
+		return c.Then(nil)
+	}
+	return c.Then(fn)
+}
+
+// Group registers routes on a ServeMux under a common path prefix, wrapped with the
+// group's middlewares.
+type Group struct {
+	mux    *http.ServeMux
+	prefix string
+	chain  Chain
+}
+
+// NewGroup returns the root group of mux. Its middlewares only wrap the routes registered
+// through the group; wrap mux itself with a Chain for middlewares that must also see
+// unmatched requests.
+func NewGroup(mux *http.ServeMux, middlewares ...Middleware) *Group {
+	return &Group{mux: mux, chain: NewChain(middlewares...)}
+}
+
+// Group returns a sub-group whose routes are registered below prefix and wrapped with the
+// parent's middlewares followed by middlewares.
+func (g *Group) Group(prefix string, middlewares ...Middleware) *Group {
+	return &Group{
+		mux:    g.mux,
+		prefix: g.prefix + strings.TrimSuffix(prefix, "/"),
+		chain:  g.chain.Append(middlewares...),
+	}
+}
+
+// Handle registers h for pattern, a ServeMux pattern such as "GET /orders/{id}" relative
+// to the group prefix, wrapped with the group's middlewares followed by middlewares.
+func (g *Group) Handle(pattern string, h http.Handler, middlewares ...Middleware) {
+	g.mux.Handle(g.pattern(pattern), g.chain.Append(middlewares...).Then(h))
+}
+
+// HandleFunc is Handle for a handler function.
+func (g *Group) HandleFunc(pattern string, fn http.HandlerFunc, middlewares ...Middleware) {
+	g.Handle(pattern, fn, middlewares...)
+}
+
+// pattern prefixes the path of a ServeMux pattern, keeping its method.
+func (g *Group) pattern(pattern string) string {
+	if g.prefix == "" {
+		return pattern
+	}
+	method, p := splitRoute(pattern)
+	if method != "" {
+		return method + " " + g.prefix + p
+	}
+	return g.prefix + p
+}
+
+// serveWithContext serves r with ctx and copies the pattern the ServeMux matched back to r,
+// so outer middlewares such as HTTPMetrics can still label the request by route.
+func serveWithContext(ctx context.Context, next http.Handler, w http.ResponseWriter, r *http.Request) {
+	req := r.WithContext(ctx)
+	defer func() {
+		if r.Pattern == "" {
+			r.Pattern = req.Pattern
+		}
+	}()
+	next.ServeHTTP(w, req)
+}
+
+// contextWithLogFields extends the context logger with fields. A context without a logger
+// is seeded with base, carrying the request ID already on the context, so the fields reach
+// handlers and inner middlewares even without an AccessLogger before this middleware. A
+// nil base leaves such a context as is.
+func contextWithLogFields(ctx context.Context, base *zap.Logger, fields ...zap.Field) context.Context {
+	if _, ok := logging.ContextLogger(ctx); ok {
+		return logging.ContextWithFields(ctx, fields...)
+	}
+	if base == nil {
+		return ctx
+	}
+	if id := utils.RequestIDFromContext(ctx); id != "" {
+		base = base.With(zap.String("request_id", id))
+	}
+	return logging.ContextWithLogger(ctx, base.With(fields...))
+}
@@ -0,0 +1,215 @@
+package middlewares
+
+import (
+	"context"
+	"crypto/x509"
+	"fmt"
+	"net/http"
+	"path"
+	"strings"
+
+	"go.uber.org/zap"
+)
+
+// ClientIdentity is the identity of an mTLS client taken from its verified certificate.
+type ClientIdentity struct {
+	// SPIFFEID is the spiffe:// URI SAN, if the certificate carries one.
+	SPIFFEID            string
+	DNSNames            []string
+	CommonName          string
+	OrganizationalUnits []string
+	SerialNumber        string
+	Certificate         *x509.Certificate
+}
+
+type clientIdentityKey struct{}
+
+// ClientIdentityFromContext returns the identity stored by ClientIdentityMiddleware.
+func ClientIdentityFromContext(ctx context.Context) (*ClientIdentity, bool) {
+	id, ok := ctx.Value(clientIdentityKey{}).(*ClientIdentity)
+	return id, ok
+}
+
+// NewClientIdentity extracts the identity fields from a client certificate.
+func NewClientIdentity(cert *x509.Certificate) *ClientIdentity {
+	id := &ClientIdentity{
+		DNSNames:            cert.DNSNames,
+		CommonName:          cert.Subject.CommonName,
+		OrganizationalUnits: cert.Subject.OrganizationalUnit,
+		SerialNumber:        cert.SerialNumber.Text(16),
+		Certificate:         cert,
+	}
+	for _, uri := range cert.URIs {
+		if uri.Scheme == "spiffe" {
+			id.SPIFFEID = uri.String()
+			break
+		}
+	}
+	return id
+}
+
+// ClientIdentityMiddleware stores the identity of the verified client certificate on the
+// request context. Only certificates that passed chain verification are used, so requests
+// over plain HTTP or without a verified certificate carry no identity.
+func ClientIdentityMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.TLS != nil && len(r.TLS.VerifiedChains) > 0 && len(r.TLS.VerifiedChains[0]) > 0 {
+			id := NewClientIdentity(r.TLS.VerifiedChains[0][0])
+			serveWithContext(context.WithValue(r.Context(), clientIdentityKey{}, id), next, w, r)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// IdentityRule allows the clients matching Identity to call the routes matching Routes.
+//
+// Identity is one of:
+//
+//	"spiffe://example.org/ns/payments/sa/api"  exact SPIFFE ID, or a prefix ending in "/*"
+//	"dns:orders.internal"                      DNS SAN, "*.internal" matches one label
+//	"cn:orders"                                subject common name
+//	"ou:platform"                              subject organizational unit
+//	"*"                                        any verified client
+//
+// Routes are "[METHOD ]pattern" where pattern is an exact path, a path.Match glob such as
+// "/orders/*/items", or a prefix ending in "/..." matching every path below it.
+type IdentityRule struct {
+	Identity string
+	Routes   []string
+}
+
+// IdentityAuthorizer rejects requests from mTLS clients that no rule allows on the route.
+type IdentityAuthorizer struct {
+	logger *zap.Logger
+	rules  []IdentityRule
+}
+
+// NewIdentityAuthorizer validates the rules and returns an authorizer enforcing them.
+func NewIdentityAuthorizer(logger *zap.Logger, rules []IdentityRule) (*IdentityAuthorizer, error) {
+	for _, rule := range rules {
+		if !validIdentityPattern(rule.Identity) {
+			return nil, fmt.Errorf("invalid identity pattern %q", rule.Identity)
+		}
+		for _, route := range rule.Routes {
+			_, pattern := splitRoute(route)
+			if _, err := path.Match(pattern, "/"); err != nil {
+				return nil, fmt.Errorf("invalid route pattern %q: %w", route, err)
+			}
+		}
+	}
+	return &IdentityAuthorizer{logger: logger, rules: rules}, nil
+}
+
+// Handler returns a middleware responding 403 Forbidden unless the client identity is
+// allowed on the route. It extracts the identity itself, so it can be used without
+// ClientIdentityMiddleware.
+func (a *IdentityAuthorizer) Handler(next http.Handler) http.Handler {
+	return ClientIdentityMiddleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		id, ok := ClientIdentityFromContext(r.Context())
+		if !ok || !a.Allowed(id, r.Method, r.URL.Path) {
+			fields := []zap.Field{zap.String("method", r.Method), zap.String("path", r.URL.Path)}
+			if ok {
+				fields = append(fields, zap.String("spiffe_id", id.SPIFFEID), zap.String("cn", id.CommonName), zap.String("serial", id.SerialNumber))
+			}
+			a.logger.Warn("client identity not allowed", fields...)
+			http.Error(w, http.StatusText(http.StatusForbidden), http.StatusForbidden)
+			return
+		}
+		next.ServeHTTP(w, r)
+	}))
+}
+
+// Allowed reports whether any rule allows id to call method on urlPath.
+func (a *IdentityAuthorizer) Allowed(id *ClientIdentity, method, urlPath string) bool {
+	for _, rule := range a.rules {
+		if !matchIdentity(rule.Identity, id) {
+			continue
+		}
+		for _, route := range rule.Routes {
+			if matchRoute(route, method, urlPath) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func validIdentityPattern(pattern string) bool {
+	if pattern == "*" || strings.HasPrefix(pattern, "spiffe://") {
+		return true
+	}
+	kind, value, ok := strings.Cut(pattern, ":")
+	if !ok || value == "" {
+		return false
+	}
+	switch kind {
+	case "dns", "cn", "ou":
+		return true
+	}
+	return false
+}
+
+func matchIdentity(pattern string, id *ClientIdentity) bool {
+	if pattern == "*" {
+		return true
+	}
+	if strings.HasPrefix(pattern, "spiffe://") {
+		if id.SPIFFEID == "" {
+			return false
+		}
+		if prefix, ok := strings.CutSuffix(pattern, "/*"); ok {
+			return strings.HasPrefix(id.SPIFFEID, prefix+"/")
+		}
+		return id.SPIFFEID == pattern
+	}
+
+	kind, value, _ := strings.Cut(pattern, ":")
+	switch kind {
+	case "dns":
+		for _, name := range id.DNSNames {
+			if matchDNSName(value, name) {
+				return true
+			}
+		}
+	case "cn":
+		return id.CommonName == value
+	case "ou":
+		for _, ou := range id.OrganizationalUnits {
+			if ou == value {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// matchDNSName matches name against pattern, where a leading "*." matches exactly one label.
+func matchDNSName(pattern, name string) bool {
+	pattern, name = strings.ToLower(pattern), strings.ToLower(name)
+	if suffix, ok := strings.CutPrefix(pattern, "*."); ok {
+		label, rest, found := strings.Cut(name, ".")
+		return found && label != "" && rest == suffix
+	}
+	return pattern == name
+}
+
+func splitRoute(route string) (method, pattern string) {
+	if m, p, ok := strings.Cut(route, " "); ok {
+		return m, strings.TrimSpace(p)
+	}
+	return "", route
+}
+
+func matchRoute(route, method, urlPath string) bool {
+	routeMethod, pattern := splitRoute(route)
+	if routeMethod != "" && !strings.EqualFold(routeMethod, method) {
+		return false
+	}
+	urlPath = path.Clean(urlPath)
+	if prefix, ok := strings.CutSuffix(pattern, "/..."); ok {
+		return urlPath == prefix || strings.HasPrefix(urlPath, prefix+"/")
+	}
+	matched, _ := path.Match(pattern, urlPath)
+	return matched
+}
@@ -0,0 +1,292 @@
+package middlewares
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"fmt"
+	"io"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// testCA issues certificates generated in memory.
+type testCA struct {
+	cert *x509.Certificate
+	key  *ecdsa.PrivateKey
+	pool *x509.CertPool
+}
+
+func newTestCA(t *testing.T) *testCA {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "test ca"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pool := x509.NewCertPool()
+	pool.AddCert(cert)
+	return &testCA{cert: cert, key: key, pool: pool}
+}
+
+// issue signs a leaf certificate for tmpl, which carries the subject and SANs.
+func (ca *testCA) issue(t *testing.T, tmpl *x509.Certificate, usage x509.ExtKeyUsage) tls.Certificate {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl.NotBefore = time.Now().Add(-time.Hour)
+	tmpl.NotAfter = time.Now().Add(time.Hour)
+	tmpl.KeyUsage = x509.KeyUsageDigitalSignature
+	tmpl.ExtKeyUsage = []x509.ExtKeyUsage{usage}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, ca.cert, &key.PublicKey, ca.key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	leaf, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key, Leaf: leaf}
+}
+
+func mustParseURL(t *testing.T, raw string) *url.URL {
+	t.Helper()
+	u, err := url.Parse(raw)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return u
+}
+
+func TestNewClientIdentity(t *testing.T) {
+	ca := newTestCA(t)
+	cert := ca.issue(t, &x509.Certificate{
+		SerialNumber: big.NewInt(0xbeef),
+		Subject:      pkix.Name{CommonName: "payments", OrganizationalUnit: []string{"platform", "billing"}},
+		DNSNames:     []string{"payments.svc.internal"},
+		URIs: []*url.URL{
+			mustParseURL(t, "https://payments.example.org"),
+			mustParseURL(t, "spiffe://example.org/ns/payments/sa/api"),
+		},
+	}, x509.ExtKeyUsageClientAuth)
+
+	id := NewClientIdentity(cert.Leaf)
+	if id.SPIFFEID != "spiffe://example.org/ns/payments/sa/api" {
+		t.Errorf("SPIFFEID = %q", id.SPIFFEID)
+	}
+	if strings.Join(id.DNSNames, ",") != "payments.svc.internal" {
+		t.Errorf("DNSNames = %v", id.DNSNames)
+	}
+	if id.CommonName != "payments" {
+		t.Errorf("CommonName = %q", id.CommonName)
+	}
+	// the units are a DER SET, so their order is not the one they were issued in
+	ous := slices.Sorted(slices.Values(id.OrganizationalUnits))
+	if strings.Join(ous, ",") != "billing,platform" {
+		t.Errorf("OrganizationalUnits = %v", id.OrganizationalUnits)
+	}
+	if id.SerialNumber != "beef" {
+		t.Errorf("SerialNumber = %q, want beef", id.SerialNumber)
+	}
+	if id.Certificate != cert.Leaf {
+		t.Error("Certificate is not the client certificate")
+	}
+}
+
+func TestNewIdentityAuthorizerRejectsInvalidRules(t *testing.T) {
+	for _, rule := range []IdentityRule{
+		{Identity: "orders", Routes: []string{"/orders"}},
+		{Identity: "dns:", Routes: []string{"/orders"}},
+		{Identity: "email:ops@example.org", Routes: []string{"/orders"}},
+		{Identity: "cn:orders", Routes: []string{"GET /orders/["}},
+	} {
+		if _, err := NewIdentityAuthorizer(zap.NewNop(), []IdentityRule{rule}); err == nil {
+			t.Errorf("rule %+v was accepted", rule)
+		}
+	}
+}
+
+func TestIdentityAuthorizerAllowed(t *testing.T) {
+	authz, err := NewIdentityAuthorizer(zap.NewNop(), []IdentityRule{
+		{Identity: "spiffe://example.org/ns/payments/*", Routes: []string{"GET /orders/..."}},
+		{Identity: "spiffe://example.org/ns/billing/sa/worker", Routes: []string{"POST /invoices"}},
+		{Identity: "dns:*.svc.internal", Routes: []string{"/inventory/*/stock"}},
+		{Identity: "cn:auditor", Routes: []string{"GET /audit"}},
+		{Identity: "ou:platform", Routes: []string{"/admin/..."}},
+		{Identity: "*", Routes: []string{"GET /health"}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	payments := &ClientIdentity{SPIFFEID: "spiffe://example.org/ns/payments/sa/api"}
+	worker := &ClientIdentity{SPIFFEID: "spiffe://example.org/ns/billing/sa/worker"}
+	orders := &ClientIdentity{DNSNames: []string{"orders.svc.internal"}}
+	deep := &ClientIdentity{DNSNames: []string{"a.orders.svc.internal"}}
+	auditor := &ClientIdentity{CommonName: "auditor"}
+	ops := &ClientIdentity{CommonName: "ops", OrganizationalUnits: []string{"sre", "platform"}}
+
+	tests := []struct {
+		name   string
+		id     *ClientIdentity
+		method string
+		path   string
+		want   bool
+	}{
+		{"spiffe prefix", payments, "GET", "/orders/42", true},
+		{"spiffe prefix root", payments, "GET", "/orders", true},
+		{"spiffe prefix wrong method", payments, "DELETE", "/orders/42", false},
+		{"spiffe prefix other route", payments, "GET", "/ordersx", false},
+		{"spiffe prefix dot segments", payments, "GET", "/orders/../admin", false},
+		{"spiffe exact", worker, "POST", "/invoices", true},
+		{"spiffe exact is not a prefix", &ClientIdentity{SPIFFEID: worker.SPIFFEID + "/x"}, "POST", "/invoices", false},
+		{"spiffe prefix needs a segment", &ClientIdentity{SPIFFEID: "spiffe://example.org/ns/paymentsx/sa/api"}, "GET", "/orders/42", false},
+		{"dns wildcard", orders, "PUT", "/inventory/7/stock", true},
+		{"dns wildcard one label only", deep, "PUT", "/inventory/7/stock", false},
+		{"dns glob is one segment", orders, "PUT", "/inventory/7/8/stock", false},
+		{"cn", auditor, "GET", "/audit", true},
+		{"cn other route", auditor, "GET", "/admin", false},
+		{"ou", ops, "DELETE", "/admin/users/1", true},
+		{"any client", deep, "GET", "/health", true},
+		{"no rule", deep, "GET", "/orders/42", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := authz.Allowed(tt.id, tt.method, tt.path); got != tt.want {
+				t.Errorf("Allowed(%s %s) = %v, want %v", tt.method, tt.path, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestIdentityAuthorizerOverMTLS(t *testing.T) {
+	ca := newTestCA(t)
+	authz, err := NewIdentityAuthorizer(zap.NewNop(), []IdentityRule{
+		{Identity: "spiffe://example.org/ns/payments/*", Routes: []string{"GET /orders/..."}},
+		{Identity: "dns:*.svc.internal", Routes: []string{"/inventory/..."}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	srv := httptest.NewUnstartedServer(authz.Handler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		id, ok := ClientIdentityFromContext(r.Context())
+		if !ok {
+			t.Error("allowed request has no client identity")
+			return
+		}
+		fmt.Fprintf(w, "%s|%s|%s", id.SPIFFEID, strings.Join(id.DNSNames, ","), id.CommonName)
+	})))
+	srv.TLS = &tls.Config{
+		Certificates: []tls.Certificate{ca.issue(t, &x509.Certificate{
+			SerialNumber: big.NewInt(2),
+			IPAddresses:  []net.IP{net.IPv4(127, 0, 0, 1)},
+		}, x509.ExtKeyUsageServerAuth)},
+		ClientCAs:  ca.pool,
+		ClientAuth: tls.VerifyClientCertIfGiven,
+	}
+	srv.StartTLS()
+	defer srv.Close()
+
+	payments := ca.issue(t, &x509.Certificate{
+		SerialNumber: big.NewInt(3),
+		Subject:      pkix.Name{CommonName: "payments"},
+		URIs:         []*url.URL{mustParseURL(t, "spiffe://example.org/ns/payments/sa/api")},
+	}, x509.ExtKeyUsageClientAuth)
+	orders := ca.issue(t, &x509.Certificate{
+		SerialNumber: big.NewInt(4),
+		Subject:      pkix.Name{CommonName: "orders"},
+		DNSNames:     []string{"orders.svc.internal"},
+	}, x509.ExtKeyUsageClientAuth)
+
+	tests := []struct {
+		name     string
+		cert     *tls.Certificate
+		method   string
+		path     string
+		wantCode int
+		wantBody string
+	}{
+		{"spiffe allowed", &payments, http.MethodGet, "/orders/42", http.StatusOK, "spiffe://example.org/ns/payments/sa/api||payments"},
+		{"spiffe wrong method", &payments, http.MethodPost, "/orders/42", http.StatusForbidden, ""},
+		{"spiffe other route", &payments, http.MethodGet, "/inventory/1", http.StatusForbidden, ""},
+		{"dns allowed", &orders, http.MethodPut, "/inventory/1", http.StatusOK, "|orders.svc.internal|orders"},
+		{"dns other route", &orders, http.MethodGet, "/orders/42", http.StatusForbidden, ""},
+		{"no client certificate", nil, http.MethodGet, "/orders/42", http.StatusForbidden, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			clientTLS := &tls.Config{RootCAs: ca.pool}
+			if tt.cert != nil {
+				clientTLS.Certificates = []tls.Certificate{*tt.cert}
+			}
+			client := &http.Client{Transport: &http.Transport{TLSClientConfig: clientTLS}}
+			defer client.CloseIdleConnections()
+
+			req, err := http.NewRequest(tt.method, srv.URL+tt.path, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			resp, err := client.Do(req)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer resp.Body.Close()
+			body, _ := io.ReadAll(resp.Body)
+			if resp.StatusCode != tt.wantCode {
+				t.Fatalf("status = %d, want %d", resp.StatusCode, tt.wantCode)
+			}
+			if tt.wantBody != "" && string(body) != tt.wantBody {
+				t.Errorf("body = %q, want %q", body, tt.wantBody)
+			}
+		})
+	}
+}
+
+func TestClientIdentityMiddlewareIgnoresUnverifiedRequests(t *testing.T) {
+	ca := newTestCA(t)
+	cert := ca.issue(t, &x509.Certificate{SerialNumber: big.NewInt(5), Subject: pkix.Name{CommonName: "orders"}}, x509.ExtKeyUsageClientAuth)
+
+	handler := ClientIdentityMiddleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if _, ok := ClientIdentityFromContext(r.Context()); ok {
+			t.Error("identity taken from a certificate that was not verified")
+		}
+	}))
+
+	// plain HTTP
+	handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/", nil))
+	// a certificate presented but not verified, e.g. with tls.RequestClientCert
+	r := httptest.NewRequest(http.MethodGet, "/", nil)
+	r.TLS = &tls.ConnectionState{PeerCertificates: []*x509.Certificate{cert.Leaf}}
+	handler.ServeHTTP(httptest.NewRecorder(), r)
+}
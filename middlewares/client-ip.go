@@ -0,0 +1,33 @@
+package middlewares
+
+import (
+	"net/http"
+
+	"github.com/harphies/go.microservices.io/utils"
+)
+
+/*
+The client address of each request, resolved once behind the trusted reverse proxies:
+
+	resolver, err := utils.NewClientIPResolver(utils.ClientIPConfig{TrustedProxies: []string{"10.0.0.0/8"}})
+	handler := middlewares.NewChain(middlewares.ClientIP(resolver), ids.Handler, access.Handler).Then(mux)
+
+GetUserIP, KeyByIP, the access log, RateLimit and the IPFilter use the resolved address,
+and the peer address of the connection without this middleware; forwarding headers are
+never trusted on their own.
+*/
+
+// ClientIP stores the client address resolved by resolver on the request context
+// (utils.ClientIPFromContext). Place it first in the chain.
+func ClientIP(resolver *utils.ClientIPResolver) Middleware {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			addr := resolver.Resolve(r)
+			if !addr.IsValid() {
+				next.ServeHTTP(w, r)
+				return
+			}
+			serveWithContext(utils.ContextWithClientIP(r.Context(), addr), next, w, r)
+		})
+	}
+}
@@ -0,0 +1,432 @@
+package middlewares
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/klauspost/compress/gzip"
+	"github.com/klauspost/compress/zstd"
+)
+
+/*
+Response compression negotiated with Accept-Encoding, and optional decompression of request
+bodies sent with Content-Encoding.
+
+	compressor, err := middlewares.NewCompressor(middlewares.CompressionConfig{
+		MinSize:            1024,
+		DecompressRequests: true,
+	})
+	handler := compressor.Handler(mux)
+
+Responses are compressed with the encoding the client prefers by q-value, zstd over gzip
+on ties. Bodies below MinSize, ranges, responses already encoded and already compressed
+content types (images, video, archives, ...) are sent as is. Flushing a response
+compresses what was written so far, so streaming responses keep working.
+Refs
+https://www.rfc-editor.org/rfc/rfc9110#name-accept-encoding
+https://www.rfc-editor.org/rfc/rfc8878#name-zstd-media-type-and-content-coding
+*/
+
+const (
+	encodingGzip = "gzip"
+	encodingZstd = "zstd"
+
+	defaultCompressMinSize        = 1024
+	defaultMaxDecompressedRequest = 10 << 20
+)
+
+// defaultSkipContentTypes are compressed already; a "/*" suffix matches the whole type.
+// Structured syntaxes such as image/svg+xml are always compressed.
+var defaultSkipContentTypes = []string{
+	"image/*", "video/*", "audio/*", "font/woff", "font/woff2",
+	"application/zip", "application/gzip", "application/x-gzip", "application/zstd",
+	"application/x-7z-compressed", "application/x-rar-compressed", "application/x-bzip2",
+	"application/x-xz", "application/pdf",
+}
+
+// CompressionConfig configures a Compressor.
+type CompressionConfig struct {
+	// Encodings in order of preference, from "zstd" and "gzip". Both by default.
+	Encodings []string
+	// MinSize is the smallest response body compressed, 1KB by default.
+	MinSize int
+	// GzipLevel is a compress/gzip level; zero is gzip.DefaultCompression.
+	GzipLevel int
+	// ZstdLevel defaults to zstd.SpeedDefault.
+	ZstdLevel zstd.EncoderLevel
+	// SkipContentTypes are not compressed, in addition to the defaults.
+	SkipContentTypes []string
+	// DecompressRequests decodes request bodies sent with a gzip or zstd Content-Encoding.
+	// Other encodings are rejected with 415 Unsupported Media Type.
+	DecompressRequests bool
+	// MaxDecompressedSize limits decompressed request bodies, 10MB by default.
+	MaxDecompressedSize int64
+}
+
+// Compressor is the compression middleware created by NewCompressor.
+type Compressor struct {
+	encodings     []string
+	minSize       int
+	skipTypes     map[string]bool
+	decompress    bool
+	maxDecompress int64
+
+	gzipWriters  sync.Pool
+	zstdWriters  sync.Pool
+	gzipReaders  sync.Pool
+	zstdReaders  sync.Pool
+	zstdMaxBytes uint64
+}
+
+// NewCompressor returns the compression middleware for cfg.
+func NewCompressor(cfg CompressionConfig) (*Compressor, error) {
+	c := &Compressor{
+		encodings:     append([]string(nil), cfg.Encodings...),
+		minSize:       cfg.MinSize,
+		skipTypes:     map[string]bool{},
+		decompress:    cfg.DecompressRequests,
+		maxDecompress: cfg.MaxDecompressedSize,
+	}
+	if len(c.encodings) == 0 {
+		c.encodings = []string{encodingZstd, encodingGzip}
+	}
+	for i, e := range c.encodings {
+		e = strings.ToLower(e)
+		if e != encodingGzip && e != encodingZstd {
+			return nil, fmt.Errorf("compression: unsupported encoding %q", e)
+		}
+		c.encodings[i] = e
+	}
+	if c.minSize <= 0 {
+		c.minSize = defaultCompressMinSize
+	}
+	if c.maxDecompress <= 0 {
+		c.maxDecompress = defaultMaxDecompressedRequest
+	}
+	for _, t := range append(defaultSkipContentTypes, cfg.SkipContentTypes...) {
+		c.skipTypes[strings.ToLower(t)] = true
+	}
+
+	gzipLevel := cfg.GzipLevel
+	if gzipLevel == 0 {
+		gzipLevel = gzip.DefaultCompression
+	}
+	if _, err := gzip.NewWriterLevel(io.Discard, gzipLevel); err != nil {
+		return nil, fmt.Errorf("compression: %w", err)
+	}
+	zstdLevel := cfg.ZstdLevel
+	if zstdLevel == 0 {
+		zstdLevel = zstd.SpeedDefault
+	}
+	zstdOpts := []zstd.EOption{
+		zstd.WithEncoderLevel(zstdLevel),
+		zstd.WithEncoderConcurrency(1),
+		zstd.WithLowerEncoderMem(true),
+	}
+	enc, err := zstd.NewWriter(nil, zstdOpts...)
+	if err != nil {
+		return nil, fmt.Errorf("compression: %w", err)
+	}
+	enc.Close()
+
+	c.gzipWriters.New = func() any {
+		w, _ := gzip.NewWriterLevel(nil, gzipLevel)
+		return w
+	}
+	c.zstdWriters.New = func() any {
+		w, _ := zstd.NewWriter(nil, zstdOpts...)
+		return w
+	}
+	c.zstdMaxBytes = uint64(c.maxDecompress)
+	return c, nil
+}
+
+var defaultCompressor, _ = NewCompressor(CompressionConfig{})
+
+// Compress is the compression middleware with the default configuration.
+func Compress(next http.Handler) http.Handler {
+	return defaultCompressor.Handler(next)
+}
+
+// Handler returns the compression middleware.
+func (c *Compressor) Handler(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if c.decompress && r.Header.Get("Content-Encoding") != "" {
+			release, ok := c.decodeRequest(w, r)
+			if !ok {
+				return
+			}
+			defer release()
+		}
+
+		w.Header().Add("Vary", "Accept-Encoding")
+		encoding := negotiateEncoding(r.Header.Get("Accept-Encoding"), c.encodings)
+		if encoding == "" || r.Method == http.MethodHead {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		cw := &compressWriter{ResponseWriter: w, c: c, encoding: encoding}
+		returned := false
+		defer func() { cw.close(returned) }()
+		next.ServeHTTP(cw, r)
+		returned = true
+	})
+}
+
+// decodeRequest replaces the body of r with its decoded content. It writes an error and
+// returns false if the encoding is not supported.
+func (c *Compressor) decodeRequest(w http.ResponseWriter, r *http.Request) (release func(), ok bool) {
+	var body io.ReadCloser
+	switch strings.ToLower(strings.TrimSpace(r.Header.Get("Content-Encoding"))) {
+	case "identity":
+		return func() {}, true
+	case encodingGzip, "x-gzip":
+		zr, _ := c.gzipReaders.Get().(*gzip.Reader)
+		var err error
+		if zr == nil {
+			zr, err = gzip.NewReader(r.Body)
+		} else {
+			err = zr.Reset(r.Body)
+		}
+		if err != nil {
+			http.Error(w, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
+			return nil, false
+		}
+		body = io.NopCloser(zr)
+		release = func() { c.gzipReaders.Put(zr) }
+	case encodingZstd:
+		zr, _ := c.zstdReaders.Get().(*zstd.Decoder)
+		var err error
+		if zr == nil {
+			zr, err = zstd.NewReader(r.Body, zstd.WithDecoderConcurrency(1), zstd.WithDecoderMaxMemory(c.zstdMaxBytes))
+		} else {
+			err = zr.Reset(r.Body)
+		}
+		if err != nil {
+			http.Error(w, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
+			return nil, false
+		}
+		body = io.NopCloser(zr)
+		release = func() {
+			zr.Reset(nil)
+			c.zstdReaders.Put(zr)
+		}
+	default:
+		w.Header().Set("Accept-Encoding", strings.Join(c.encodings, ", "))
+		http.Error(w, http.StatusText(http.StatusUnsupportedMediaType), http.StatusUnsupportedMediaType)
+		return nil, false
+	}
+
+	r.Body = http.MaxBytesReader(w, body, c.maxDecompress)
+	r.Header.Del("Content-Encoding")
+	r.Header.Del("Content-Length")
+	r.ContentLength = -1
+	return release, true
+}
+
+// skipContentType reports whether responses of contentType are compressed already.
+func (c *Compressor) skipContentType(contentType string) bool {
+	mediaType, _, _ := strings.Cut(strings.ToLower(contentType), ";")
+	mediaType = strings.TrimSpace(mediaType)
+	if strings.HasSuffix(mediaType, "+xml") || strings.HasSuffix(mediaType, "+json") {
+		return false
+	}
+	major, _, _ := strings.Cut(mediaType, "/")
+	return c.skipTypes[mediaType] || c.skipTypes[major+"/*"]
+}
+
+// negotiateEncoding returns the encoding of supported with the highest q-value in the
+// Accept-Encoding header, the first one on ties, or "" for none.
+func negotiateEncoding(header string, supported []string) string {
+	if header == "" {
+		return ""
+	}
+	accepted := map[string]float64{}
+	for _, part := range strings.Split(header, ",") {
+		name, params, _ := strings.Cut(part, ";")
+		name = strings.ToLower(strings.TrimSpace(name))
+		if name == "x-gzip" {
+			name = encodingGzip
+		}
+		q := 1.0
+		for _, p := range strings.Split(params, ";") {
+			k, v, _ := strings.Cut(strings.TrimSpace(p), "=")
+			if strings.EqualFold(k, "q") {
+				if f, err := strconv.ParseFloat(v, 64); err == nil {
+					q = f
+				}
+			}
+		}
+		accepted[name] = q
+	}
+
+	best, bestQ := "", 0.0
+	for _, e := range supported {
+		q, ok := accepted[e]
+		if !ok {
+			q, ok = accepted["*"]
+		}
+		if ok && q > bestQ {
+			best, bestQ = e, q
+		}
+	}
+	return best
+}
+
+// compressWriter holds back the response until MinSize bytes were written, the handler
+// flushed or returned, then either compresses it or writes it as is.
+type compressWriter struct {
+	http.ResponseWriter
+	c        *Compressor
+	encoding string
+
+	status  int
+	buf     []byte
+	decided bool
+	encoder io.WriteCloser
+}
+
+func (cw *compressWriter) WriteHeader(code int) {
+	if cw.decided || cw.status != 0 {
+		return
+	}
+	if code >= 100 && code < 200 && code != http.StatusSwitchingProtocols {
+		cw.ResponseWriter.WriteHeader(code)
+		return
+	}
+	cw.status = code
+	// bodies these responses may not have, or don't own, are never compressed
+	if code == http.StatusNoContent || code == http.StatusNotModified || code == http.StatusSwitchingProtocols {
+		cw.decide(false)
+	}
+}
+
+func (cw *compressWriter) Write(b []byte) (int, error) {
+	if cw.status == 0 {
+		cw.status = http.StatusOK
+	}
+	if !cw.decided {
+		if n, err := strconv.Atoi(cw.Header().Get("Content-Length")); err == nil && n < cw.c.minSize {
+			cw.decide(false)
+		} else {
+			cw.buf = append(cw.buf, b...)
+			if len(cw.buf) >= cw.c.minSize {
+				cw.decide(true)
+				return len(b), cw.writeBuffered()
+			}
+			return len(b), nil
+		}
+	}
+	if cw.encoder != nil {
+		return cw.encoder.Write(b)
+	}
+	return cw.ResponseWriter.Write(b)
+}
+
+// Flush compresses the buffered response, whatever its size, and flushes it to the client.
+func (cw *compressWriter) Flush() {
+	if !cw.decided {
+		if cw.status == 0 {
+			cw.status = http.StatusOK
+		}
+		cw.decide(true)
+		cw.writeBuffered()
+	}
+	if f, ok := cw.encoder.(interface{ Flush() error }); ok {
+		f.Flush()
+	}
+	http.NewResponseController(cw.ResponseWriter).Flush()
+}
+
+func (cw *compressWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	return http.NewResponseController(cw.ResponseWriter).Hijack()
+}
+
+func (cw *compressWriter) Unwrap() http.ResponseWriter {
+	return cw.ResponseWriter
+}
+
+// decide writes the header, compressing the response if compress is set and the response
+// is eligible.
+func (cw *compressWriter) decide(compress bool) {
+	cw.decided = true
+	h := cw.Header()
+	if compress && h.Get("Content-Encoding") == "" && h.Get("Content-Range") == "" &&
+		cw.status != http.StatusPartialContent {
+		if h.Get("Content-Type") == "" {
+			h.Set("Content-Type", http.DetectContentType(cw.buf))
+		}
+		if !cw.c.skipContentType(h.Get("Content-Type")) {
+			cw.encoder = cw.c.newEncoder(cw.encoding, cw.ResponseWriter)
+			h.Set("Content-Encoding", cw.encoding)
+			h.Del("Content-Length")
+			// the encoded body differs from the identity one, so a strong validator can't
+			// be shared between them
+			if etag := h.Get("ETag"); strings.HasPrefix(etag, `"`) {
+				h.Set("ETag", "W/"+etag)
+			}
+		}
+	}
+	if cw.status != 0 {
+		cw.ResponseWriter.WriteHeader(cw.status)
+	}
+}
+
+func (cw *compressWriter) writeBuffered() error {
+	buf := cw.buf
+	cw.buf = nil
+	if len(buf) == 0 {
+		return nil
+	}
+	var err error
+	if cw.encoder != nil {
+		_, err = cw.encoder.Write(buf)
+	} else {
+		_, err = cw.ResponseWriter.Write(buf)
+	}
+	return err
+}
+
+// close sends what was held back and finishes the encoded stream. If the handler panicked
+// nothing is sent, so the recovery middleware can still answer with a 500.
+func (cw *compressWriter) close(returned bool) {
+	if returned && !cw.decided {
+		cw.decide(len(cw.buf) >= cw.c.minSize)
+		cw.writeBuffered()
+	}
+	if cw.encoder != nil {
+		if returned {
+			cw.encoder.Close()
+		}
+		cw.c.putEncoder(cw.encoding, cw.encoder)
+		cw.encoder = nil
+	}
+}
+
+func (c *Compressor) newEncoder(encoding string, w io.Writer) io.WriteCloser {
+	if encoding == encodingZstd {
+		enc := c.zstdWriters.Get().(*zstd.Encoder)
+		enc.Reset(w)
+		return enc
+	}
+	enc := c.gzipWriters.Get().(*gzip.Writer)
+	enc.Reset(w)
+	return enc
+}
+
+func (c *Compressor) putEncoder(encoding string, enc io.WriteCloser) {
+	if encoding == encodingZstd {
+		enc.(*zstd.Encoder).Reset(nil)
+		c.zstdWriters.Put(enc)
+		return
+	}
+	enc.(*gzip.Writer).Reset(nil)
+	c.gzipWriters.Put(enc)
+}
@@ -0,0 +1,423 @@
+package middlewares
+
+import (
+	"context"
+	"math"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/harphies/go.microservices.io/observability/prommetrics"
+	"github.com/harphies/go.microservices.io/utils"
+)
+
+/*
+Adaptive concurrency limiting and load shedding. The number of requests served at once is
+capped by a limit the LimitAlgorithm tunes from observed latency: it grows while latency
+stays flat and shrinks as soon as requests queue up inside the service. Requests over the
+limit wait for a slot in priority order and are shed with a 503 problem+json response, code
+"overloaded", once they waited longer than their priority allows.
+
+	limiter := middlewares.NewConcurrencyLimiter(middlewares.ConcurrencyLimiterConfig{
+		Priorities: []middlewares.PriorityRule{
+			{Route: "POST /payments/...", Priority: middlewares.PriorityHigh},
+			{Route: "/reports/...", Priority: middlewares.PriorityLow},
+		},
+		Metrics: concurrencyMetrics,
+	})
+	handler := limiter.Handler(mux)
+Refs
+https://github.com/Netflix/concurrency-limits
+https://netflixtechblog.medium.com/performance-under-load-3e6fa9a60581
+*/
+
+// Priority orders requests waiting for the concurrency limit.
+type Priority int
+
+const (
+	// PriorityCritical requests, e.g. health checks, bypass the limit and are never shed.
+	PriorityCritical Priority = iota
+	PriorityHigh
+	PriorityNormal
+	// PriorityLow requests, e.g. batch jobs, are shed first.
+	PriorityLow
+	numPriorities
+)
+
+func (p Priority) String() string {
+	switch p {
+	case PriorityCritical:
+		return "critical"
+	case PriorityHigh:
+		return "high"
+	case PriorityNormal:
+		return "normal"
+	case PriorityLow:
+		return "low"
+	}
+	return "unknown"
+}
+
+// PriorityRule assigns Priority to requests matching Route, a "[METHOD ]pattern" route as
+// in IdentityRule.
+type PriorityRule struct {
+	Route    string
+	Priority Priority
+}
+
+// defaultMaxWait is how long requests of each priority may queue by default.
+var defaultMaxWait = map[Priority]time.Duration{
+	PriorityHigh:   time.Second,
+	PriorityNormal: 250 * time.Millisecond,
+	PriorityLow:    50 * time.Millisecond,
+}
+
+// ConcurrencyLimiterConfig configures a ConcurrencyLimiter.
+type ConcurrencyLimiterConfig struct {
+	// Name labels the limiter's metrics, "http" by default.
+	Name string
+	// Algorithm tunes the limit, a GradientLimit with the default config if nil.
+	Algorithm LimitAlgorithm
+	// Priorities are matched in order; requests matching none are PriorityNormal, except
+	// /healthz, /livez and /readyz which are PriorityCritical.
+	Priorities []PriorityRule
+	// MaxWait replaces how long requests of each priority may wait for a slot, 1s for
+	// high, 250ms for normal and 50ms for low priority by default. Priorities without a
+	// wait are shed as soon as the limit is reached.
+	MaxWait map[Priority]time.Duration
+	// Metrics optionally exports the limit, queue and shed requests.
+	Metrics *prommetrics.ConcurrencyMetrics
+}
+
+// ConcurrencyLimiter is the middleware created by NewConcurrencyLimiter.
+type ConcurrencyLimiter struct {
+	name       string
+	algorithm  LimitAlgorithm
+	priorities []PriorityRule
+	maxWait    map[Priority]time.Duration
+	metrics    *prommetrics.ConcurrencyMetrics
+
+	mu       sync.Mutex
+	inFlight int
+	queues   [numPriorities][]*waiter
+	queued   int
+}
+
+type waiter struct {
+	ready   chan struct{}
+	granted bool
+}
+
+// NewConcurrencyLimiter returns a limiter configured by cfg.
+func NewConcurrencyLimiter(cfg ConcurrencyLimiterConfig) *ConcurrencyLimiter {
+	l := &ConcurrencyLimiter{
+		name:       cfg.Name,
+		algorithm:  cfg.Algorithm,
+		priorities: cfg.Priorities,
+		maxWait:    cfg.MaxWait,
+		metrics:    cfg.Metrics,
+	}
+	if l.name == "" {
+		l.name = "http"
+	}
+	if l.algorithm == nil {
+		l.algorithm = NewGradientLimit(GradientLimitConfig{})
+	}
+	if l.maxWait == nil {
+		l.maxWait = defaultMaxWait
+	}
+	l.report()
+	return l
+}
+
+// Limit returns the current concurrency limit.
+func (l *ConcurrencyLimiter) Limit() int {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.algorithm.Limit()
+}
+
+// Priority returns the priority of r.
+func (l *ConcurrencyLimiter) Priority(r *http.Request) Priority {
+	for _, rule := range l.priorities {
+		if matchRoute(rule.Route, r.Method, r.URL.Path) {
+			return rule.Priority
+		}
+	}
+	switch r.URL.Path {
+	case "/healthz", "/livez", "/readyz":
+		return PriorityCritical
+	}
+	return PriorityNormal
+}
+
+// Handler returns the middleware. Place it early in the chain, so shed requests cost as
+// little as possible.
+func (l *ConcurrencyLimiter) Handler(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		p := l.Priority(r)
+		if p == PriorityCritical {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		queuedAt := time.Now()
+		if !l.acquire(r.Context(), p) {
+			if l.metrics != nil {
+				l.metrics.Shed(l.name, p.String())
+			}
+			w.Header().Set("Retry-After", "1")
+			utils.WriteProblemResponse(w, r, utils.Problem{
+				Status: http.StatusServiceUnavailable,
+				Code:   "overloaded",
+				Detail: "the service is overloaded, retry later",
+			})
+			return
+		}
+		if l.metrics != nil {
+			l.metrics.Admitted(l.name, p.String(), time.Since(queuedAt))
+		}
+
+		rw := NewResponseWriter(w)
+		start := time.Now()
+		defer func() {
+			// overload further down, e.g. a timeout, is a signal to back off like queueing
+			status := rw.Status()
+			dropped := status == http.StatusServiceUnavailable || status == http.StatusGatewayTimeout
+			l.release(time.Since(start), dropped)
+		}()
+		next.ServeHTTP(rw, r)
+	})
+}
+
+// acquire waits for a slot until the priority's max wait passed or ctx is done.
+func (l *ConcurrencyLimiter) acquire(ctx context.Context, p Priority) bool {
+	l.mu.Lock()
+	if l.inFlight < l.algorithm.Limit() {
+		l.inFlight++
+		l.report()
+		l.mu.Unlock()
+		return true
+	}
+	maxWait := l.maxWait[p]
+	if maxWait <= 0 {
+		l.mu.Unlock()
+		return false
+	}
+	w := &waiter{ready: make(chan struct{})}
+	l.queues[p] = append(l.queues[p], w)
+	l.queued++
+	l.report()
+	l.mu.Unlock()
+
+	timer := time.NewTimer(maxWait)
+	defer timer.Stop()
+	select {
+	case <-w.ready:
+		return true
+	case <-timer.C:
+	case <-ctx.Done():
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if w.granted {
+		return true // granted while timing out, the slot is ours
+	}
+	for i, qw := range l.queues[p] {
+		if qw == w {
+			l.queues[p] = append(l.queues[p][:i], l.queues[p][i+1:]...)
+			break
+		}
+	}
+	l.queued--
+	l.report()
+	return false
+}
+
+// release frees a slot, updates the limit with the request's latency and admits waiting
+// requests, highest priority first.
+func (l *ConcurrencyLimiter) release(rtt time.Duration, dropped bool) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	limit := l.algorithm.Update(rtt, l.inFlight, dropped)
+	l.inFlight--
+	for p := PriorityHigh; p < numPriorities && l.inFlight < limit; {
+		if len(l.queues[p]) == 0 {
+			p++
+			continue
+		}
+		w := l.queues[p][0]
+		l.queues[p] = l.queues[p][1:]
+		l.queued--
+		l.inFlight++
+		w.granted = true
+		close(w.ready)
+	}
+	l.report()
+}
+
+// report exports the limiter state. It must be called with mu held.
+func (l *ConcurrencyLimiter) report() {
+	if l.metrics != nil {
+		l.metrics.State(l.name, l.algorithm.Limit(), l.inFlight, l.queued)
+	}
+}
+
+// LimitAlgorithm computes the concurrency limit from the latency of served requests. The
+// limiter serialises calls, so implementations need not be safe for concurrent use.
+type LimitAlgorithm interface {
+	// Limit returns the current limit.
+	Limit() int
+	// Update records a request that took rtt with inFlight requests being served,
+	// including itself, and returns the new limit. dropped reports an overload signal.
+	Update(rtt time.Duration, inFlight int, dropped bool) int
+}
+
+// AIMDLimitConfig configures an AIMDLimit.
+type AIMDLimitConfig struct {
+	// Initial, Min and Max bound the limit; 20, 1 and 1000 by default.
+	Initial, Min, Max int
+	// BackoffRatio multiplies the limit on overload, 0.9 by default.
+	BackoffRatio float64
+	// Timeout is the latency treated as overload, 1s by default.
+	Timeout time.Duration
+}
+
+// AIMDLimit grows the limit by one while it is being used and requests are fast, and
+// shrinks it by BackoffRatio when a request is slower than Timeout or dropped.
+type AIMDLimit struct {
+	limit, min, max int
+	backoff         float64
+	timeout         time.Duration
+}
+
+// NewAIMDLimit returns an AIMDLimit with the defaults applied to cfg.
+func NewAIMDLimit(cfg AIMDLimitConfig) *AIMDLimit {
+	a := &AIMDLimit{limit: cfg.Initial, min: cfg.Min, max: cfg.Max, backoff: cfg.BackoffRatio, timeout: cfg.Timeout}
+	if a.limit <= 0 {
+		a.limit = 20
+	}
+	if a.min <= 0 {
+		a.min = 1
+	}
+	if a.max <= 0 {
+		a.max = 1000
+	}
+	if a.backoff <= 0 || a.backoff >= 1 {
+		a.backoff = 0.9
+	}
+	if a.timeout <= 0 {
+		a.timeout = time.Second
+	}
+	return a
+}
+
+func (a *AIMDLimit) Limit() int {
+	return a.limit
+}
+
+func (a *AIMDLimit) Update(rtt time.Duration, inFlight int, dropped bool) int {
+	switch {
+	case dropped || rtt > a.timeout:
+		a.limit = max(a.min, int(float64(a.limit)*a.backoff))
+	case inFlight*2 >= a.limit:
+		a.limit = min(a.max, a.limit+1)
+	}
+	return a.limit
+}
+
+// GradientLimitConfig configures a GradientLimit.
+type GradientLimitConfig struct {
+	// Initial, Min and Max bound the limit; 20, 10 and 1000 by default.
+	Initial, Min, Max int
+	// Tolerance is how much slower than the long-term average requests may get before the
+	// limit shrinks, 1.5 by default.
+	Tolerance float64
+	// Smoothing weighs new limits against the current one, 0.2 by default.
+	Smoothing float64
+	// QueueSize is the headroom added to the limit so it can grow, 4 by default.
+	QueueSize int
+	// LongWindow is the number of samples of the long-term latency average, 600 by default.
+	LongWindow int
+}
+
+// GradientLimit follows Netflix's Gradient2 algorithm: it compares each request's latency
+// with the long-term average and shrinks the limit as the ratio drops, which detects
+// queueing before it causes timeouts.
+type GradientLimit struct {
+	limit      float64
+	min, max   float64
+	tolerance  float64
+	smoothing  float64
+	queueSize  float64
+	longWindow float64
+	longRTT    float64
+}
+
+// NewGradientLimit returns a GradientLimit with the defaults applied to cfg.
+func NewGradientLimit(cfg GradientLimitConfig) *GradientLimit {
+	g := &GradientLimit{
+		limit:      float64(cfg.Initial),
+		min:        float64(cfg.Min),
+		max:        float64(cfg.Max),
+		tolerance:  cfg.Tolerance,
+		smoothing:  cfg.Smoothing,
+		queueSize:  float64(cfg.QueueSize),
+		longWindow: float64(cfg.LongWindow),
+	}
+	if g.limit <= 0 {
+		g.limit = 20
+	}
+	if g.min <= 0 {
+		g.min = 10
+	}
+	if g.max <= 0 {
+		g.max = 1000
+	}
+	if g.tolerance < 1 {
+		g.tolerance = 1.5
+	}
+	if g.smoothing <= 0 || g.smoothing > 1 {
+		g.smoothing = 0.2
+	}
+	if g.queueSize <= 0 {
+		g.queueSize = 4
+	}
+	if g.longWindow <= 0 {
+		g.longWindow = 600
+	}
+	return g
+}
+
+func (g *GradientLimit) Limit() int {
+	return int(g.limit)
+}
+
+func (g *GradientLimit) Update(rtt time.Duration, inFlight int, dropped bool) int {
+	short := max(rtt.Seconds(), 1e-6)
+	if g.longRTT == 0 {
+		g.longRTT = short
+	} else {
+		g.longRTT += (short - g.longRTT) / g.longWindow
+	}
+	// once latency recovered, decay the long-term average faster so the limit can grow again
+	if g.longRTT/short > 2 {
+		g.longRTT *= 0.95
+	}
+
+	// an underused limit says nothing about the service's capacity
+	if !dropped && float64(inFlight) < g.limit/2 {
+		return int(g.limit)
+	}
+
+	gradient := math.Max(0.5, math.Min(1, g.tolerance*g.longRTT/short))
+	if dropped {
+		gradient = 0.5
+	}
+	newLimit := g.limit*gradient + g.queueSize
+	newLimit = g.limit*(1-g.smoothing) + newLimit*g.smoothing
+	g.limit = math.Max(g.min, math.Min(g.max, newLimit))
+	return int(g.limit)
+}
@@ -1,16 +1,237 @@
 package middlewares
 
 import (
+	"errors"
+	"fmt"
 	"net/http"
+	"strconv"
+	"strings"
+	"time"
 )
 
-func Cors(w http.ResponseWriter, r *http.Request, next http.HandlerFunc) {
-	w.Header().Set("Access-Control-Allow-Origin", "*")
-	w.Header().Set("Access-Control-Allow-Methods", "GET, POST, OPTIONS")
-	w.Header().Set("Access-Control-Allow-Headers", "Accept, Authorization, Content-Type")
-	w.Header().Set("Content-Type", "application/json")
-	if r.Method == "OPTIONS" {
+/*
+CORS (Cross-Origin Resource Sharing) following the Fetch standard.
+
+	cors, err := middlewares.NewCors(middlewares.CorsConfig{
+		AllowedOrigins:   []string{"https://app.example.com", "https://*.example.com"},
+		AllowedMethods:   []string{http.MethodGet, http.MethodPost, http.MethodPut, http.MethodDelete},
+		ExposedHeaders:   []string{"X-Request-ID"},
+		AllowCredentials: true,
+		MaxAge:           10 * time.Minute,
+	})
+	handler := cors.Handler(mux)
+Refs
+https://fetch.spec.whatwg.org/#http-cors-protocol
+https://developer.mozilla.org/en-US/docs/Web/HTTP/CORS
+*/
+
+// CorsConfig configures a CorsPolicy.
+type CorsConfig struct {
+	// AllowedOrigins are exact origins such as "https://app.example.com", wildcard
+	// subdomain origins such as "https://*.example.com" matching any subdomain but not
+	// example.com itself, or "*" for any origin.
+	AllowedOrigins []string
+	// AllowedMethods defaults to GET, HEAD and POST.
+	AllowedMethods []string
+	// AllowedHeaders are the request headers clients may send, "*" for any. Defaults to
+	// Accept, Authorization and Content-Type.
+	AllowedHeaders []string
+	// ExposedHeaders are the response headers scripts may read besides the safelisted ones.
+	ExposedHeaders []string
+	// AllowCredentials lets browsers send cookies and client certificates. It cannot be
+	// combined with the "*" origin.
+	AllowCredentials bool
+	// MaxAge is how long browsers may cache a preflight response. Zero leaves it to the
+	// browser's default of 5 seconds.
+	MaxAge time.Duration
+}
+
+// CorsPolicy is a CORS middleware created by NewCors.
+type CorsPolicy struct {
+	allowAll         bool
+	origins          map[string]bool
+	wildcards        []wildcardOrigin
+	methods          map[string]bool
+	allowedMethods   string
+	allowAllHeaders  bool
+	headers          map[string]bool
+	exposedHeaders   string
+	allowCredentials bool
+	maxAge           string
+}
+
+// wildcardOrigin matches "<scheme>://<subdomain>.<suffix>".
+type wildcardOrigin struct {
+	scheme, suffix string
+}
+
+var defaultCors, _ = NewCors(CorsConfig{
+	AllowedOrigins: []string{"*"},
+	AllowedMethods: []string{http.MethodGet, http.MethodHead, http.MethodPost, http.MethodPut, http.MethodPatch, http.MethodDelete},
+})
+
+// NewCors validates cfg and returns the policy enforcing it.
+func NewCors(cfg CorsConfig) (*CorsPolicy, error) {
+	c := &CorsPolicy{
+		origins:          map[string]bool{},
+		methods:          map[string]bool{},
+		headers:          map[string]bool{},
+		exposedHeaders:   strings.Join(cfg.ExposedHeaders, ", "),
+		allowCredentials: cfg.AllowCredentials,
+	}
+
+	for _, origin := range cfg.AllowedOrigins {
+		origin = strings.ToLower(strings.TrimSpace(origin))
+		switch {
+		case origin == "*":
+			c.allowAll = true
+		case strings.Contains(origin, "*"):
+			scheme, rest, ok := strings.Cut(origin, "://")
+			suffix, found := strings.CutPrefix(rest, "*.")
+			if !ok || !found || suffix == "" || strings.Contains(suffix, "*") {
+				return nil, fmt.Errorf("invalid wildcard origin %q, want <scheme>://*.<domain>", origin)
+			}
+			c.wildcards = append(c.wildcards, wildcardOrigin{scheme: scheme + "://", suffix: "." + suffix})
+		default:
+			c.origins[origin] = true
+		}
+	}
+	if c.allowAll && c.allowCredentials {
+		return nil, errors.New(`cors: credentials cannot be allowed for the "*" origin`)
+	}
+
+	methods := []string{http.MethodGet, http.MethodHead, http.MethodPost}
+	if len(cfg.AllowedMethods) > 0 {
+		methods = make([]string, len(cfg.AllowedMethods))
+		for i, m := range cfg.AllowedMethods {
+			methods[i] = strings.ToUpper(m)
+		}
+	}
+	for _, m := range methods {
+		c.methods[m] = true
+	}
+	c.allowedMethods = strings.Join(methods, ", ")
+
+	headers := cfg.AllowedHeaders
+	if len(headers) == 0 {
+		headers = []string{"Accept", "Authorization", "Content-Type"}
+	}
+	for _, h := range headers {
+		if h == "*" {
+			c.allowAllHeaders = true
+		}
+		c.headers[strings.ToLower(h)] = true
+	}
+
+	if cfg.MaxAge > 0 {
+		c.maxAge = strconv.Itoa(int(cfg.MaxAge.Seconds()))
+	}
+	return c, nil
+}
+
+// OriginAllowed reports whether origin matches the allowed origins.
+func (c *CorsPolicy) OriginAllowed(origin string) bool {
+	if c.allowAll {
+		return true
+	}
+	origin = strings.ToLower(origin)
+	if c.origins[origin] {
+		return true
+	}
+	for _, w := range c.wildcards {
+		host, ok := strings.CutPrefix(origin, w.scheme)
+		if ok && len(host) > len(w.suffix) && strings.HasSuffix(host, w.suffix) && !strings.ContainsAny(host, "/?#@") {
+			return true
+		}
+	}
+	return false
+}
+
+// Handler returns the CORS middleware. Preflight requests are answered with 204 No Content
+// without calling next; disallowed origins get no CORS headers, so browsers block them.
+func (c *CorsPolicy) Handler(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		c.serve(w, r, next.ServeHTTP)
+	})
+}
+
+func (c *CorsPolicy) serve(w http.ResponseWriter, r *http.Request, next http.HandlerFunc) {
+	if r.Method == http.MethodOptions && r.Header.Get("Access-Control-Request-Method") != "" {
+		c.preflight(w, r)
 		return
 	}
+
+	// caches must key responses on the origin unless every origin gets the same answer
+	if !c.allowAll {
+		w.Header().Add("Vary", "Origin")
+	}
+	origin := r.Header.Get("Origin")
+	if origin != "" && c.OriginAllowed(origin) {
+		c.setAllowOrigin(w, origin)
+		if c.exposedHeaders != "" {
+			w.Header().Set("Access-Control-Expose-Headers", c.exposedHeaders)
+		}
+	}
 	next(w, r)
 }
+
+func (c *CorsPolicy) preflight(w http.ResponseWriter, r *http.Request) {
+	h := w.Header()
+	h.Add("Vary", "Origin")
+	h.Add("Vary", "Access-Control-Request-Method")
+	h.Add("Vary", "Access-Control-Request-Headers")
+	defer w.WriteHeader(http.StatusNoContent)
+
+	origin := r.Header.Get("Origin")
+	if origin == "" || !c.OriginAllowed(origin) || !c.methods[strings.ToUpper(r.Header.Get("Access-Control-Request-Method"))] {
+		return
+	}
+	requested := r.Header.Get("Access-Control-Request-Headers")
+	if !c.headersAllowed(requested) {
+		return
+	}
+
+	c.setAllowOrigin(w, origin)
+	h.Set("Access-Control-Allow-Methods", c.allowedMethods)
+	if requested != "" {
+		h.Set("Access-Control-Allow-Headers", requested)
+	}
+	if c.maxAge != "" {
+		h.Set("Access-Control-Max-Age", c.maxAge)
+	}
+}
+
+func (c *CorsPolicy) setAllowOrigin(w http.ResponseWriter, origin string) {
+	if c.allowAll {
+		w.Header().Set("Access-Control-Allow-Origin", "*")
+		return
+	}
+	w.Header().Set("Access-Control-Allow-Origin", origin)
+	if c.allowCredentials {
+		w.Header().Set("Access-Control-Allow-Credentials", "true")
+	}
+}
+
+// headersAllowed checks a comma separated Access-Control-Request-Headers value.
+func (c *CorsPolicy) headersAllowed(requested string) bool {
+	if c.allowAllHeaders || requested == "" {
+		return true
+	}
+	for _, h := range strings.Split(requested, ",") {
+		if h = strings.ToLower(strings.TrimSpace(h)); h != "" && !c.headers[h] {
+			return false
+		}
+	}
+	return true
+}
+
+// Cors allows requests from any origin, without credentials. Use NewCors to restrict
+// origins or allow credentials.
+func Cors(w http.ResponseWriter, r *http.Request, next http.HandlerFunc) {
+	defaultCors.serve(w, r, next)
+}
+
+// CorsMiddleware adapts Cors to the Middleware signature.
+func CorsMiddleware(next http.Handler) http.Handler {
+	return defaultCors.Handler(next)
+}
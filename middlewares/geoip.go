@@ -0,0 +1,74 @@
+package middlewares
+
+import (
+	"errors"
+	"net/http"
+
+	"github.com/harphies/go.microservices.io/utils"
+	"github.com/harphies/go.microservices.io/utils/geoip"
+	"go.uber.org/zap"
+)
+
+/*
+The location of the client of each request, looked up offline by a geoip.Provider:
+
+	geo := middlewares.NewGeoIP(logger, provider)
+	handler := middlewares.NewChain(middlewares.ClientIP(resolver), geo.Handler, access.Handler).Then(mux)
+
+The location is stored on the context (geoip.LocationFromContext) and added to the context
+logger as geo_country, geo_region, geo_city and asn, so it is in the logs of the handler
+and the entries of an inner AccessLogger. A context without a logger gets the logger of
+the middleware. Private and other non-public addresses are not looked up.
+*/
+
+// GeoIP is the geolocation middleware created by NewGeoIP.
+type GeoIP struct {
+	logger   *zap.Logger
+	provider geoip.Provider
+}
+
+// NewGeoIP returns the geolocation middleware looking up client addresses in provider.
+func NewGeoIP(logger *zap.Logger, provider geoip.Provider) *GeoIP {
+	return &GeoIP{logger: logger, provider: provider}
+}
+
+// Handler returns the geolocation middleware. Requests are served without a location if
+// the lookup fails.
+func (g *GeoIP) Handler(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		addr := utils.ClientIP(r)
+		if !addr.IsValid() || !addr.IsGlobalUnicast() || addr.IsPrivate() {
+			next.ServeHTTP(w, r)
+			return
+		}
+		loc, err := g.provider.Lookup(addr)
+		if err != nil {
+			if !errors.Is(err, geoip.ErrNotFound) {
+				g.logger.Warn("geoip lookup failed", zap.String("client_ip", addr.String()), zap.Error(err))
+			}
+			next.ServeHTTP(w, r)
+			return
+		}
+		ctx := geoip.ContextWithLocation(r.Context(), loc)
+		ctx = contextWithLogFields(ctx, g.logger, locationFields(loc)...)
+		serveWithContext(ctx, next, w, r)
+	})
+}
+
+// locationFields are the log fields of loc that are known.
+func locationFields(loc geoip.Location) []zap.Field {
+	var fields []zap.Field
+	if loc.Country != "" {
+		fields = append(fields, zap.String("geo_country", loc.Country))
+	}
+	if loc.Region != "" {
+		fields = append(fields, zap.String("geo_region", loc.Region))
+	}
+	if loc.City != "" {
+		fields = append(fields, zap.String("geo_city", loc.City))
+	}
+	if loc.ASN != 0 {
+		fields = append(fields, zap.Uint("asn", loc.ASN))
+	}
+	return fields
+}
@@ -0,0 +1,68 @@
+package middlewares
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"testing"
+
+	"github.com/harphies/go.microservices.io/observability/logging"
+	"github.com/harphies/go.microservices.io/utils/geoip"
+	"go.uber.org/zap"
+	"go.uber.org/zap/zaptest/observer"
+)
+
+type staticGeoIP map[netip.Addr]geoip.Location
+
+func (p staticGeoIP) Lookup(addr netip.Addr) (geoip.Location, error) {
+	if loc, ok := p[addr]; ok {
+		return loc, nil
+	}
+	return geoip.Location{}, geoip.ErrNotFound
+}
+
+func TestGeoIPFieldsReachHandlerAndAccessLogs(t *testing.T) {
+	core, logs := observer.New(zap.InfoLevel)
+	logger := zap.New(core)
+	provider := staticGeoIP{netip.MustParseAddr("81.2.69.160"): {Country: "GB", Region: "ENG", City: "London", ASN: 20712}}
+
+	geo := NewGeoIP(logger, provider)
+	access := NewAccessLogger(logger, AccessLogConfig{})
+	handler := NewChain(geo.Handler, access.Handler).Then(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if loc, ok := geoip.LocationFromContext(r.Context()); !ok || loc.City != "London" {
+			t.Errorf("location = %+v, %v", loc, ok)
+		}
+		logging.LoggerFromContext(r.Context()).Info("handled")
+	}))
+
+	r := httptest.NewRequest(http.MethodGet, "/orders", nil)
+	r.RemoteAddr = "81.2.69.160:4711"
+	handler.ServeHTTP(httptest.NewRecorder(), r)
+
+	entries := logs.TakeAll()
+	if len(entries) != 2 {
+		t.Fatalf("got %d log entries, want the handler's and the access log", len(entries))
+	}
+	for _, e := range entries {
+		fields := e.ContextMap()
+		if fields["geo_country"] != "GB" || fields["geo_region"] != "ENG" || fields["geo_city"] != "London" || fields["asn"] != uint64(20712) {
+			t.Errorf("%q entry has %v, want the location fields once", e.Message, fields)
+		}
+		seen := map[string]bool{}
+		for _, f := range e.Context {
+			if seen[f.Key] {
+				t.Errorf("%q entry has %s twice", e.Message, f.Key)
+			}
+			seen[f.Key] = true
+		}
+	}
+
+	// private addresses are not looked up and get no fields
+	r = httptest.NewRequest(http.MethodGet, "/orders", nil)
+	r.RemoteAddr = "10.0.0.1:4711"
+	NewChain(geo.Handler).Then(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if _, ok := geoip.LocationFromContext(r.Context()); ok {
+			t.Error("private address has a location")
+		}
+	})).ServeHTTP(httptest.NewRecorder(), r)
+}
@@ -0,0 +1,572 @@
+package middlewares
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"net"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/harphies/go.microservices.io/storage/cache/redis"
+	"go.uber.org/zap"
+)
+
+/*
+HTTP caching for read-heavy endpoints: ETags and conditional requests for GET and HEAD,
+Cache-Control per route, and a shared store of full responses.
+
+	httpCache := middlewares.NewHTTPCache(logger, middlewares.HTTPCacheConfig{
+		Store: middlewares.NewRedisResponseCache(cacheStore),
+		Rules: []middlewares.CacheRule{
+			{Route: "GET /products/...", CacheControl: "public, max-age=60", TTL: time.Minute, Public: true},
+			{Route: "GET /orders/{id}", CacheControl: "private, no-cache", TTL: 10 * time.Minute, Vary: []string{"Accept-Language"}},
+		},
+	})
+	handler := middlewares.NewChain(compressor.Handler, httpCache.Handler).Then(mux)
+
+Handlers tag the responses they serve, and invalidate the tags after writes:
+
+	middlewares.TagResponse(r.Context(), "order:"+id)           // in GET /orders/{id}
+	middlewares.InvalidateCacheTags(r.Context(), "order:"+id)   // in PATCH /orders/{id}
+
+Responses without an ETag get one computed from their body. Responses larger than
+MaxBodySize, or flushed by the handler, are streamed without one and are not stored.
+If-None-Match and If-Modified-Since are answered with 304 Not Modified, also for stored
+responses. Place the cache after the Compressor, so it hashes and stores identity bodies.
+Refs
+https://www.rfc-editor.org/rfc/rfc9110#name-conditional-requests
+https://www.rfc-editor.org/rfc/rfc9111
+https://www.rfc-editor.org/rfc/rfc9211
+*/
+
+const (
+	defaultCacheBodySize = 1 << 20
+	cacheStatusHeader    = "Cache-Status"
+	cacheStatusName      = "httpcache"
+	responseCachePrefix  = "httpcache:"
+)
+
+// notModifiedHeaders are the headers of a 304 response, see RFC 9110 section 15.4.5.
+var notModifiedHeaders = []string{"Cache-Control", "Content-Location", "Date", "Etag", "Expires", "Vary", "Last-Modified", cacheStatusHeader}
+
+// CacheRule applies to GET and HEAD requests matching Route, a "[METHOD ]pattern" route as
+// in IdentityRule.
+type CacheRule struct {
+	Route string
+	// CacheControl is sent with 2xx responses that don't set their own.
+	CacheControl string
+	// TTL keeps 200 responses in the store; zero doesn't store them.
+	TTL time.Duration
+	// Vary are the request headers the response depends on. They are sent as Vary and are
+	// part of the key of stored responses.
+	Vary []string
+	// Public responses are the same for every client. Others are stored per authenticated
+	// principal, or per Authorization and Cookie header.
+	Public bool
+}
+
+// HTTPCacheConfig configures an HTTPCache.
+type HTTPCacheConfig struct {
+	// Rules are matched in order, the first match wins. Requests matching none still get
+	// ETags and conditional responses.
+	Rules []CacheRule
+	// Store keeps responses of rules with a TTL; nil disables storing.
+	Store ResponseCache
+	// WeakETags computes weak ETags, for responses that are equivalent but not identical
+	// byte for byte.
+	WeakETags bool
+	// MaxBodySize is the largest response buffered for its ETag, 1MB by default.
+	MaxBodySize int64
+}
+
+// CachedResponse is a response kept by a ResponseCache.
+type CachedResponse struct {
+	Status   int         `json:"status"`
+	Header   http.Header `json:"header"`
+	Body     []byte      `json:"body"`
+	StoredAt time.Time   `json:"stored_at"`
+}
+
+// ResponseCache stores responses for the HTTPCache.
+type ResponseCache interface {
+	// Get returns the response stored at key, or nil if there is none.
+	Get(ctx context.Context, key string) (*CachedResponse, error)
+	// Set stores resp at key for ttl, tagged with tags.
+	Set(ctx context.Context, key string, resp *CachedResponse, ttl time.Duration, tags []string) error
+	// Invalidate deletes the responses tagged with any of tags.
+	Invalidate(ctx context.Context, tags ...string) error
+}
+
+type cacheTagsContextKey struct{}
+
+// cacheTags collects the tags a handler sets on its response and invalidates.
+type cacheTags struct {
+	mu         sync.Mutex
+	tags       []string
+	invalidate []string
+}
+
+// TagResponse tags the response of the request of ctx, so it is dropped from the store
+// when one of tags is invalidated. It does nothing outside an HTTPCache.
+func TagResponse(ctx context.Context, tags ...string) {
+	if c, ok := ctx.Value(cacheTagsContextKey{}).(*cacheTags); ok {
+		c.mu.Lock()
+		c.tags = append(c.tags, tags...)
+		c.mu.Unlock()
+	}
+}
+
+// InvalidateCacheTags drops the stored responses tagged with any of tags once the request
+// of ctx succeeded, i.e. a POST, PUT, PATCH or DELETE answered below 400. Use
+// HTTPCache.Invalidate outside of requests, e.g. in consumers.
+func InvalidateCacheTags(ctx context.Context, tags ...string) {
+	if c, ok := ctx.Value(cacheTagsContextKey{}).(*cacheTags); ok {
+		c.mu.Lock()
+		c.invalidate = append(c.invalidate, tags...)
+		c.mu.Unlock()
+	}
+}
+
+// HTTPCache is the caching middleware created by NewHTTPCache.
+type HTTPCache struct {
+	logger      *zap.Logger
+	rules       []CacheRule
+	store       ResponseCache
+	weakETags   bool
+	maxBodySize int64
+}
+
+// NewHTTPCache returns the caching middleware for cfg.
+func NewHTTPCache(logger *zap.Logger, cfg HTTPCacheConfig) *HTTPCache {
+	c := &HTTPCache{
+		logger:      logger,
+		rules:       cfg.Rules,
+		store:       cfg.Store,
+		weakETags:   cfg.WeakETags,
+		maxBodySize: cfg.MaxBodySize,
+	}
+	if c.maxBodySize <= 0 {
+		c.maxBodySize = defaultCacheBodySize
+	}
+	return c
+}
+
+// Invalidate drops the stored responses tagged with any of tags.
+func (c *HTTPCache) Invalidate(ctx context.Context, tags ...string) error {
+	if c.store == nil || len(tags) == 0 {
+		return nil
+	}
+	return c.store.Invalidate(ctx, tags...)
+}
+
+// Handler returns the caching middleware. Store failures are logged and the request is
+// served without the store.
+func (c *HTTPCache) Handler(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		tags := &cacheTags{}
+		ctx := context.WithValue(r.Context(), cacheTagsContextKey{}, tags)
+
+		if r.Method != http.MethodGet && r.Method != http.MethodHead {
+			rw := NewResponseWriter(w)
+			serveWithContext(ctx, next, rw, r)
+			if rw.Status() < http.StatusBadRequest && len(tags.invalidate) > 0 {
+				// the response is sent, so the invalidation must not be cancelled with it
+				if err := c.Invalidate(context.WithoutCancel(ctx), tags.invalidate...); err != nil {
+					c.logger.Error("http cache invalidation failed", zap.Strings("tags", tags.invalidate), zap.Error(err))
+				}
+			}
+			return
+		}
+
+		rule := c.rule(r)
+		var key string
+		if rule != nil && rule.TTL > 0 && c.store != nil {
+			key = cacheKey(r, rule)
+			cached, err := c.store.Get(r.Context(), key)
+			if err != nil {
+				c.logger.Warn("http cache lookup failed", zap.String("path", r.URL.Path), zap.Error(err))
+			}
+			if cached != nil {
+				c.serveCached(w, r, cached)
+				return
+			}
+		}
+
+		rec := &cacheRecorder{ResponseWriter: w, rule: rule, limit: c.maxBodySize}
+		serveWithContext(ctx, next, rec, r)
+		if rec.passthrough {
+			return
+		}
+
+		// only 200 responses are buffered
+		h := w.Header()
+		applyCacheRule(h, rule, http.StatusOK)
+		// HEAD handlers may leave the body out, so there is nothing to hash
+		if h.Get("ETag") == "" && (r.Method == http.MethodGet || rec.body.Len() > 0) {
+			h.Set("ETag", c.etag(rec.body.Bytes()))
+		}
+		if key != "" && r.Method == http.MethodGet && storable(h) {
+			c.storeResponse(ctx, key, rule, h, rec.body.Bytes(), tags)
+		}
+		if notModified(r, h) {
+			writeNotModified(w)
+			return
+		}
+
+		if h.Get("Content-Length") == "" && h.Get("Transfer-Encoding") == "" {
+			h.Set("Content-Length", strconv.Itoa(rec.body.Len()))
+		}
+		w.WriteHeader(http.StatusOK)
+		if r.Method != http.MethodHead {
+			w.Write(rec.body.Bytes())
+		}
+	})
+}
+
+// applyCacheRule sets the Cache-Control and Vary headers of rule on a response with status.
+func applyCacheRule(h http.Header, rule *CacheRule, status int) {
+	if rule == nil || status < http.StatusOK || status >= http.StatusMultipleChoices {
+		return
+	}
+	if rule.CacheControl != "" && h.Get("Cache-Control") == "" {
+		h.Set("Cache-Control", rule.CacheControl)
+	}
+	for _, name := range rule.Vary {
+		h.Add("Vary", name)
+	}
+}
+
+// rule returns the first rule matching r, HEAD requests matching GET routes.
+func (c *HTTPCache) rule(r *http.Request) *CacheRule {
+	for i := range c.rules {
+		if matchRoute(c.rules[i].Route, http.MethodGet, r.URL.Path) {
+			return &c.rules[i]
+		}
+	}
+	return nil
+}
+
+func (c *HTTPCache) etag(body []byte) string {
+	sum := sha256.Sum256(body)
+	tag := `"` + base64.RawURLEncoding.EncodeToString(sum[:16]) + `"`
+	if c.weakETags {
+		return "W/" + tag
+	}
+	return tag
+}
+
+func (c *HTTPCache) storeResponse(ctx context.Context, key string, rule *CacheRule, h http.Header, body []byte, tags *cacheTags) {
+	resp := &CachedResponse{
+		Status:   http.StatusOK,
+		Header:   h.Clone(),
+		Body:     bytes.Clone(body),
+		StoredAt: time.Now(),
+	}
+	for _, name := range []string{"Date", cacheStatusHeader, "Content-Length"} {
+		resp.Header.Del(name)
+	}
+	if err := c.store.Set(context.WithoutCancel(ctx), key, resp, rule.TTL, tags.tags); err != nil {
+		c.logger.Warn("http cache store failed", zap.String("key", key), zap.Error(err))
+		return
+	}
+	h.Set(cacheStatusHeader, cacheStatusName+"; fwd=uri-miss; stored")
+}
+
+func (c *HTTPCache) serveCached(w http.ResponseWriter, r *http.Request, cached *CachedResponse) {
+	h := w.Header()
+	for k, v := range cached.Header {
+		h[k] = slices.Clone(v)
+	}
+	h.Set("Age", strconv.Itoa(int(max(time.Since(cached.StoredAt), 0).Seconds())))
+	h.Set(cacheStatusHeader, cacheStatusName+"; hit")
+	if notModified(r, h) {
+		writeNotModified(w)
+		return
+	}
+	h.Set("Content-Length", strconv.Itoa(len(cached.Body)))
+	w.WriteHeader(cached.Status)
+	if r.Method != http.MethodHead {
+		w.Write(cached.Body)
+	}
+}
+
+// cacheKey identifies the response to r among those of rule: the URL, the Vary headers and,
+// unless the rule is public, the client.
+func cacheKey(r *http.Request, rule *CacheRule) string {
+	h := sha256.New()
+	h.Write([]byte(r.URL.Path + "?" + r.URL.Query().Encode() + "\n"))
+	for _, name := range rule.Vary {
+		h.Write([]byte(http.CanonicalHeaderKey(name) + ": " + strings.Join(r.Header.Values(name), ",") + "\n"))
+	}
+	if !rule.Public {
+		// only a verified principal is trusted, other credentials are part of the key as is
+		if p, ok := PrincipalFromContext(r.Context()); ok && p.Subject != "" {
+			h.Write([]byte("sub:" + p.Subject + "\n"))
+		} else {
+			h.Write([]byte("Authorization: " + r.Header.Get("Authorization") + "\n"))
+			h.Write([]byte("Cookie: " + r.Header.Get("Cookie") + "\n"))
+		}
+	}
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// storable reports whether a response with header h may be stored.
+func storable(h http.Header) bool {
+	if h.Get("Set-Cookie") != "" || h.Get("Vary") == "*" {
+		return false
+	}
+	for _, directive := range strings.Split(h.Get("Cache-Control"), ",") {
+		if strings.EqualFold(strings.TrimSpace(directive), "no-store") {
+			return false
+		}
+	}
+	return true
+}
+
+// notModified evaluates the conditional headers of r against the response header h.
+// If-Modified-Since is ignored when If-None-Match is present.
+func notModified(r *http.Request, h http.Header) bool {
+	if inm := r.Header.Get("If-None-Match"); inm != "" {
+		return etagMatches(inm, h.Get("ETag"))
+	}
+	ims, lm := r.Header.Get("If-Modified-Since"), h.Get("Last-Modified")
+	if ims == "" || lm == "" {
+		return false
+	}
+	since, err := http.ParseTime(ims)
+	if err != nil {
+		return false
+	}
+	modified, err := http.ParseTime(lm)
+	return err == nil && !modified.After(since)
+}
+
+// etagMatches compares the If-None-Match list with etag, using weak comparison.
+func etagMatches(ifNoneMatch, etag string) bool {
+	if etag == "" {
+		return false
+	}
+	etag = strings.TrimPrefix(etag, "W/")
+	for _, candidate := range strings.Split(ifNoneMatch, ",") {
+		candidate = strings.TrimSpace(candidate)
+		if candidate == "*" || strings.TrimPrefix(candidate, "W/") == etag {
+			return true
+		}
+	}
+	return false
+}
+
+func writeNotModified(w http.ResponseWriter) {
+	h := w.Header()
+	for k := range h {
+		if !slices.Contains(notModifiedHeaders, http.CanonicalHeaderKey(k)) {
+			delete(h, k)
+		}
+	}
+	w.WriteHeader(http.StatusNotModified)
+}
+
+// cacheRecorder buffers 200 responses up to limit bytes. Other responses, larger ones and
+// flushed ones are passed through.
+type cacheRecorder struct {
+	http.ResponseWriter
+	rule        *CacheRule
+	status      int
+	body        bytes.Buffer
+	limit       int64
+	passthrough bool
+}
+
+func (rec *cacheRecorder) WriteHeader(code int) {
+	if rec.passthrough || rec.status != 0 {
+		return
+	}
+	if code >= 100 && code < 200 && code != http.StatusSwitchingProtocols {
+		rec.ResponseWriter.WriteHeader(code)
+		return
+	}
+	rec.status = code
+	if code != http.StatusOK {
+		rec.startPassthrough()
+	}
+}
+
+func (rec *cacheRecorder) Write(b []byte) (int, error) {
+	if rec.status == 0 {
+		rec.WriteHeader(http.StatusOK)
+	}
+	if rec.passthrough {
+		return rec.ResponseWriter.Write(b)
+	}
+	if int64(rec.body.Len()+len(b)) > rec.limit {
+		if _, err := rec.startPassthrough(); err != nil {
+			return 0, err
+		}
+		return rec.ResponseWriter.Write(b)
+	}
+	return rec.body.Write(b)
+}
+
+// startPassthrough writes the header and the buffered body.
+func (rec *cacheRecorder) startPassthrough() (int, error) {
+	rec.passthrough = true
+	applyCacheRule(rec.ResponseWriter.Header(), rec.rule, rec.status)
+	rec.ResponseWriter.WriteHeader(rec.status)
+	n, err := rec.ResponseWriter.Write(rec.body.Bytes())
+	rec.body = bytes.Buffer{}
+	return n, err
+}
+
+func (rec *cacheRecorder) Flush() {
+	if !rec.passthrough {
+		if rec.status == 0 {
+			rec.status = http.StatusOK
+		}
+		rec.startPassthrough()
+	}
+	http.NewResponseController(rec.ResponseWriter).Flush()
+}
+
+func (rec *cacheRecorder) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	rec.passthrough = true
+	return http.NewResponseController(rec.ResponseWriter).Hijack()
+}
+
+func (rec *cacheRecorder) Unwrap() http.ResponseWriter {
+	return rec.ResponseWriter
+}
+
+// MemoryResponseCache keeps responses in process, for tests and services with a single
+// replica. It is safe for concurrent use.
+type MemoryResponseCache struct {
+	mu        sync.Mutex
+	responses map[string]memoryCachedResponse
+	tags      map[string]map[string]struct{}
+}
+
+type memoryCachedResponse struct {
+	resp    *CachedResponse
+	expires time.Time
+}
+
+// NewMemoryResponseCache returns an empty in-process store.
+func NewMemoryResponseCache() *MemoryResponseCache {
+	return &MemoryResponseCache{
+		responses: map[string]memoryCachedResponse{},
+		tags:      map[string]map[string]struct{}{},
+	}
+}
+
+// Get implements ResponseCache.
+func (s *MemoryResponseCache) Get(_ context.Context, key string) (*CachedResponse, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if stored, ok := s.responses[key]; ok && time.Now().Before(stored.expires) {
+		return stored.resp, nil
+	}
+	return nil, nil
+}
+
+// Set implements ResponseCache.
+func (s *MemoryResponseCache) Set(_ context.Context, key string, resp *CachedResponse, ttl time.Duration, tags []string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := time.Now()
+	for k, stored := range s.responses {
+		if !now.Before(stored.expires) {
+			delete(s.responses, k)
+		}
+	}
+	for tag, keys := range s.tags {
+		for k := range keys {
+			if _, ok := s.responses[k]; !ok {
+				delete(keys, k)
+			}
+		}
+		if len(keys) == 0 {
+			delete(s.tags, tag)
+		}
+	}
+
+	s.responses[key] = memoryCachedResponse{resp: resp, expires: now.Add(ttl)}
+	for _, tag := range tags {
+		if s.tags[tag] == nil {
+			s.tags[tag] = map[string]struct{}{}
+		}
+		s.tags[tag][key] = struct{}{}
+	}
+	return nil
+}
+
+// Invalidate implements ResponseCache.
+func (s *MemoryResponseCache) Invalidate(_ context.Context, tags ...string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, tag := range tags {
+		for k := range s.tags[tag] {
+			delete(s.responses, k)
+		}
+		delete(s.tags, tag)
+	}
+	return nil
+}
+
+// RedisResponseCache keeps responses in Redis, shared by every replica.
+type RedisResponseCache struct {
+	store *redis.CacheStore
+}
+
+// NewRedisResponseCache returns a store using store.
+func NewRedisResponseCache(store *redis.CacheStore) *RedisResponseCache {
+	return &RedisResponseCache{store: store}
+}
+
+// Get implements ResponseCache.
+func (s *RedisResponseCache) Get(ctx context.Context, key string) (*CachedResponse, error) {
+	stored, err := s.store.Get(ctx, responseCachePrefix+key)
+	if errors.Is(err, redis.ErrCacheMiss) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	resp := &CachedResponse{}
+	if err := json.Unmarshal(stored, resp); err != nil {
+		return nil, err
+	}
+	return resp, nil
+}
+
+// Set implements ResponseCache.
+func (s *RedisResponseCache) Set(ctx context.Context, key string, resp *CachedResponse, ttl time.Duration, tags []string) error {
+	value, err := json.Marshal(resp)
+	if err != nil {
+		return err
+	}
+	return s.store.SetTagged(ctx, responseCachePrefix+key, value, ttl, prefixTags(tags)...)
+}
+
+// Invalidate implements ResponseCache.
+func (s *RedisResponseCache) Invalidate(ctx context.Context, tags ...string) error {
+	return s.store.InvalidateTags(ctx, prefixTags(tags)...)
+}
+
+// prefixTags keeps the response tags apart from other tags in the same Redis.
+func prefixTags(tags []string) []string {
+	prefixed := make([]string, len(tags))
+	for i, tag := range tags {
+		prefixed[i] = responseCachePrefix + tag
+	}
+	return prefixed
+}
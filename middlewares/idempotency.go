@@ -0,0 +1,602 @@
+package middlewares
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/harphies/go.microservices.io/storage/cache/redis"
+	"github.com/harphies/go.microservices.io/storage/datastore/relational/postgresql"
+	"github.com/harphies/go.microservices.io/utils"
+	"go.uber.org/zap"
+)
+
+/*
+Idempotency keys make retries of unsafe requests safe: the first response to a request with
+an Idempotency-Key header is stored and replayed for repeats of the request.
+
+	idem := middlewares.NewIdempotency(logger, middlewares.IdempotencyConfig{
+		Store: middlewares.NewRedisIdempotencyStore(cacheStore),
+	})
+	group.HandleFunc("POST /orders", createOrder, idem.Handler)
+
+A key is bound to a fingerprint of the method, URL and body of its first request. Repeats
+get 409 Conflict while the first request runs, and 422 Unprocessable Content if the
+fingerprint differs. Replayed responses carry Idempotent-Replayed: true.
+5xx responses are not stored, so the request can be retried with the same key.
+
+The key is reserved for LockTimeout and the reservation is extended while the handler
+runs. Each reservation carries a random token, so a request whose reservation expired
+can't overwrite or release the key of the request that took it over.
+Refs
+https://datatracker.ietf.org/doc/draft-ietf-httpapi-idempotency-key-header/
+https://stripe.com/docs/api/idempotent_requests
+*/
+
+const (
+	idempotencyKeyHeader    = "Idempotency-Key"
+	maxIdempotencyKeyLength = 255
+	defaultIdempotencyTTL   = 24 * time.Hour
+	defaultIdempotencyLock  = time.Minute
+	defaultIdempotencyBody  = 1 << 20
+)
+
+// notReplayedHeaders belong to the response they were sent with, not to its replays.
+var notReplayedHeaders = []string{"Date", utils.RequestIDHeader, "Retry-After"}
+
+// ErrIdempotencyKeyLost is returned by IdempotencyStore methods called with a reservation
+// that no longer holds its key, e.g. because it expired and another request reserved it.
+var ErrIdempotencyKeyLost = errors.New("idempotency key no longer held by the reservation")
+
+// IdempotencyRecord is the state of an idempotency key: in progress until Completed, then
+// the response to replay.
+type IdempotencyRecord struct {
+	Fingerprint string `json:"fingerprint"`
+	// Token identifies the request holding an in-progress record.
+	Token     string      `json:"token,omitempty"`
+	Completed bool        `json:"completed"`
+	Status    int         `json:"status,omitempty"`
+	Header    http.Header `json:"header,omitempty"`
+	Body      []byte      `json:"body,omitempty"`
+}
+
+// IdempotencyStore stores idempotency records. The methods taking a reservation only
+// apply while key still holds that in-progress record, compared by its Token.
+type IdempotencyStore interface {
+	// Reserve stores the in-progress rec under key for ttl unless the key exists, and
+	// returns the existing record if it does.
+	Reserve(ctx context.Context, key string, rec IdempotencyRecord, ttl time.Duration) (*IdempotencyRecord, error)
+	// Extend keeps the reservation of key for another ttl, or returns ErrIdempotencyKeyLost.
+	Extend(ctx context.Context, key string, reservation IdempotencyRecord, ttl time.Duration) error
+	// Complete replaces the reservation of key with the completed rec, kept for ttl, or
+	// returns ErrIdempotencyKeyLost.
+	Complete(ctx context.Context, key string, reservation, rec IdempotencyRecord, ttl time.Duration) error
+	// Release deletes the reservation of key. It does nothing if the key was lost.
+	Release(ctx context.Context, key string, reservation IdempotencyRecord) error
+}
+
+// IdempotencyConfig configures an Idempotency middleware.
+type IdempotencyConfig struct {
+	Store IdempotencyStore
+	// Methods are the methods keys are honoured for, POST and PATCH by default.
+	Methods []string
+	// Required rejects requests of Methods without a key with 400 Bad Request.
+	Required bool
+	// TTL is how long responses are replayed, 24h by default.
+	TTL time.Duration
+	// LockTimeout is how long a key is held by a request that never completes, e.g.
+	// because the process crashed. One minute by default. The reservation is extended
+	// every third of it while the handler runs, so handlers may take longer.
+	LockTimeout time.Duration
+	// MaxBodySize limits the request bodies fingerprinted and the response bodies stored,
+	// 1MB by default. Larger requests get 413 and larger responses are not stored.
+	MaxBodySize int64
+	// Scope returns the client a key belongs to, so clients can't replay each other's
+	// responses. By default keys are scoped to the subject of the verified principal set
+	// by JWTAuthenticator, and requests without a principal share one global scope, so
+	// APIs open to anonymous clients should set a Scope, e.g. KeyByIP.
+	Scope RateLimitKeyFunc
+}
+
+// Idempotency is the idempotency middleware created by NewIdempotency.
+type Idempotency struct {
+	logger      *zap.Logger
+	store       IdempotencyStore
+	methods     map[string]bool
+	required    bool
+	ttl         time.Duration
+	lockTimeout time.Duration
+	maxBodySize int64
+	scope       RateLimitKeyFunc
+}
+
+// NewIdempotency returns the idempotency middleware storing responses in cfg.Store.
+func NewIdempotency(logger *zap.Logger, cfg IdempotencyConfig) *Idempotency {
+	i := &Idempotency{
+		logger:      logger,
+		store:       cfg.Store,
+		methods:     map[string]bool{},
+		required:    cfg.Required,
+		ttl:         cfg.TTL,
+		lockTimeout: cfg.LockTimeout,
+		maxBodySize: cfg.MaxBodySize,
+		scope:       cfg.Scope,
+	}
+	methods := cfg.Methods
+	if len(methods) == 0 {
+		methods = []string{http.MethodPost, http.MethodPatch}
+	}
+	for _, m := range methods {
+		i.methods[strings.ToUpper(m)] = true
+	}
+	if i.ttl <= 0 {
+		i.ttl = defaultIdempotencyTTL
+	}
+	if i.lockTimeout <= 0 {
+		i.lockTimeout = defaultIdempotencyLock
+	}
+	if i.maxBodySize <= 0 {
+		i.maxBodySize = defaultIdempotencyBody
+	}
+	if i.scope == nil {
+		i.scope = principalScope
+	}
+	return i
+}
+
+// principalScope is the subject of the verified principal. Unverified tokens are not
+// used: their claims could be forged to read the responses stored for another client.
+func principalScope(r *http.Request) string {
+	if p, ok := PrincipalFromContext(r.Context()); ok && p.Subject != "" {
+		return "sub:" + p.Subject
+	}
+	return ""
+}
+
+// Handler returns the idempotency middleware. Requests are rejected with 503 if the store
+// fails, since running them could create duplicates.
+func (i *Idempotency) Handler(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !i.methods[r.Method] {
+			next.ServeHTTP(w, r)
+			return
+		}
+		key, ok := idempotencyKey(r.Header.Get(idempotencyKeyHeader))
+		if !ok {
+			writeIdempotencyProblem(w, r, http.StatusBadRequest, "idempotency_key_invalid",
+				"the Idempotency-Key header must be a string of at most 255 characters")
+			return
+		}
+		if key == "" {
+			if i.required {
+				writeIdempotencyProblem(w, r, http.StatusBadRequest, "idempotency_key_missing",
+					"this operation requires an Idempotency-Key header")
+				return
+			}
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		body, err := io.ReadAll(io.LimitReader(r.Body, i.maxBodySize+1))
+		if err != nil {
+			writeIdempotencyProblem(w, r, http.StatusBadRequest, "body_unreadable",
+				"the request body could not be read")
+			return
+		}
+		if int64(len(body)) > i.maxBodySize {
+			writeIdempotencyProblem(w, r, http.StatusRequestEntityTooLarge, "body_too_large",
+				fmt.Sprintf("requests with an Idempotency-Key header are limited to %d bytes", i.maxBodySize))
+			return
+		}
+		r.Body = io.NopCloser(bytes.NewReader(body))
+
+		if scope := i.scope(r); scope != "" {
+			key = scope + ":" + key
+		}
+		fingerprint := requestFingerprint(r, body)
+		reservation := IdempotencyRecord{Fingerprint: fingerprint, Token: rand.Text()}
+
+		existing, err := i.store.Reserve(r.Context(), key, reservation, i.lockTimeout)
+		if err != nil {
+			i.logger.Error("idempotency store failed", zap.String("key", key), zap.Error(err))
+			utils.WriteProblemResponse(w, r, utils.Problem{Status: http.StatusServiceUnavailable})
+			return
+		}
+		if existing != nil {
+			i.replay(w, r, existing, fingerprint)
+			return
+		}
+
+		i.serve(w, r, next, key, reservation)
+	})
+}
+
+func (i *Idempotency) replay(w http.ResponseWriter, r *http.Request, rec *IdempotencyRecord, fingerprint string) {
+	switch {
+	case rec.Fingerprint != fingerprint:
+		writeIdempotencyProblem(w, r, http.StatusUnprocessableEntity, "idempotency_key_reused",
+			"the Idempotency-Key was already used for a different request")
+	case !rec.Completed:
+		w.Header().Set("Retry-After", "1")
+		writeIdempotencyProblem(w, r, http.StatusConflict, "idempotency_key_in_use",
+			"a request with this Idempotency-Key is still being processed")
+	default:
+		h := w.Header()
+		for k, v := range rec.Header {
+			h[k] = v
+		}
+		h.Set("Idempotent-Replayed", "true")
+		w.WriteHeader(rec.Status)
+		w.Write(rec.Body)
+	}
+}
+
+// serve runs the request holding key with reservation and stores its response. The key
+// is released if the handler panics or the response can't be replayed.
+func (i *Idempotency) serve(w http.ResponseWriter, r *http.Request, next http.Handler, key string, reservation IdempotencyRecord) {
+	// the outcome is stored even if the client went away
+	ctx := context.WithoutCancel(r.Context())
+	rec := &idempotencyRecorder{ResponseWriter: w, limit: i.maxBodySize}
+	stored := false
+	defer func() {
+		if !stored {
+			if err := i.store.Release(ctx, key, reservation); err != nil {
+				i.logger.Error("failed to release idempotency key", zap.String("key", key), zap.Error(err))
+			}
+		}
+	}()
+
+	stopExtending := i.keepReserved(ctx, key, reservation)
+	defer stopExtending()
+	next.ServeHTTP(rec, r)
+	stopExtending()
+
+	status := rec.status
+	if status == 0 {
+		status = http.StatusOK
+	}
+	if status >= http.StatusInternalServerError || rec.overflow {
+		return
+	}
+
+	header := w.Header().Clone()
+	for _, h := range notReplayedHeaders {
+		header.Del(h)
+	}
+	for k := range header {
+		if strings.HasPrefix(k, "Ratelimit-") {
+			delete(header, k)
+		}
+	}
+	err := i.store.Complete(ctx, key, reservation, IdempotencyRecord{
+		Fingerprint: reservation.Fingerprint,
+		Completed:   true,
+		Status:      status,
+		Header:      header,
+		Body:        rec.body.Bytes(),
+	}, i.ttl)
+	if errors.Is(err, ErrIdempotencyKeyLost) {
+		i.logger.Warn("idempotency key taken over before the response was stored", zap.String("key", key))
+		return
+	}
+	if err != nil {
+		i.logger.Error("failed to store idempotent response", zap.String("key", key), zap.Error(err))
+		return
+	}
+	stored = true
+}
+
+// keepReserved extends the reservation of key every third of the lock timeout until the
+// returned func is called, so the key is not taken over while a slow handler runs. The
+// returned func waits for an extension in flight and may be called more than once.
+func (i *Idempotency) keepReserved(ctx context.Context, key string, reservation IdempotencyRecord) func() {
+	done := make(chan struct{})
+	stopped := make(chan struct{})
+	go func() {
+		defer close(stopped)
+		ticker := time.NewTicker(i.lockTimeout / 3)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-done:
+				return
+			case <-ticker.C:
+			}
+			err := i.store.Extend(ctx, key, reservation, i.lockTimeout)
+			if errors.Is(err, ErrIdempotencyKeyLost) {
+				i.logger.Warn("idempotency key taken over while the request was running", zap.String("key", key))
+				return
+			}
+			if err != nil {
+				// retried on the next tick, before the reservation expires
+				i.logger.Error("failed to extend idempotency key", zap.String("key", key), zap.Error(err))
+			}
+		}
+	}()
+
+	var once sync.Once
+	return func() {
+		once.Do(func() { close(done) })
+		<-stopped
+	}
+}
+
+// idempotencyKey parses the Idempotency-Key header, a string that may be quoted as a
+// structured field.
+func idempotencyKey(v string) (string, bool) {
+	if v == "" {
+		return "", true
+	}
+	if len(v) >= 2 && v[0] == '"' && v[len(v)-1] == '"' {
+		v = v[1 : len(v)-1]
+	}
+	return v, v != "" && len(v) <= maxIdempotencyKeyLength && utils.ValidRequestID(v)
+}
+
+func requestFingerprint(r *http.Request, body []byte) string {
+	h := sha256.New()
+	io.WriteString(h, r.Method+" "+r.URL.RequestURI()+"\n")
+	h.Write(body)
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+func writeIdempotencyProblem(w http.ResponseWriter, r *http.Request, status int, code, detail string) {
+	utils.WriteProblemResponse(w, r, utils.Problem{Status: status, Code: code, Detail: detail})
+}
+
+// idempotencyRecorder copies the response body, up to limit bytes, while writing it.
+type idempotencyRecorder struct {
+	http.ResponseWriter
+	status   int
+	body     bytes.Buffer
+	limit    int64
+	overflow bool
+}
+
+func (rec *idempotencyRecorder) WriteHeader(code int) {
+	if rec.status == 0 {
+		rec.status = code
+	}
+	rec.ResponseWriter.WriteHeader(code)
+}
+
+func (rec *idempotencyRecorder) Write(b []byte) (int, error) {
+	if rec.status == 0 {
+		rec.status = http.StatusOK
+	}
+	if !rec.overflow {
+		if int64(rec.body.Len()+len(b)) > rec.limit {
+			rec.overflow = true
+			rec.body.Reset()
+		} else {
+			rec.body.Write(b)
+		}
+	}
+	return rec.ResponseWriter.Write(b)
+}
+
+func (rec *idempotencyRecorder) Unwrap() http.ResponseWriter {
+	return rec.ResponseWriter
+}
+
+// MemoryIdempotencyStore keeps idempotency records in process, for tests and services with
+// a single replica. It is safe for concurrent use.
+type MemoryIdempotencyStore struct {
+	mu      sync.Mutex
+	records map[string]memoryIdempotencyRecord
+}
+
+type memoryIdempotencyRecord struct {
+	rec     IdempotencyRecord
+	expires time.Time
+}
+
+// NewMemoryIdempotencyStore returns an empty in-process store.
+func NewMemoryIdempotencyStore() *MemoryIdempotencyStore {
+	return &MemoryIdempotencyStore{records: map[string]memoryIdempotencyRecord{}}
+}
+
+// Reserve implements IdempotencyStore.
+func (s *MemoryIdempotencyStore) Reserve(_ context.Context, key string, rec IdempotencyRecord, ttl time.Duration) (*IdempotencyRecord, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := time.Now()
+	if existing, ok := s.records[key]; ok && now.Before(existing.expires) {
+		return &existing.rec, nil
+	}
+	for k, r := range s.records {
+		if !now.Before(r.expires) {
+			delete(s.records, k)
+		}
+	}
+	s.records[key] = memoryIdempotencyRecord{rec: rec, expires: now.Add(ttl)}
+	return nil, nil
+}
+
+// held reports whether key is still reserved by reservation. s.mu must be held.
+func (s *MemoryIdempotencyStore) held(key string, reservation IdempotencyRecord) bool {
+	r, ok := s.records[key]
+	return ok && !r.rec.Completed && r.rec.Token == reservation.Token && time.Now().Before(r.expires)
+}
+
+// Extend implements IdempotencyStore.
+func (s *MemoryIdempotencyStore) Extend(_ context.Context, key string, reservation IdempotencyRecord, ttl time.Duration) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if !s.held(key, reservation) {
+		return ErrIdempotencyKeyLost
+	}
+	s.records[key] = memoryIdempotencyRecord{rec: s.records[key].rec, expires: time.Now().Add(ttl)}
+	return nil
+}
+
+// Complete implements IdempotencyStore.
+func (s *MemoryIdempotencyStore) Complete(_ context.Context, key string, reservation, rec IdempotencyRecord, ttl time.Duration) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if !s.held(key, reservation) {
+		return ErrIdempotencyKeyLost
+	}
+	s.records[key] = memoryIdempotencyRecord{rec: rec, expires: time.Now().Add(ttl)}
+	return nil
+}
+
+// Release implements IdempotencyStore.
+func (s *MemoryIdempotencyStore) Release(_ context.Context, key string, reservation IdempotencyRecord) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.held(key, reservation) {
+		delete(s.records, key)
+	}
+	return nil
+}
+
+const idempotencyKeyPrefix = "idempotency:"
+
+// RedisIdempotencyStore keeps idempotency records in Redis, shared by every replica. A
+// reservation is compared with the stored value by its JSON encoding, which includes the
+// token, in the Lua scripts of the redis.CacheStore Compare* methods.
+type RedisIdempotencyStore struct {
+	store *redis.CacheStore
+}
+
+// NewRedisIdempotencyStore returns a store using store.
+func NewRedisIdempotencyStore(store *redis.CacheStore) *RedisIdempotencyStore {
+	return &RedisIdempotencyStore{store: store}
+}
+
+// Reserve implements IdempotencyStore.
+func (s *RedisIdempotencyStore) Reserve(ctx context.Context, key string, rec IdempotencyRecord, ttl time.Duration) (*IdempotencyRecord, error) {
+	value, err := json.Marshal(rec)
+	if err != nil {
+		return nil, err
+	}
+	// the stored record may expire or be released between SETNX and GET
+	for range 3 {
+		ok, err := s.store.SetNX(ctx, idempotencyKeyPrefix+key, value, ttl)
+		if err != nil || ok {
+			return nil, err
+		}
+		stored, err := s.store.Get(ctx, idempotencyKeyPrefix+key)
+		if errors.Is(err, redis.ErrCacheMiss) {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		existing := &IdempotencyRecord{}
+		if err := json.Unmarshal(stored, existing); err != nil {
+			return nil, err
+		}
+		return existing, nil
+	}
+	return nil, errors.New("idempotency key " + key + ": too much contention")
+}
+
+// Extend implements IdempotencyStore.
+func (s *RedisIdempotencyStore) Extend(ctx context.Context, key string, reservation IdempotencyRecord, ttl time.Duration) error {
+	expected, err := json.Marshal(reservation)
+	if err != nil {
+		return err
+	}
+	ok, err := s.store.CompareAndExpire(ctx, idempotencyKeyPrefix+key, expected, ttl)
+	if err == nil && !ok {
+		return ErrIdempotencyKeyLost
+	}
+	return err
+}
+
+// Complete implements IdempotencyStore.
+func (s *RedisIdempotencyStore) Complete(ctx context.Context, key string, reservation, rec IdempotencyRecord, ttl time.Duration) error {
+	expected, err := json.Marshal(reservation)
+	if err != nil {
+		return err
+	}
+	value, err := json.Marshal(rec)
+	if err != nil {
+		return err
+	}
+	ok, err := s.store.CompareAndSwap(ctx, idempotencyKeyPrefix+key, expected, value, ttl)
+	if err == nil && !ok {
+		return ErrIdempotencyKeyLost
+	}
+	return err
+}
+
+// Release implements IdempotencyStore.
+func (s *RedisIdempotencyStore) Release(ctx context.Context, key string, reservation IdempotencyRecord) error {
+	expected, err := json.Marshal(reservation)
+	if err != nil {
+		return err
+	}
+	_, err = s.store.CompareAndDelete(ctx, idempotencyKeyPrefix+key, expected)
+	return err
+}
+
+// PostgresIdempotencyStore keeps idempotency records in the idempotency_keys table, see
+// postgresql.PostgresSQLDataStore.CreateIdempotencyKeysTable.
+type PostgresIdempotencyStore struct {
+	db *postgresql.PostgresSQLDataStore
+}
+
+// NewPostgresIdempotencyStore returns a store using db.
+func NewPostgresIdempotencyStore(db *postgresql.PostgresSQLDataStore) *PostgresIdempotencyStore {
+	return &PostgresIdempotencyStore{db: db}
+}
+
+// Reserve implements IdempotencyStore.
+func (s *PostgresIdempotencyStore) Reserve(ctx context.Context, key string, rec IdempotencyRecord, ttl time.Duration) (*IdempotencyRecord, error) {
+	stored, err := s.db.ReserveIdempotencyKey(ctx, key, rec.Fingerprint, rec.Token, ttl)
+	if err != nil || stored == nil {
+		return nil, err
+	}
+	existing := &IdempotencyRecord{
+		Fingerprint: stored.Fingerprint,
+		Completed:   stored.Completed,
+		Status:      stored.Status,
+		Body:        stored.Body,
+	}
+	if len(stored.Headers) > 0 {
+		if err := json.Unmarshal(stored.Headers, &existing.Header); err != nil {
+			return nil, err
+		}
+	}
+	return existing, nil
+}
+
+// Extend implements IdempotencyStore.
+func (s *PostgresIdempotencyStore) Extend(ctx context.Context, key string, reservation IdempotencyRecord, ttl time.Duration) error {
+	return postgresIdempotencyErr(s.db.ExtendIdempotencyKey(ctx, key, reservation.Token, ttl))
+}
+
+// Complete implements IdempotencyStore.
+func (s *PostgresIdempotencyStore) Complete(ctx context.Context, key string, reservation, rec IdempotencyRecord, ttl time.Duration) error {
+	header, err := json.Marshal(rec.Header)
+	if err != nil {
+		return err
+	}
+	return postgresIdempotencyErr(s.db.CompleteIdempotencyKey(ctx, key, reservation.Token, rec.Status, header, rec.Body, ttl))
+}
+
+// Release implements IdempotencyStore.
+func (s *PostgresIdempotencyStore) Release(ctx context.Context, key string, reservation IdempotencyRecord) error {
+	return s.db.ReleaseIdempotencyKey(ctx, key, reservation.Token)
+}
+
+func postgresIdempotencyErr(err error) error {
+	if errors.Is(err, postgresql.ErrIdempotencyKeyNotHeld) {
+		return ErrIdempotencyKeyLost
+	}
+	return err
+}
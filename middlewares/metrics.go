@@ -1 +1,202 @@
 package middlewares
+
+import (
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/harphies/go.microservices.io/observability/prommetrics"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+/*
+RED metrics (rate, errors, duration) for HTTP handlers.
+
+	metrics, err := middlewares.NewHTTPMetrics(middlewares.HTTPMetricsConfig{Registerer: reg})
+	handler := metrics.Handler(mux)
+
+Requests are labelled by the ServeMux pattern that matched them, e.g. "/orders/{id}",
+never by the raw path, so the number of series stays bounded.
+Refs
+https://grafana.com/blog/2018/08/02/the-red-method-how-to-instrument-your-services/
+https://prometheus.io/docs/practices/naming/
+*/
+
+// unmatchedRoute labels requests no route matched, e.g. 404s from the ServeMux.
+const unmatchedRoute = "unmatched"
+
+// HTTPMetricsConfig configures HTTPMetrics.
+type HTTPMetricsConfig struct {
+	// Registerer is where the metrics are registered, prometheus.DefaultRegisterer if nil.
+	Registerer prometheus.Registerer
+	// Namespace defaults to prommetrics.DefaultPromMetricsNamespace.
+	Namespace string
+	Subsystem string
+	// DurationBuckets defaults to prometheus.DefBuckets.
+	DurationBuckets []float64
+	// Route returns the route template of a request after it was served. The default uses
+	// the ServeMux pattern (http.Request.Pattern) without its method and host.
+	Route func(r *http.Request) string
+}
+
+// HTTPMetrics records request counts, durations, in-flight requests and request and
+// response sizes, labelled by method, route template and status class (2xx, 4xx, ...).
+type HTTPMetrics struct {
+	requests     *prometheus.CounterVec
+	duration     *prometheus.HistogramVec
+	inFlight     prometheus.Gauge
+	requestSize  *prometheus.HistogramVec
+	responseSize *prometheus.HistogramVec
+	route        func(r *http.Request) string
+}
+
+// NewHTTPMetrics creates the metrics and registers them on cfg.Registerer. Metrics already
+// registered by another HTTPMetrics with the same config are shared.
+func NewHTTPMetrics(cfg HTTPMetricsConfig) (*HTTPMetrics, error) {
+	reg := cfg.Registerer
+	if reg == nil {
+		reg = prometheus.DefaultRegisterer
+	}
+	namespace := cfg.Namespace
+	if namespace == "" {
+		namespace = prommetrics.DefaultPromMetricsNamespace
+	}
+	buckets := cfg.DurationBuckets
+	if len(buckets) == 0 {
+		buckets = prometheus.DefBuckets
+	}
+	sizeBuckets := prometheus.ExponentialBuckets(100, 10, 7) // 100B to 100MB
+
+	m := &HTTPMetrics{
+		requests: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: namespace,
+			Subsystem: cfg.Subsystem,
+			Name:      "http_requests_total",
+			Help:      "Total number of HTTP requests served",
+		}, []string{"method", "route", "status"}),
+		duration: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Namespace: namespace,
+			Subsystem: cfg.Subsystem,
+			Name:      "http_request_duration_seconds",
+			Help:      "Time taken to serve HTTP requests",
+			Buckets:   buckets,
+		}, []string{"method", "route", "status"}),
+		inFlight: prometheus.NewGauge(prometheus.GaugeOpts{
+			Namespace: namespace,
+			Subsystem: cfg.Subsystem,
+			Name:      "http_requests_in_flight",
+			Help:      "Number of HTTP requests being served",
+		}),
+		requestSize: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Namespace: namespace,
+			Subsystem: cfg.Subsystem,
+			Name:      "http_request_size_bytes",
+			Help:      "Size of HTTP request bodies",
+			Buckets:   sizeBuckets,
+		}, []string{"method", "route"}),
+		responseSize: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Namespace: namespace,
+			Subsystem: cfg.Subsystem,
+			Name:      "http_response_size_bytes",
+			Help:      "Size of HTTP response bodies",
+			Buckets:   sizeBuckets,
+		}, []string{"method", "route", "status"}),
+		route: cfg.Route,
+	}
+	if m.route == nil {
+		m.route = RouteTemplate
+	}
+
+	var err error
+	if m.requests, err = prommetrics.Register(reg, m.requests); err != nil {
+		return nil, err
+	}
+	if m.duration, err = prommetrics.Register(reg, m.duration); err != nil {
+		return nil, err
+	}
+	if m.inFlight, err = prommetrics.Register(reg, m.inFlight); err != nil {
+		return nil, err
+	}
+	if m.requestSize, err = prommetrics.Register(reg, m.requestSize); err != nil {
+		return nil, err
+	}
+	if m.responseSize, err = prommetrics.Register(reg, m.responseSize); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+// Handler returns the metrics middleware. Place it outside the ServeMux, or inside it per
+// route; either way the matched pattern is known once the request was served.
+func (m *HTTPMetrics) Handler(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		m.inFlight.Inc()
+		defer m.inFlight.Dec()
+
+		start := time.Now()
+		rw := NewResponseWriter(w)
+		body := &countingReader{ReadCloser: r.Body}
+		if r.Body != nil && r.Body != http.NoBody {
+			r.Body = body
+		}
+
+		next.ServeHTTP(rw, r)
+
+		method := normalizeMethod(r.Method)
+		route := m.route(r)
+		status := statusClass(rw.Status())
+		m.requests.WithLabelValues(method, route, status).Inc()
+		m.duration.WithLabelValues(method, route, status).Observe(time.Since(start).Seconds())
+		size := body.n
+		if size == 0 && r.ContentLength > 0 {
+			size = r.ContentLength // the handler did not read the body
+		}
+		m.requestSize.WithLabelValues(method, route).Observe(float64(size))
+		m.responseSize.WithLabelValues(method, route, status).Observe(float64(rw.BytesWritten()))
+	})
+}
+
+// RouteTemplate returns the ServeMux pattern that matched r without its method and host,
+// e.g. "/orders/{id}" for "GET /orders/{id}", or "unmatched".
+func RouteTemplate(r *http.Request) string {
+	if r.Pattern == "" {
+		return unmatchedRoute
+	}
+	_, pattern := splitRoute(r.Pattern)
+	if i := strings.Index(pattern, "/"); i > 0 {
+		pattern = pattern[i:] // drop the host
+	}
+	return pattern
+}
+
+// statusClass returns "2xx" for 200 and so on. Handlers that wrote nothing sent a 200.
+func statusClass(code int) string {
+	if code == 0 {
+		code = http.StatusOK
+	}
+	return strconv.Itoa(code/100) + "xx"
+}
+
+// normalizeMethod bounds the method label to the standard methods.
+func normalizeMethod(method string) string {
+	switch method {
+	case http.MethodGet, http.MethodHead, http.MethodPost, http.MethodPut, http.MethodPatch,
+		http.MethodDelete, http.MethodConnect, http.MethodOptions, http.MethodTrace:
+		return method
+	}
+	return "OTHER"
+}
+
+// countingReader counts the bytes read from a request body.
+type countingReader struct {
+	io.ReadCloser
+	n int64
+}
+
+func (c *countingReader) Read(p []byte) (int, error) {
+	n, err := c.ReadCloser.Read(p)
+	c.n += int64(n)
+	return n, err
+}
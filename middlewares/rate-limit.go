@@ -3,7 +3,7 @@ package middlewares
 import (
 	"github.com/didip/tollbooth/v7"
 	"github.com/didip/tollbooth/v7/limiter"
-	"github.com/tomasen/realip"
+	"github.com/harphies/go.microservices.io/utils"
 	"net/http"
 	"sync"
 	"time"
@@ -24,6 +24,9 @@ func NewRateLimiter(limit int) *RateLimitOptions {
 }
 
 // LimitMaxConcurrentRequestPerHour ... Ref - https://stackoverflow.com/questions/73439068/limit-max-number-of-requests-per-hour-with-didip-tollbooth
+//
+// Deprecated: the concurrency cap is fixed and per process. Use a ConcurrencyLimiter, which
+// adapts the limit to the observed latency and sheds low-priority requests first.
 func (limiter *RateLimitOptions) LimitMaxConcurrentRequestPerHour(lmt *limiter.Limiter,
 	handler func(w http.ResponseWriter, r *http.Request)) http.Handler {
 	middle := func(w http.ResponseWriter, r *http.Request) {
@@ -49,21 +52,59 @@ func (limiter *RateLimitOptions) LimitMaxConcurrentRequestPerHour(lmt *limiter.L
 		// There's no rate-limit error, serve the next handler.
 		handler(w, r)
 	}
-	return tollbooth.LimitHandler(lmt, http.HandlerFunc(middle))
+	return limitByClientIP(lmt, http.HandlerFunc(middle))
+}
+
+// Middleware adapts LimitMaxConcurrentRequestPerHour to the Middleware signature.
+func (limiter *RateLimitOptions) Middleware(lmt *limiter.Limiter) Middleware {
+	return func(next http.Handler) http.Handler {
+		return limiter.LimitMaxConcurrentRequestPerHour(lmt, next.ServeHTTP)
+	}
 }
 
 // Usage example
 
-// GetUserIP ...
+// GetUserIP returns the client address resolved by the ClientIP middleware, or the peer
+// address of the connection without it.
 func GetUserIP(r *http.Request) string {
-	userIp := realip.FromRequest(r)
-	return userIp
+	if addr := utils.ClientIP(r); addr.IsValid() {
+		return addr.String()
+	}
+	return r.RemoteAddr
 }
 
-// RateLimit middleware to rate limit http requests
+// RateLimit middleware to rate limit http requests. It already has the Middleware signature.
+// The limit is per process; use a RateLimitPolicy with a RedisRateLimiter to share it
+// across replicas.
 func RateLimit(next http.Handler) http.Handler {
 	// rate limit: 3(rps) requests per seconds and resets after 1 minute
 	lmt := tollbooth.NewLimiter(3, &limiter.ExpirableOptions{DefaultExpirationTTL: 5 * time.Minute})
-	ltmw := tollbooth.LimitHandler(lmt, next)
+	ltmw := limitByClientIP(lmt, next)
 	return ltmw
 }
+
+// limitByClientIP is tollbooth.LimitHandler counting requests per GetUserIP, instead of
+// the address tollbooth reads from X-Forwarded-For, which any client can set.
+func limitByClientIP(lmt *limiter.Limiter, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if tollbooth.ShouldSkipLimiter(lmt, r) {
+			next.ServeHTTP(w, r)
+			return
+		}
+		ip := GetUserIP(r)
+		for _, keys := range tollbooth.BuildKeys(lmt, r) {
+			keys[0] = ip
+			if httpError := tollbooth.LimitByKeys(lmt, keys); httpError != nil {
+				lmt.ExecOnLimitReached(w, r)
+				if lmt.GetOverrideDefaultResponseWriter() {
+					return
+				}
+				w.Header().Add("Content-Type", lmt.GetMessageContentType())
+				w.WriteHeader(httpError.StatusCode)
+				w.Write([]byte(httpError.Message))
+				return
+			}
+		}
+		next.ServeHTTP(w, r)
+	})
+}
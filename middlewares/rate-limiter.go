@@ -0,0 +1,309 @@
+package middlewares
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/harphies/go.microservices.io/storage/cache/redis"
+	"github.com/harphies/go.microservices.io/utils"
+	"go.uber.org/zap"
+)
+
+/*
+Rate limiting shared by every replica of a service, using GCRA in Redis. When Redis is
+unreachable the limiter stops calling it for a short cool-down and falls back to an
+in-process GCRA with the same limit, so each replica enforces the limit on its own until
+Redis is back.
+
+	limiter := middlewares.NewRedisRateLimiter(logger, cacheStore)
+	policy, err := middlewares.NewRateLimitPolicy(logger, limiter,
+		middlewares.Limit{Rate: 100, Period: time.Minute}, middlewares.KeyByHeader("X-Api-Key"))
+	handler := policy.Handler(mux)
+
+Responses carry RateLimit-Limit, RateLimit-Remaining, RateLimit-Reset and RateLimit-Policy,
+and Retry-After when the request is rejected with a 429 problem+json response, code
+"rate_limited".
+Refs
+https://datatracker.ietf.org/doc/draft-ietf-httpapi-ratelimit-headers/
+https://brandur.org/rate-limiting
+*/
+
+// Limit allows Rate requests per Period, with bursts of up to Burst requests. Burst
+// defaults to Rate.
+type Limit struct {
+	Rate   int
+	Period time.Duration
+	Burst  int
+}
+
+func (l Limit) validate() error {
+	switch {
+	case l.Rate <= 0 || l.Period <= 0:
+		return fmt.Errorf("rate limit: rate and period must be positive, got %d per %s", l.Rate, l.Period)
+	case l.Burst < 0:
+		return fmt.Errorf("rate limit: negative burst %d", l.Burst)
+	case l.Period/time.Duration(l.Rate) == 0:
+		return fmt.Errorf("rate limit: %d per %s is more than one request per nanosecond", l.Rate, l.Period)
+	}
+	return nil
+}
+
+func (l Limit) burst() int {
+	if l.Burst > 0 {
+		return l.Burst
+	}
+	return l.Rate
+}
+
+// RateLimitDecision is the outcome of a rate limit check.
+type RateLimitDecision struct {
+	Allowed    bool
+	Remaining  int
+	RetryAfter time.Duration
+	ResetAfter time.Duration
+}
+
+// RateLimiter takes one request from the bucket of key.
+type RateLimiter interface {
+	Allow(ctx context.Context, key string, limit Limit) (RateLimitDecision, error)
+}
+
+// MemoryRateLimiter is an in-process GCRA rate limiter. It is safe for concurrent use.
+type MemoryRateLimiter struct {
+	mu        sync.Mutex
+	tats      map[string]time.Time
+	lastSweep time.Time
+}
+
+// NewMemoryRateLimiter returns an empty in-process limiter.
+func NewMemoryRateLimiter() *MemoryRateLimiter {
+	return &MemoryRateLimiter{tats: map[string]time.Time{}, lastSweep: time.Now()}
+}
+
+// Allow implements RateLimiter. It only fails for invalid limits.
+func (m *MemoryRateLimiter) Allow(_ context.Context, key string, limit Limit) (RateLimitDecision, error) {
+	if err := limit.validate(); err != nil {
+		return RateLimitDecision{}, err
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	now := time.Now()
+	m.sweep(now)
+
+	emission := limit.Period / time.Duration(limit.Rate)
+	tat := m.tats[key]
+	if tat.Before(now) {
+		tat = now
+	}
+	newTAT := tat.Add(emission)
+	diff := now.Sub(newTAT.Add(-emission * time.Duration(limit.burst())))
+	if diff < 0 {
+		return RateLimitDecision{RetryAfter: -diff, ResetAfter: tat.Sub(now)}, nil
+	}
+	m.tats[key] = newTAT
+	return RateLimitDecision{
+		Allowed:    true,
+		Remaining:  int(diff / emission),
+		ResetAfter: newTAT.Sub(now),
+	}, nil
+}
+
+// sweep drops full buckets once a minute so the map does not grow with every key seen.
+func (m *MemoryRateLimiter) sweep(now time.Time) {
+	if now.Sub(m.lastSweep) < time.Minute {
+		return
+	}
+	m.lastSweep = now
+	for k, tat := range m.tats {
+		if tat.Before(now) {
+			delete(m.tats, k)
+		}
+	}
+}
+
+// redisCooldown is how long RedisRateLimiter uses the fallback after Redis failed before
+// trying it again, so requests don't each wait for a Redis timeout during an outage.
+const redisCooldown = 5 * time.Second
+
+// RedisRateLimiter enforces limits across replicas with redis.CacheStore.AllowGCRA. When
+// Redis fails it opens a circuit breaker and uses an in-process limiter for redisCooldown,
+// then lets a single request probe Redis again.
+type RedisRateLimiter struct {
+	logger   *zap.Logger
+	store    *redis.CacheStore
+	fallback RateLimiter
+	cooldown time.Duration
+
+	// openUntil is the UnixNano time until which Redis is skipped, 0 while it is healthy.
+	openUntil atomic.Int64
+}
+
+// NewRedisRateLimiter returns a limiter using store, with a MemoryRateLimiter fallback.
+func NewRedisRateLimiter(logger *zap.Logger, store *redis.CacheStore) *RedisRateLimiter {
+	return &RedisRateLimiter{logger: logger, store: store, fallback: NewMemoryRateLimiter(), cooldown: redisCooldown}
+}
+
+// Allow implements RateLimiter.
+func (l *RedisRateLimiter) Allow(ctx context.Context, key string, limit Limit) (RateLimitDecision, error) {
+	if err := limit.validate(); err != nil {
+		return RateLimitDecision{}, err
+	}
+	if l.store != nil && l.useRedis() {
+		res, err := l.store.AllowGCRA(ctx, key, limit.Rate, limit.Period, limit.burst())
+		if err == nil {
+			l.closeBreaker()
+			return RateLimitDecision{
+				Allowed:    res.Allowed,
+				Remaining:  res.Remaining,
+				RetryAfter: res.RetryAfter,
+				ResetAfter: res.ResetAfter,
+			}, nil
+		}
+		// a request cancelled by its client says nothing about Redis
+		if ctx.Err() == nil {
+			l.openBreaker(err)
+		}
+	}
+	return l.fallback.Allow(ctx, key, limit)
+}
+
+// useRedis reports whether the breaker lets the request through to Redis. Once the
+// cool-down is over, the one request winning the swap probes Redis and the others keep
+// using the fallback for another cool-down.
+func (l *RedisRateLimiter) useRedis() bool {
+	until := l.openUntil.Load()
+	if until == 0 {
+		return true
+	}
+	now := time.Now().UnixNano()
+	if now < until {
+		return false
+	}
+	return l.openUntil.CompareAndSwap(until, now+int64(l.cooldown))
+}
+
+func (l *RedisRateLimiter) openBreaker(err error) {
+	if l.openUntil.Swap(time.Now().Add(l.cooldown).UnixNano()) == 0 {
+		l.logger.Warn("redis rate limiter unavailable, falling back to in-memory limits",
+			zap.Duration("retry_in", l.cooldown), zap.Error(err))
+	}
+}
+
+func (l *RedisRateLimiter) closeBreaker() {
+	if l.openUntil.Load() != 0 && l.openUntil.Swap(0) != 0 {
+		l.logger.Info("redis rate limiter recovered")
+	}
+}
+
+// RateLimitKeyFunc returns the bucket a request is counted in. Requests for which it
+// returns "" are not limited.
+type RateLimitKeyFunc func(r *http.Request) string
+
+// KeyByIP counts requests per client IP.
+func KeyByIP(r *http.Request) string {
+	return "ip:" + GetUserIP(r)
+}
+
+// KeyByHeader counts requests per value of header, e.g. an API key header.
+func KeyByHeader(header string) RateLimitKeyFunc {
+	return func(r *http.Request) string {
+		if v := r.Header.Get(header); v != "" {
+			return strings.ToLower(header) + ":" + v
+		}
+		return ""
+	}
+}
+
+// KeyByJWTSubject counts requests per subject of the verified JWTAuthenticator principal,
+// so place the policy behind the authentication middleware. Requests without a principal
+// are counted per client IP: claims of a token that was not verified can be forged to
+// get a fresh budget on every request.
+func KeyByJWTSubject(r *http.Request) string {
+	if p, ok := PrincipalFromContext(r.Context()); ok && p.Subject != "" {
+		return "sub:" + p.Subject
+	}
+	return KeyByIP(r)
+}
+
+// KeyByRoute counts requests per route and key, giving every route its own budget. The
+// route is only known inside the ServeMux, so register the policy per route or group.
+func KeyByRoute(key RateLimitKeyFunc) RateLimitKeyFunc {
+	return func(r *http.Request) string {
+		if k := key(r); k != "" {
+			return "route:" + r.Method + " " + RouteTemplate(r) + ":" + k
+		}
+		return ""
+	}
+}
+
+// RateLimitPolicy is the rate limit middleware created by NewRateLimitPolicy.
+type RateLimitPolicy struct {
+	logger  *zap.Logger
+	limiter RateLimiter
+	limit   Limit
+	key     RateLimitKeyFunc
+	policy  string
+}
+
+// NewRateLimitPolicy limits the requests of each key to limit. A nil key is KeyByIP.
+func NewRateLimitPolicy(logger *zap.Logger, limiter RateLimiter, limit Limit, key RateLimitKeyFunc) (*RateLimitPolicy, error) {
+	if err := limit.validate(); err != nil {
+		return nil, err
+	}
+	if key == nil {
+		key = KeyByIP
+	}
+	return &RateLimitPolicy{
+		logger:  logger,
+		limiter: limiter,
+		limit:   limit,
+		key:     key,
+		policy:  strconv.Itoa(limit.Rate) + ";w=" + strconv.Itoa(int(limit.Period.Seconds())),
+	}, nil
+}
+
+// Handler returns the middleware. Requests are let through if the limiter fails.
+func (p *RateLimitPolicy) Handler(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		key := p.key(r)
+		if key == "" {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		d, err := p.limiter.Allow(r.Context(), key, p.limit)
+		if err != nil {
+			p.logger.Error("rate limiter failed", zap.String("key", key), zap.Error(err))
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		h := w.Header()
+		h.Set("RateLimit-Limit", strconv.Itoa(p.limit.Rate))
+		h.Set("RateLimit-Remaining", strconv.Itoa(d.Remaining))
+		h.Set("RateLimit-Reset", ceilSeconds(d.ResetAfter))
+		h.Set("RateLimit-Policy", p.policy)
+		if !d.Allowed {
+			h.Set("Retry-After", ceilSeconds(d.RetryAfter))
+			utils.WriteProblemResponse(w, r, utils.Problem{
+				Status: http.StatusTooManyRequests,
+				Code:   "rate_limited",
+				Detail: fmt.Sprintf("limit of %d requests per %s exceeded", p.limit.Rate, p.limit.Period),
+			})
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+func ceilSeconds(d time.Duration) string {
+	return strconv.Itoa(int(math.Ceil(d.Seconds())))
+}
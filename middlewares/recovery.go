@@ -0,0 +1,176 @@
+package middlewares
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"runtime/debug"
+
+	"github.com/harphies/go.microservices.io/observability/prommetrics"
+	"github.com/harphies/go.microservices.io/utils"
+	"github.com/prometheus/client_golang/prometheus"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
+	"go.uber.org/zap"
+)
+
+/*
+Panic recovery: a panic in a handler is logged with its stack, counted and recorded on the
+active span, and the client gets a 500 problem response instead of a dropped connection.
+
+	recoverer, err := middlewares.NewRecoverer(logger, middlewares.RecoveryConfig{
+		Registerer: reg,
+		Report: func(ctx context.Context, p middlewares.PanicReport) {
+			sentry.CaptureException(p.Err)
+		},
+	})
+	handler := middlewares.NewChain(ids.Handler, access.Handler, recoverer.Handler, metrics.Handler).Then(mux)
+	srv := httpserver.NewServer(logger, otelhttp.NewHandler(handler, "http"))
+
+Place the recoverer after the request ID and tracing middlewares and before the rest of
+the chain. It reports the request ID and records the panic on the span of the request it
+receives, and both are only on the context the outer middlewares pass on. Panics in the
+middlewares before it are not recovered, so keep those simple.
+A panic with http.ErrAbortHandler is passed on, since net/http uses it to abort a
+response silently.
+*/
+
+// PanicReport describes a recovered panic, for reporting to an external sink.
+type PanicReport struct {
+	// Value is the value passed to panic and Err wraps it as an error.
+	Value any
+	Err   error
+	Stack []byte
+
+	Method    string
+	Route     string
+	Path      string
+	RequestID string
+}
+
+// RecoveryConfig configures a Recoverer.
+type RecoveryConfig struct {
+	// Registerer is where the panic counter is registered, prometheus.DefaultRegisterer if nil.
+	Registerer prometheus.Registerer
+	// Namespace defaults to prommetrics.DefaultPromMetricsNamespace.
+	Namespace string
+	Subsystem string
+	// Route returns the route template of a request, RouteTemplate by default.
+	Route func(r *http.Request) string
+	// Report is called with every recovered panic, after it was logged. It runs on the
+	// request goroutine, so it should not block for long.
+	Report func(ctx context.Context, report PanicReport)
+}
+
+// Recoverer is the panic recovery middleware created by NewRecoverer.
+type Recoverer struct {
+	logger *zap.Logger
+	panics *prometheus.CounterVec
+	route  func(r *http.Request) string
+	report func(ctx context.Context, report PanicReport)
+}
+
+// NewRecoverer returns a recoverer logging to logger and registers its
+// http_panics_total{method,route} counter on cfg.Registerer.
+func NewRecoverer(logger *zap.Logger, cfg RecoveryConfig) (*Recoverer, error) {
+	reg := cfg.Registerer
+	if reg == nil {
+		reg = prometheus.DefaultRegisterer
+	}
+	namespace := cfg.Namespace
+	if namespace == "" {
+		namespace = prommetrics.DefaultPromMetricsNamespace
+	}
+
+	panics, err := prommetrics.Register(reg, prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Subsystem: cfg.Subsystem,
+		Name:      "http_panics_total",
+		Help:      "Total number of panics recovered in HTTP handlers",
+	}, []string{"method", "route"}))
+	if err != nil {
+		return nil, err
+	}
+
+	rec := &Recoverer{logger: logger, panics: panics, route: cfg.Route, report: cfg.Report}
+	if rec.route == nil {
+		rec.route = RouteTemplate
+	}
+	return rec, nil
+}
+
+// Handler returns the recovery middleware.
+func (rec *Recoverer) Handler(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		rw := NewResponseWriter(w)
+		defer func() {
+			p := recover()
+			if p == nil {
+				return
+			}
+			if p == http.ErrAbortHandler {
+				panic(p)
+			}
+			rec.recovered(rw, r, p, debug.Stack())
+		}()
+		next.ServeHTTP(rw, r)
+	})
+}
+
+func (rec *Recoverer) recovered(w *ResponseWriter, r *http.Request, p any, stack []byte) {
+	err, ok := p.(error)
+	if !ok {
+		err = fmt.Errorf("panic: %v", p)
+	}
+	report := PanicReport{
+		Value:     p,
+		Err:       err,
+		Stack:     stack,
+		Method:    r.Method,
+		Route:     rec.route(r),
+		Path:      r.URL.Path,
+		RequestID: utils.RequestIDFromContext(r.Context()),
+	}
+	if report.RequestID == "" {
+		// the request ID middleware also sets the header, if the recoverer was placed before it
+		report.RequestID = r.Header.Get(utils.RequestIDHeader)
+	}
+
+	rec.logger.Error("recovered from panic in http handler",
+		zap.Any("panic", p),
+		zap.String("method", report.Method),
+		zap.String("route", report.Route),
+		zap.String("path", report.Path),
+		zap.String("request_id", report.RequestID),
+		zap.ByteString("stack", stack),
+	)
+	rec.panics.WithLabelValues(normalizeMethod(r.Method), report.Route).Inc()
+
+	span := trace.SpanFromContext(r.Context())
+	span.RecordError(err, trace.WithStackTrace(true))
+	span.SetStatus(codes.Error, "panic")
+
+	if rec.report != nil {
+		rec.reportPanic(r.Context(), report)
+	}
+
+	if w.WroteHeader() {
+		// part of the response is on the wire, so a 500 can't be sent anymore; abort the
+		// connection so the client does not take the truncated response as complete
+		panic(http.ErrAbortHandler)
+	}
+	utils.WriteProblemResponse(w, r, utils.Problem{
+		Status: http.StatusInternalServerError,
+		Code:   "internal_error",
+	})
+}
+
+// reportPanic keeps a panicking Report hook from escaping the recoverer.
+func (rec *Recoverer) reportPanic(ctx context.Context, report PanicReport) {
+	defer func() {
+		if p := recover(); p != nil {
+			rec.logger.Error("panic reporter failed", zap.Any("panic", p))
+		}
+	}()
+	rec.report(ctx, report)
+}
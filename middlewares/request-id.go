@@ -0,0 +1,91 @@
+package middlewares
+
+import (
+	"net/http"
+
+	"github.com/harphies/go.microservices.io/observability/logging"
+	"github.com/harphies/go.microservices.io/utils"
+	"go.uber.org/zap"
+)
+
+/*
+Request IDs correlate the logs of a request with the calls it makes downstream.
+
+	ids := middlewares.NewRequestIDPropagator(middlewares.RequestIDConfig{Logger: logger})
+	handler := middlewares.NewChain(ids.Handler, access.Handler, recoverer.Handler).Then(mux)
+
+A valid X-Request-ID from the client is kept, otherwise a ULID is generated. The ID is
+echoed on the response and stored on the context (utils.RequestIDFromContext), from where
+utils.HTTPRequest and the Kafka and SQS publishers forward it, and added to the context
+logger as "request_id". Placed first, the middleware puts Logger on the context, so
+handlers get the ID from logging.LoggerFromContext with or without an AccessLogger.
+*/
+
+// RequestIDConfig configures a RequestIDPropagator.
+type RequestIDConfig struct {
+	// Header defaults to utils.RequestIDHeader.
+	Header string
+	// IgnoreIncoming always generates a new ID, for services facing untrusted clients.
+	IgnoreIncoming bool
+	// Generate returns a new ID, utils.GenerateID by default.
+	Generate func() (string, error)
+	// Logger is stored on the context, with the ID, when no outer middleware stored a
+	// logger. Without it the ID is only added to an existing context logger.
+	Logger *zap.Logger
+}
+
+// RequestIDPropagator is the request ID middleware created by NewRequestIDPropagator.
+type RequestIDPropagator struct {
+	header         string
+	ignoreIncoming bool
+	generate       func() (string, error)
+	logger         *zap.Logger
+}
+
+// NewRequestIDPropagator returns the request ID middleware for cfg.
+func NewRequestIDPropagator(cfg RequestIDConfig) *RequestIDPropagator {
+	p := &RequestIDPropagator{
+		header:         cfg.Header,
+		ignoreIncoming: cfg.IgnoreIncoming,
+		generate:       cfg.Generate,
+		logger:         cfg.Logger,
+	}
+	if p.header == "" {
+		p.header = utils.RequestIDHeader
+	}
+	if p.generate == nil {
+		p.generate = utils.GenerateID
+	}
+	return p
+}
+
+var defaultRequestIDs = NewRequestIDPropagator(RequestIDConfig{})
+
+// RequestID is the request ID middleware with the default configuration.
+func RequestID(next http.Handler) http.Handler {
+	return defaultRequestIDs.Handler(next)
+}
+
+// Handler returns the request ID middleware.
+func (p *RequestIDPropagator) Handler(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		id := ""
+		if !p.ignoreIncoming {
+			id = r.Header.Get(p.header)
+		}
+		if !utils.ValidRequestID(id) {
+			var err error
+			if id, err = p.generate(); err != nil {
+				logging.LoggerFromContext(r.Context()).Warn("failed to generate request id", zap.Error(err))
+				next.ServeHTTP(w, r)
+				return
+			}
+		}
+		r.Header.Set(p.header, id)
+		w.Header().Set(p.header, id)
+
+		ctx := contextWithLogFields(r.Context(), p.logger, zap.String("request_id", id))
+		ctx = utils.ContextWithRequestID(ctx, id)
+		serveWithContext(ctx, next, w, r)
+	})
+}
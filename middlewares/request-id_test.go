@@ -0,0 +1,67 @@
+package middlewares
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/harphies/go.microservices.io/observability/logging"
+	"github.com/harphies/go.microservices.io/utils"
+	"go.uber.org/zap"
+	"go.uber.org/zap/zaptest/observer"
+)
+
+func TestRequestIDSeedsTheContextLogger(t *testing.T) {
+	core, logs := observer.New(zap.InfoLevel)
+	ids := NewRequestIDPropagator(RequestIDConfig{Logger: zap.New(core)})
+	handler := ids.Handler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		logging.LoggerFromContext(r.Context()).Info("handled")
+	}))
+
+	for _, incoming := range []string{"", "client-id-1"} {
+		r := httptest.NewRequest(http.MethodGet, "/", nil)
+		if incoming != "" {
+			r.Header.Set(utils.RequestIDHeader, incoming)
+		}
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, r)
+
+		id := w.Header().Get(utils.RequestIDHeader)
+		if incoming != "" && id != incoming {
+			t.Errorf("response ID = %q, want the incoming %q", id, incoming)
+		}
+		entries := logs.TakeAll()
+		if len(entries) != 1 {
+			t.Fatalf("got %d log entries, want 1", len(entries))
+		}
+		if got := entries[0].ContextMap()["request_id"]; got != id || id == "" {
+			t.Errorf("handler logged request_id %v, want %q", got, id)
+		}
+	}
+}
+
+func TestRequestIDExtendsAnExistingContextLogger(t *testing.T) {
+	outerCore, outerLogs := observer.New(zap.InfoLevel)
+	seedCore, seedLogs := observer.New(zap.InfoLevel)
+	ids := NewRequestIDPropagator(RequestIDConfig{Logger: zap.New(seedCore)})
+	handler := ids.Handler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		logging.LoggerFromContext(r.Context()).Info("handled")
+	}))
+
+	r := httptest.NewRequest(http.MethodGet, "/", nil)
+	outer := zap.New(outerCore).With(zap.String("tenant", "acme"))
+	r = r.WithContext(logging.ContextWithLogger(r.Context(), outer))
+	handler.ServeHTTP(httptest.NewRecorder(), r)
+
+	if seedLogs.Len() != 0 {
+		t.Fatal("the context logger was replaced")
+	}
+	entries := outerLogs.TakeAll()
+	if len(entries) != 1 {
+		t.Fatalf("got %d log entries, want 1", len(entries))
+	}
+	fields := entries[0].ContextMap()
+	if fields["tenant"] != "acme" || fields["request_id"] == "" || fields["request_id"] == nil {
+		t.Errorf("handler logged %v, want the outer fields and the request ID", fields)
+	}
+}
@@ -1,4 +1,358 @@
 package middlewares
 
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/lestrrat-go/jwx/v2/jwa"
+	"github.com/lestrrat-go/jwx/v2/jwk"
+	"github.com/lestrrat-go/jwx/v2/jws"
+	"github.com/lestrrat-go/jwx/v2/jwt"
+	"go.uber.org/zap"
+)
+
 // Require Authorization server access token
 // https://github.com/okta-samples/okta-go-api-sample/blob/main/server/middleware.go#L13
+
+/*
+Bearer JWT authentication against the JWKS of an authorization server (Cognito, Okta,
+Auth0, Keycloak, ...).
+
+	authn, err := middlewares.NewJWTAuthenticator(ctx, logger, middlewares.JWTAuthConfig{
+		JWKSURL:  "https://cognito-idp.eu-west-1.amazonaws.com/<pool>/.well-known/jwks.json",
+		Issuer:   "https://cognito-idp.eu-west-1.amazonaws.com/<pool>",
+		Audience: "orders-api",
+	})
+	api := middlewares.NewGroup(mux, authn.Handler)
+	api.HandleFunc("POST /orders", createOrder, authn.RequireScopes("orders:write"))
+	api.HandleFunc("DELETE /orders/{id}", deleteOrder, authn.RequireRoles("admin"))
+
+Handlers read the caller from middlewares.PrincipalFromContext.
+Refs
+https://datatracker.ietf.org/doc/html/rfc6750#section-3
+https://datatracker.ietf.org/doc/html/rfc8725
+*/
+
+const (
+	defaultClockSkew        = time.Minute
+	defaultJWKSRefresh      = 15 * time.Minute
+	minJWKSRefreshOnUnknown = 30 * time.Second
+)
+
+// asymmetricAlgorithms are the accepted signature algorithms. Symmetric and "none"
+// algorithms are rejected, since a JWKS only publishes public keys.
+var asymmetricAlgorithms = []jwa.SignatureAlgorithm{
+	jwa.RS256, jwa.RS384, jwa.RS512,
+	jwa.PS256, jwa.PS384, jwa.PS512,
+	jwa.ES256, jwa.ES384, jwa.ES512,
+	jwa.EdDSA,
+}
+
+// JWTAuthConfig configures a JWTAuthenticator.
+type JWTAuthConfig struct {
+	// JWKSURL serves the public keys tokens are signed with.
+	JWKSURL string
+	// Issuer and Audience are compared with the iss and aud claims when set.
+	Issuer   string
+	Audience string
+	// ClockSkew is tolerated when checking exp, nbf and iat, 1 minute by default.
+	ClockSkew time.Duration
+	// RefreshInterval is how often the JWKS is fetched again, 15 minutes by default. Tokens
+	// signed with an unknown key trigger a refresh at most every 30 seconds.
+	RefreshInterval time.Duration
+	// Realm is sent in WWW-Authenticate challenges.
+	Realm string
+	// ScopeClaim holds the granted scopes, "scope" (space separated) or "scp" by default.
+	ScopeClaim string
+	// RolesClaim holds the caller's roles, "roles", "groups" or "cognito:groups" by default.
+	RolesClaim string
+	// HTTPClient fetches the JWKS, http.DefaultClient if nil.
+	HTTPClient *http.Client
+}
+
+// Principal is the authenticated caller of a request.
+type Principal struct {
+	Subject string
+	Scopes  []string
+	Roles   []string
+	// Claims are all claims of the token.
+	Claims map[string]any
+	Token  jwt.Token
+}
+
+// HasScope reports whether the principal was granted scope.
+func (p *Principal) HasScope(scope string) bool {
+	return slices.Contains(p.Scopes, scope)
+}
+
+// HasRole reports whether the principal has role.
+func (p *Principal) HasRole(role string) bool {
+	return slices.Contains(p.Roles, role)
+}
+
+type principalKey struct{}
+
+// PrincipalFromContext returns the principal stored by JWTAuthenticator.
+func PrincipalFromContext(ctx context.Context) (*Principal, bool) {
+	p, ok := ctx.Value(principalKey{}).(*Principal)
+	return p, ok
+}
+
+// JWTAuthenticator is the bearer token middleware created by NewJWTAuthenticator.
+type JWTAuthenticator struct {
+	logger *zap.Logger
+	cfg    JWTAuthConfig
+	cache  *jwk.Cache
+
+	mu          sync.Mutex
+	lastRefresh time.Time
+}
+
+// NewJWTAuthenticator starts caching the JWKS, which stops when ctx is done. A JWKS that
+// cannot be fetched yet is only logged, so services start while the issuer is down.
+func NewJWTAuthenticator(ctx context.Context, logger *zap.Logger, cfg JWTAuthConfig) (*JWTAuthenticator, error) {
+	if cfg.JWKSURL == "" {
+		return nil, errors.New("jwt auth: JWKS URL is required")
+	}
+	if cfg.ClockSkew == 0 {
+		cfg.ClockSkew = defaultClockSkew
+	}
+	if cfg.RefreshInterval == 0 {
+		cfg.RefreshInterval = defaultJWKSRefresh
+	}
+
+	cache := jwk.NewCache(ctx)
+	opts := []jwk.RegisterOption{jwk.WithRefreshInterval(cfg.RefreshInterval)}
+	if cfg.HTTPClient != nil {
+		opts = append(opts, jwk.WithHTTPClient(cfg.HTTPClient))
+	}
+	if err := cache.Register(cfg.JWKSURL, opts...); err != nil {
+		return nil, fmt.Errorf("jwt auth: register JWKS: %w", err)
+	}
+	a := &JWTAuthenticator{logger: logger, cfg: cfg, cache: cache, lastRefresh: time.Now()}
+	if _, err := cache.Refresh(ctx, cfg.JWKSURL); err != nil {
+		logger.Warn("failed to fetch JWKS, retrying on first request", zap.String("url", cfg.JWKSURL), zap.Error(err))
+	}
+	return a, nil
+}
+
+// Authenticate verifies a raw token and returns its principal.
+func (a *JWTAuthenticator) Authenticate(ctx context.Context, token string) (*Principal, error) {
+	opts := []jwt.ParseOption{
+		jwt.WithKeyProvider(jws.KeyProviderFunc(a.fetchKeys)),
+		jwt.WithValidate(true),
+		jwt.WithAcceptableSkew(a.cfg.ClockSkew),
+		jwt.WithRequiredClaim("exp"),
+		jwt.WithContext(ctx),
+	}
+	if a.cfg.Issuer != "" {
+		opts = append(opts, jwt.WithIssuer(a.cfg.Issuer))
+	}
+	if a.cfg.Audience != "" {
+		opts = append(opts, jwt.WithAudience(a.cfg.Audience))
+	}
+	tok, err := jwt.ParseString(token, opts...)
+	if err != nil {
+		return nil, err
+	}
+
+	claims, err := tok.AsMap(ctx)
+	if err != nil {
+		return nil, err
+	}
+	p := &Principal{Subject: tok.Subject(), Claims: claims, Token: tok}
+	for _, name := range claimNames(a.cfg.ScopeClaim, "scope", "scp") {
+		if v, ok := claims[name]; ok {
+			p.Scopes = claimStrings(v)
+			break
+		}
+	}
+	for _, name := range claimNames(a.cfg.RolesClaim, "roles", "groups", "cognito:groups") {
+		if v, ok := claims[name]; ok {
+			p.Roles = claimStrings(v)
+			break
+		}
+	}
+	return p, nil
+}
+
+// fetchKeys supplies the JWKS key matching the token's kid, refreshing the JWKS when the
+// key is unknown since the issuer may have rotated its keys.
+func (a *JWTAuthenticator) fetchKeys(ctx context.Context, sink jws.KeySink, sig *jws.Signature, _ *jws.Message) error {
+	headers := sig.ProtectedHeaders()
+	alg := headers.Algorithm()
+	if !slices.Contains(asymmetricAlgorithms, alg) {
+		return fmt.Errorf("signature algorithm %q not allowed", alg)
+	}
+	kid := headers.KeyID()
+	if kid == "" {
+		return errors.New("token has no kid header")
+	}
+
+	set, err := a.cache.Get(ctx, a.cfg.JWKSURL)
+	if err != nil {
+		return fmt.Errorf("fetch JWKS: %w", err)
+	}
+	key, ok := set.LookupKeyID(kid)
+	if !ok && a.refreshAllowed() {
+		if set, err = a.cache.Refresh(ctx, a.cfg.JWKSURL); err != nil {
+			return fmt.Errorf("refresh JWKS: %w", err)
+		}
+		key, ok = set.LookupKeyID(kid)
+	}
+	if !ok {
+		return fmt.Errorf("key %q not found in JWKS", kid)
+	}
+	if keyAlg := key.Algorithm(); keyAlg != nil && keyAlg.String() != "" && keyAlg.String() != alg.String() {
+		return fmt.Errorf("key %q is for %s, not %s", kid, keyAlg, alg)
+	}
+	sink.Key(alg, key)
+	return nil
+}
+
+func (a *JWTAuthenticator) refreshAllowed() bool {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if time.Since(a.lastRefresh) < minJWKSRefreshOnUnknown {
+		return false
+	}
+	a.lastRefresh = time.Now()
+	return true
+}
+
+// Handler returns a middleware rejecting requests without a valid bearer token with 401
+// Unauthorized and storing the principal of the others on the context.
+func (a *JWTAuthenticator) Handler(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		authz := r.Header.Get("Authorization")
+		if authz == "" {
+			a.challenge(w, http.StatusUnauthorized, "", "")
+			return
+		}
+		scheme, token, ok := strings.Cut(authz, " ")
+		if !ok || !strings.EqualFold(scheme, "Bearer") || strings.TrimSpace(token) == "" {
+			a.challenge(w, http.StatusBadRequest, "invalid_request", "the Authorization header is not a bearer token")
+			return
+		}
+
+		p, err := a.Authenticate(r.Context(), strings.TrimSpace(token))
+		if err != nil {
+			a.logger.Info("rejected bearer token", zap.String("path", r.URL.Path), zap.Error(err))
+			a.challenge(w, http.StatusUnauthorized, "invalid_token", tokenErrorDescription(err))
+			return
+		}
+		serveWithContext(context.WithValue(r.Context(), principalKey{}, p), next, w, r)
+	})
+}
+
+func (a *JWTAuthenticator) challenge(w http.ResponseWriter, status int, code, description string) {
+	writeBearerChallenge(w, a.cfg.Realm, status, code, description, nil)
+}
+
+// RequireScopes returns a middleware responding 403 Forbidden unless the principal was
+// granted every scope. Use it behind a.Handler.
+func (a *JWTAuthenticator) RequireScopes(scopes ...string) Middleware {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			p, ok := PrincipalFromContext(r.Context())
+			if !ok {
+				a.challenge(w, http.StatusUnauthorized, "", "")
+				return
+			}
+			for _, s := range scopes {
+				if !p.HasScope(s) {
+					writeBearerChallenge(w, a.cfg.Realm, http.StatusForbidden, "insufficient_scope", "the token lacks a required scope", scopes)
+					return
+				}
+			}
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+// RequireRoles returns a middleware responding 403 Forbidden unless the principal has at
+// least one of roles. Use it behind a.Handler.
+func (a *JWTAuthenticator) RequireRoles(roles ...string) Middleware {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			p, ok := PrincipalFromContext(r.Context())
+			if !ok {
+				a.challenge(w, http.StatusUnauthorized, "", "")
+				return
+			}
+			if !slices.ContainsFunc(roles, p.HasRole) {
+				a.challenge(w, http.StatusForbidden, "insufficient_scope", "the caller lacks a required role")
+				return
+			}
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+// writeBearerChallenge responds with status and a WWW-Authenticate header per RFC 6750.
+func writeBearerChallenge(w http.ResponseWriter, realm string, status int, code, description string, scopes []string) {
+	var params []string
+	if realm != "" {
+		params = append(params, fmt.Sprintf("realm=%q", realm))
+	}
+	if code != "" {
+		params = append(params, fmt.Sprintf("error=%q", code))
+	}
+	if description != "" {
+		params = append(params, fmt.Sprintf("error_description=%q", description))
+	}
+	if len(scopes) > 0 {
+		params = append(params, fmt.Sprintf("scope=%q", strings.Join(scopes, " ")))
+	}
+	challenge := "Bearer"
+	if len(params) > 0 {
+		challenge += " " + strings.Join(params, ", ")
+	}
+	w.Header().Set("WWW-Authenticate", challenge)
+	http.Error(w, http.StatusText(status), status)
+}
+
+// tokenErrorDescription explains why a token was rejected without leaking details.
+func tokenErrorDescription(err error) string {
+	switch {
+	case errors.Is(err, jwt.ErrTokenExpired()):
+		return "the token expired"
+	case errors.Is(err, jwt.ErrTokenNotYetValid()):
+		return "the token is not valid yet"
+	case errors.Is(err, jwt.ErrInvalidIssuer()), errors.Is(err, jwt.ErrInvalidAudience()):
+		return "the token was not issued for this service"
+	}
+	return "the token is invalid"
+}
+
+func claimNames(configured string, defaults ...string) []string {
+	if configured != "" {
+		return []string{configured}
+	}
+	return defaults
+}
+
+// claimStrings reads a claim holding a space separated string or a list of strings.
+func claimStrings(v any) []string {
+	switch v := v.(type) {
+	case string:
+		return strings.Fields(v)
+	case []string:
+		return v
+	case []any:
+		out := make([]string, 0, len(v))
+		for _, item := range v {
+			if s, ok := item.(string); ok {
+				out = append(out, s)
+			}
+		}
+		return out
+	}
+	return nil
+}
@@ -0,0 +1,42 @@
+package middlewares
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestRequireScopesAndRolesChallengeWithTheRealm(t *testing.T) {
+	a := &JWTAuthenticator{cfg: JWTAuthConfig{Realm: "orders"}}
+	ok := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {})
+	principal := &Principal{Subject: "alice", Scopes: []string{"orders:read"}, Roles: []string{"viewer"}}
+
+	tests := []struct {
+		name      string
+		mw        Middleware
+		principal *Principal
+		status    int
+		challenge string
+	}{
+		{"scopes without principal", a.RequireScopes("orders:write"), nil, http.StatusUnauthorized, `Bearer realm="orders"`},
+		{"missing scope", a.RequireScopes("orders:write"), principal, http.StatusForbidden,
+			`Bearer realm="orders", error="insufficient_scope", error_description="the token lacks a required scope", scope="orders:write"`},
+		{"granted scope", a.RequireScopes("orders:read"), principal, http.StatusOK, ""},
+		{"roles without principal", a.RequireRoles("admin"), nil, http.StatusUnauthorized, `Bearer realm="orders"`},
+		{"missing role", a.RequireRoles("admin"), principal, http.StatusForbidden,
+			`Bearer realm="orders", error="insufficient_scope", error_description="the caller lacks a required role"`},
+		{"granted role", a.RequireRoles("admin", "viewer"), principal, http.StatusOK, ""},
+	}
+	for _, tt := range tests {
+		r := httptest.NewRequest(http.MethodGet, "/orders", nil)
+		if tt.principal != nil {
+			r = r.WithContext(context.WithValue(r.Context(), principalKey{}, tt.principal))
+		}
+		w := httptest.NewRecorder()
+		tt.mw(ok).ServeHTTP(w, r)
+		if w.Code != tt.status || w.Header().Get("WWW-Authenticate") != tt.challenge {
+			t.Errorf("%s: got %d %q, want %d %q", tt.name, w.Code, w.Header().Get("WWW-Authenticate"), tt.status, tt.challenge)
+		}
+	}
+}
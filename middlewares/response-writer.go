@@ -0,0 +1,101 @@
+package middlewares
+
+import (
+	"bufio"
+	"io"
+	"net"
+	"net/http"
+)
+
+// ResponseWriter wraps an http.ResponseWriter to record the status code and the number of
+// body bytes written. It keeps http.Flusher and http.Hijacker working and supports
+// http.ResponseController through Unwrap.
+type ResponseWriter struct {
+	http.ResponseWriter
+	status      int
+	written     int64
+	wroteHeader bool
+}
+
+// NewResponseWriter wraps w. If w already is a *ResponseWriter it is returned as is, so
+// stacked middlewares share one wrapper.
+func NewResponseWriter(w http.ResponseWriter) *ResponseWriter {
+	if rw, ok := w.(*ResponseWriter); ok {
+		return rw
+	}
+	return &ResponseWriter{ResponseWriter: w}
+}
+
+// Status returns the status code sent, 200 if the handler wrote a body without calling
+// WriteHeader, or 0 if nothing was written yet.
+func (w *ResponseWriter) Status() int {
+	return w.status
+}
+
+// BytesWritten returns the number of body bytes written.
+func (w *ResponseWriter) BytesWritten() int64 {
+	return w.written
+}
+
+// WroteHeader reports whether the response header was sent.
+func (w *ResponseWriter) WroteHeader() bool {
+	return w.wroteHeader
+}
+
+func (w *ResponseWriter) WriteHeader(code int) {
+	// informational responses are followed by the real one, except for protocol switches
+	if !w.wroteHeader && (code >= 200 || code == http.StatusSwitchingProtocols) {
+		w.status = code
+		w.wroteHeader = true
+	}
+	w.ResponseWriter.WriteHeader(code)
+}
+
+func (w *ResponseWriter) Write(b []byte) (int, error) {
+	if !w.wroteHeader {
+		w.WriteHeader(http.StatusOK)
+	}
+	n, err := w.ResponseWriter.Write(b)
+	w.written += int64(n)
+	return n, err
+}
+
+// ReadFrom keeps the sendfile optimisation of the underlying writer for io.Copy.
+func (w *ResponseWriter) ReadFrom(r io.Reader) (int64, error) {
+	if !w.wroteHeader {
+		w.WriteHeader(http.StatusOK)
+	}
+	n, err := io.Copy(w.ResponseWriter, r)
+	w.written += n
+	return n, err
+}
+
+// Flush implements http.Flusher. It does nothing if the underlying writer cannot flush.
+func (w *ResponseWriter) Flush() {
+	if !w.wroteHeader {
+		w.WriteHeader(http.StatusOK)
+	}
+	if f, ok := w.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// Hijack implements http.Hijacker, returning http.ErrNotSupported if the underlying writer
+// cannot be hijacked.
+func (w *ResponseWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	h, ok := w.ResponseWriter.(http.Hijacker)
+	if !ok {
+		return nil, nil, http.ErrNotSupported
+	}
+	conn, rw, err := h.Hijack()
+	if err == nil && !w.wroteHeader {
+		w.status = http.StatusSwitchingProtocols
+		w.wroteHeader = true
+	}
+	return conn, rw, err
+}
+
+// Unwrap returns the underlying writer for http.ResponseController.
+func (w *ResponseWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
@@ -0,0 +1,256 @@
+package middlewares
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"net"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/harphies/go.microservices.io/utils"
+)
+
+/*
+Per-route deadlines on the request context, so the work of a request stops once nobody is
+waiting for its response anymore.
+
+	timeouts := middlewares.NewTimeoutPolicy(middlewares.TimeoutConfig{
+		Default: 5 * time.Second,
+		Routes: []middlewares.RouteTimeout{
+			{Route: "POST /reports/...", Timeout: 30 * time.Second},
+		},
+	})
+	handler := middlewares.NewChain(timeouts.Handler, compressor.Handler).Then(mux)
+
+A Request-Timeout header from the caller shortens the deadline. Handlers that have not
+started their response when the deadline passes are answered with a 503 problem response,
+and their later writes fail with http.ErrHandlerTimeout. utils.HTTPRequest forwards the
+remaining budget as Request-Timeout, and gRPC clients as grpc-timeout; Postgres queries
+and S3 operations run with the request context are cancelled at the deadline.
+Place the policy before middlewares that buffer the response, such as the Compressor, so
+the timeout response is not held back. Timeouts above the server WriteTimeout need
+http.ResponseController.SetWriteDeadline.
+*/
+
+// RouteTimeout applies Timeout to requests matching Route, a "[METHOD ]pattern" route as
+// in IdentityRule.
+type RouteTimeout struct {
+	Route   string
+	Timeout time.Duration
+}
+
+// TimeoutConfig configures a TimeoutPolicy.
+type TimeoutConfig struct {
+	// Default applies to requests matching none of Routes; zero means no timeout.
+	Default time.Duration
+	// Routes are matched in order, the first match wins.
+	Routes []RouteTimeout
+	// IgnoreRequestTimeout ignores the Request-Timeout header of callers.
+	IgnoreRequestTimeout bool
+	// Status is sent when the deadline passes, 503 Service Unavailable by default or
+	// 504 Gateway Timeout.
+	Status int
+}
+
+// TimeoutPolicy is the timeout middleware created by NewTimeoutPolicy.
+type TimeoutPolicy struct {
+	defaultTimeout       time.Duration
+	routes               []RouteTimeout
+	ignoreRequestTimeout bool
+	status               int
+}
+
+// NewTimeoutPolicy returns the timeout middleware for cfg.
+func NewTimeoutPolicy(cfg TimeoutConfig) *TimeoutPolicy {
+	p := &TimeoutPolicy{
+		defaultTimeout:       cfg.Default,
+		routes:               cfg.Routes,
+		ignoreRequestTimeout: cfg.IgnoreRequestTimeout,
+		status:               cfg.Status,
+	}
+	if p.status != http.StatusGatewayTimeout {
+		p.status = http.StatusServiceUnavailable
+	}
+	return p
+}
+
+// Timeout returns the timeout of r, zero for none.
+func (p *TimeoutPolicy) Timeout(r *http.Request) time.Duration {
+	timeout := p.defaultTimeout
+	for _, rule := range p.routes {
+		if matchRoute(rule.Route, r.Method, r.URL.Path) {
+			timeout = rule.Timeout
+			break
+		}
+	}
+	if p.ignoreRequestTimeout {
+		return timeout
+	}
+	if d, err := utils.ParseTimeout(r.Header.Get(utils.RequestTimeoutHeader)); err == nil && (timeout <= 0 || d < timeout) {
+		// a zero budget means the caller gave up already
+		timeout = max(d, time.Nanosecond)
+	}
+	return timeout
+}
+
+// Handler returns the timeout middleware.
+func (p *TimeoutPolicy) Handler(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		timeout := p.Timeout(r)
+		if timeout <= 0 {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		ctx, cancel := context.WithTimeout(r.Context(), timeout)
+		defer cancel()
+
+		// the problem is prepared here, since the handler may still use r at the deadline
+		problem := utils.Problem{
+			Status:    p.status,
+			Code:      "request_timeout",
+			Detail:    "the request did not complete within " + timeout.String(),
+			Instance:  r.URL.Path,
+			RequestID: utils.RequestIDFromContext(r.Context()),
+		}
+		if problem.RequestID == "" {
+			problem.RequestID = r.Header.Get(utils.RequestIDHeader)
+		}
+
+		tw := &timeoutWriter{w: w, header: w.Header().Clone()}
+		stop := context.AfterFunc(ctx, func() {
+			if ctx.Err() == context.DeadlineExceeded {
+				tw.timeout(r, problem)
+			}
+		})
+		defer func() {
+			stop()
+			tw.finish()
+		}()
+
+		serveWithContext(ctx, next, tw, r)
+	})
+}
+
+// timeoutWriter serializes the writes of the handler with the timeout response. The
+// handler gets its own header map, copied to the response when it writes the header.
+type timeoutWriter struct {
+	w      http.ResponseWriter
+	header http.Header
+
+	mu          sync.Mutex
+	wroteHeader bool
+	timedOut    bool
+	finished    bool
+}
+
+func (tw *timeoutWriter) Header() http.Header {
+	return tw.header
+}
+
+func (tw *timeoutWriter) WriteHeader(code int) {
+	tw.mu.Lock()
+	defer tw.mu.Unlock()
+	tw.writeHeaderLocked(code)
+}
+
+func (tw *timeoutWriter) writeHeaderLocked(code int) {
+	if tw.timedOut || tw.wroteHeader {
+		return
+	}
+	if code >= 100 && code < 200 && code != http.StatusSwitchingProtocols {
+		tw.copyHeader()
+		tw.w.WriteHeader(code)
+		return
+	}
+	tw.wroteHeader = true
+	tw.copyHeader()
+	tw.w.WriteHeader(code)
+}
+
+func (tw *timeoutWriter) copyHeader() {
+	dst := tw.w.Header()
+	for k := range dst {
+		if _, ok := tw.header[k]; !ok {
+			delete(dst, k)
+		}
+	}
+	for k, v := range tw.header {
+		dst[k] = v
+	}
+}
+
+func (tw *timeoutWriter) Write(b []byte) (int, error) {
+	tw.mu.Lock()
+	defer tw.mu.Unlock()
+	if tw.timedOut {
+		return 0, http.ErrHandlerTimeout
+	}
+	tw.writeHeaderLocked(http.StatusOK)
+	return tw.w.Write(b)
+}
+
+func (tw *timeoutWriter) Flush() {
+	tw.mu.Lock()
+	defer tw.mu.Unlock()
+	if !tw.timedOut {
+		http.NewResponseController(tw.w).Flush()
+	}
+}
+
+// Hijack is not supported: the connection could be taken over after the timeout response
+// was sent on it.
+func (tw *timeoutWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	return nil, nil, http.ErrNotSupported
+}
+
+func (tw *timeoutWriter) Unwrap() http.ResponseWriter {
+	return tw.w
+}
+
+// timeout answers the request unless the handler started its response or returned.
+func (tw *timeoutWriter) timeout(r *http.Request, problem utils.Problem) {
+	tw.mu.Lock()
+	defer tw.mu.Unlock()
+	if tw.wroteHeader || tw.finished {
+		return
+	}
+	tw.timedOut = true
+
+	// the response is complete before the handler returns, so it needs a Content-Length
+	buf := &bufferedResponse{header: tw.w.Header()}
+	utils.WriteProblemResponse(buf, r, problem)
+	tw.w.Header().Set("Content-Length", strconv.Itoa(buf.body.Len()))
+	// the handler still holds the connection, so clients should not wait to reuse it
+	tw.w.Header().Set("Connection", "close")
+	tw.w.WriteHeader(buf.status)
+	tw.w.Write(buf.body.Bytes())
+	http.NewResponseController(tw.w).Flush()
+}
+
+// finish keeps the timeout response from being written once the handler returned, and
+// sends the headers of a handler that returned without writing.
+func (tw *timeoutWriter) finish() {
+	tw.mu.Lock()
+	defer tw.mu.Unlock()
+	tw.finished = true
+	if !tw.timedOut && !tw.wroteHeader {
+		tw.copyHeader()
+	}
+}
+
+// bufferedResponse holds a small response in memory.
+type bufferedResponse struct {
+	header http.Header
+	status int
+	body   bytes.Buffer
+}
+
+func (b *bufferedResponse) Header() http.Header { return b.header }
+
+func (b *bufferedResponse) WriteHeader(code int) { b.status = code }
+
+func (b *bufferedResponse) Write(p []byte) (int, error) { return b.body.Write(p) }
@@ -0,0 +1,278 @@
+package health
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+const (
+	defaultCheckTimeout = 2 * time.Second
+
+	StatusOK   = "ok"
+	StatusFail = "fail"
+)
+
+// ErrDraining is reported by readiness while the server is shutting down.
+var ErrDraining = errors.New("server is draining")
+
+// Checker reports whether a dependency or component is healthy.
+type Checker interface {
+	Check(ctx context.Context) error
+}
+
+// CheckerFunc adapts an ordinary function to a Checker.
+type CheckerFunc func(ctx context.Context) error
+
+func (f CheckerFunc) Check(ctx context.Context) error {
+	return f(ctx)
+}
+
+// Pinger is implemented by the storage clients in this module that can probe their
+// connection: s3.AmazonS3Backend, postgresql.PostgresSQLDataStore, redis.CacheStore and
+// elasticsearch.SearchIndex.
+type Pinger interface {
+	Ping(ctx context.Context) error
+}
+
+// FromPinger adapts a client with a Ping method to a Checker.
+func FromPinger(p Pinger) Checker {
+	return CheckerFunc(p.Ping)
+}
+
+// CheckOption configures a registered check.
+type CheckOption func(*check)
+
+// WithTimeout bounds how long a single run of the check may take. Default: 2s.
+func WithTimeout(d time.Duration) CheckOption {
+	return func(c *check) {
+		c.timeout = d
+	}
+}
+
+// WithCacheTTL reuses the last result of the check for d, so frequent probes from several
+// kubelets or load balancers do not hammer the dependency. Default: no caching.
+func WithCacheTTL(d time.Duration) CheckOption {
+	return func(c *check) {
+		c.cacheTTL = d
+	}
+}
+
+type check struct {
+	name     string
+	checker  Checker
+	timeout  time.Duration
+	cacheTTL time.Duration
+
+	mu       sync.Mutex
+	last     Result
+	lastTime time.Time
+}
+
+// Result is the outcome of a single check.
+type Result struct {
+	Status   string `json:"status"`
+	Error    string `json:"error,omitempty"`
+	Duration string `json:"duration,omitempty"`
+}
+
+// Report is the JSON body returned by the health handlers.
+type Report struct {
+	Status string            `json:"status"`
+	Checks map[string]Result `json:"checks,omitempty"`
+}
+
+func (c *check) run(ctx context.Context) Result {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.cacheTTL > 0 && !c.lastTime.IsZero() && time.Since(c.lastTime) < c.cacheTTL {
+		return c.last
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, c.timeout)
+	defer cancel()
+
+	start := time.Now()
+	err := c.checker.Check(ctx)
+	res := Result{Status: StatusOK, Duration: time.Since(start).String()}
+	if err != nil {
+		res.Status = StatusFail
+		res.Error = err.Error()
+	}
+
+	c.last = res
+	c.lastTime = time.Now()
+	return res
+}
+
+// Health aggregates liveness and readiness checks and serves them over HTTP.
+//
+// Liveness checks answer "should this process be restarted?" and should only cover the
+// process itself. Readiness checks answer "should this process receive traffic?" and cover
+// the dependencies it needs. Readiness also fails as soon as Drain is called.
+type Health struct {
+	logger *zap.Logger
+
+	mu        sync.RWMutex
+	liveness  []*check
+	readiness []*check
+
+	draining atomic.Bool
+}
+
+// New creates an empty Health.
+func New(logger *zap.Logger) *Health {
+	return &Health{logger: logger}
+}
+
+// AddLivenessCheck registers a check served by /livez and /healthz.
+func (h *Health) AddLivenessCheck(name string, c Checker, opts ...CheckOption) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.liveness = append(h.liveness, newCheck(name, c, opts))
+}
+
+// AddReadinessCheck registers a check served by /readyz and /healthz.
+func (h *Health) AddReadinessCheck(name string, c Checker, opts ...CheckOption) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.readiness = append(h.readiness, newCheck(name, c, opts))
+}
+
+func newCheck(name string, c Checker, opts []CheckOption) *check {
+	chk := &check{name: name, checker: c, timeout: defaultCheckTimeout}
+	for _, opt := range opts {
+		opt(chk)
+	}
+	return chk
+}
+
+// Drain marks the process as shutting down so readiness starts failing immediately.
+func (h *Health) Drain() {
+	if !h.draining.Swap(true) {
+		h.logger.Info("readiness is now failing, server is draining")
+	}
+}
+
+// Draining reports whether Drain has been called.
+func (h *Health) Draining() bool {
+	return h.draining.Load()
+}
+
+// Live runs the liveness checks.
+func (h *Health) Live(ctx context.Context) Report {
+	h.mu.RLock()
+	checks := append([]*check(nil), h.liveness...)
+	h.mu.RUnlock()
+	return h.run(ctx, checks)
+}
+
+// Ready runs the readiness checks. It fails without running them while draining.
+func (h *Health) Ready(ctx context.Context) Report {
+	if h.Draining() {
+		return Report{Status: StatusFail, Checks: map[string]Result{
+			"shutdown": {Status: StatusFail, Error: ErrDraining.Error()},
+		}}
+	}
+
+	h.mu.RLock()
+	checks := append([]*check(nil), h.readiness...)
+	h.mu.RUnlock()
+	return h.run(ctx, checks)
+}
+
+// Healthy runs both liveness and readiness checks.
+func (h *Health) Healthy(ctx context.Context) Report {
+	live := h.Live(ctx)
+	ready := h.Ready(ctx)
+
+	report := Report{Status: StatusOK, Checks: make(map[string]Result, len(live.Checks)+len(ready.Checks))}
+	for _, r := range []Report{live, ready} {
+		if r.Status != StatusOK {
+			report.Status = StatusFail
+		}
+		for name, res := range r.Checks {
+			report.Checks[name] = res
+		}
+	}
+	return report
+}
+
+// run executes checks concurrently so one slow dependency does not add up with the others.
+func (h *Health) run(ctx context.Context, checks []*check) Report {
+	report := Report{Status: StatusOK, Checks: make(map[string]Result, len(checks))}
+
+	var (
+		mu sync.Mutex
+		wg sync.WaitGroup
+	)
+	for _, c := range checks {
+		wg.Add(1)
+		go func(c *check) {
+			defer wg.Done()
+			res := c.run(ctx)
+
+			mu.Lock()
+			defer mu.Unlock()
+			report.Checks[c.name] = res
+			if res.Status != StatusOK {
+				report.Status = StatusFail
+				h.logger.Warn("health check failed", zap.String("check", c.name), zap.String("error", res.Error))
+			}
+		}(c)
+	}
+	wg.Wait()
+	return report
+}
+
+// LivezHandler serves the liveness report.
+func (h *Health) LivezHandler() http.Handler {
+	return h.handler(h.Live)
+}
+
+// ReadyzHandler serves the readiness report.
+func (h *Health) ReadyzHandler() http.Handler {
+	return h.handler(h.Ready)
+}
+
+// HealthzHandler serves the combined liveness and readiness report.
+func (h *Health) HealthzHandler() http.Handler {
+	return h.handler(h.Healthy)
+}
+
+// RegisterHandlers adds /livez, /readyz and /healthz to mux.
+func (h *Health) RegisterHandlers(mux *http.ServeMux) {
+	mux.Handle("/livez", h.LivezHandler())
+	mux.Handle("/readyz", h.ReadyzHandler())
+	mux.Handle("/healthz", h.HealthzHandler())
+}
+
+// handler writes the report as JSON with 200 when healthy and 503 otherwise. Individual
+// check results are only included when the verbose query parameter is present.
+func (h *Health) handler(fn func(context.Context) Report) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		report := fn(r.Context())
+
+		status := http.StatusOK
+		if report.Status != StatusOK {
+			status = http.StatusServiceUnavailable
+		}
+		if !r.URL.Query().Has("verbose") {
+			report.Checks = nil
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("Cache-Control", "no-store")
+		w.WriteHeader(status)
+		if err := json.NewEncoder(w).Encode(report); err != nil {
+			h.logger.Error("failed to write health report", zap.Error(err))
+		}
+	})
+}
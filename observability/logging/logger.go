@@ -166,6 +166,21 @@ func LoggerFromContext(ctx context.Context) *zap.Logger {
 	return zap.NewNop()
 }
 
+// ContextLogger returns the *zap.Logger stored in ctx and whether there is one.
+func ContextLogger(ctx context.Context) (*zap.Logger, bool) {
+	l, ok := ctx.Value(ctxKey{}).(*zap.Logger)
+	return l, ok && l != nil
+}
+
+// ContextWithFields returns ctx with its logger extended by fields. A ctx without a logger
+// is returned as is.
+func ContextWithFields(ctx context.Context, fields ...zap.Field) context.Context {
+	if l, ok := ctx.Value(ctxKey{}).(*zap.Logger); ok && l != nil {
+		return ContextWithLogger(ctx, l.With(fields...))
+	}
+	return ctx
+}
+
 // --- Service identity helper ---
 
 // WithServiceIdentity returns a child logger with service, version, and
@@ -10,6 +10,10 @@ go get github.com/prometheus/client_golang/prometheus
 go get github.com/prometheus/client_golang/prometheus/promauto
 */
 
+// HandlerMetrics records request counts and durations driven by hand through StartRequest.
+//
+// Deprecated: use middlewares.HTTPMetrics, which instruments handlers automatically and
+// keeps label cardinality bounded.
 type HandlerMetrics struct {
 	failed    prometheus.Counter
 	requests  prometheus.Counter
@@ -0,0 +1,86 @@
+package prommetrics
+
+import (
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// ConcurrencyMetrics reports the state of adaptive concurrency limiters. It implements
+// prometheus.Collector, so register it on the registry the service exposes.
+type ConcurrencyMetrics struct {
+	limit     *prometheus.GaugeVec
+	inFlight  *prometheus.GaugeVec
+	queued    *prometheus.GaugeVec
+	shed      *prometheus.CounterVec
+	queueWait *prometheus.HistogramVec
+}
+
+func NewConcurrencyMetrics(namespace, subsystem string) *ConcurrencyMetrics {
+	return &ConcurrencyMetrics{
+		limit: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Namespace: namespace,
+			Subsystem: subsystem,
+			Name:      "concurrency_limit",
+			Help:      "Current adaptive limit of concurrently served requests",
+		}, []string{"name"}),
+		inFlight: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Namespace: namespace,
+			Subsystem: subsystem,
+			Name:      "concurrency_in_flight",
+			Help:      "Number of requests being served under the limit",
+		}, []string{"name"}),
+		queued: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Namespace: namespace,
+			Subsystem: subsystem,
+			Name:      "concurrency_queued",
+			Help:      "Number of requests waiting for the limit",
+		}, []string{"name"}),
+		shed: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: namespace,
+			Subsystem: subsystem,
+			Name:      "concurrency_shed_total",
+			Help:      "Total number of requests rejected because the limit was reached",
+		}, []string{"name", "priority"}),
+		queueWait: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Namespace: namespace,
+			Subsystem: subsystem,
+			Name:      "concurrency_queue_wait_seconds",
+			Help:      "Time admitted requests waited for the limit",
+			Buckets:   []float64{.001, .005, .01, .025, .05, .1, .25, .5, 1, 2.5},
+		}, []string{"name", "priority"}),
+	}
+}
+
+// State records the current limit, in-flight and queued requests of the named limiter.
+func (m *ConcurrencyMetrics) State(name string, limit, inFlight, queued int) {
+	m.limit.WithLabelValues(name).Set(float64(limit))
+	m.inFlight.WithLabelValues(name).Set(float64(inFlight))
+	m.queued.WithLabelValues(name).Set(float64(queued))
+}
+
+// Shed records a request of priority rejected by the named limiter.
+func (m *ConcurrencyMetrics) Shed(name, priority string) {
+	m.shed.WithLabelValues(name, priority).Inc()
+}
+
+// Admitted records how long a request of priority waited before it was admitted.
+func (m *ConcurrencyMetrics) Admitted(name, priority string, wait time.Duration) {
+	m.queueWait.WithLabelValues(name, priority).Observe(wait.Seconds())
+}
+
+func (m *ConcurrencyMetrics) Describe(ch chan<- *prometheus.Desc) {
+	m.limit.Describe(ch)
+	m.inFlight.Describe(ch)
+	m.queued.Describe(ch)
+	m.shed.Describe(ch)
+	m.queueWait.Describe(ch)
+}
+
+func (m *ConcurrencyMetrics) Collect(ch chan<- prometheus.Metric) {
+	m.limit.Collect(ch)
+	m.inFlight.Collect(ch)
+	m.queued.Collect(ch)
+	m.shed.Collect(ch)
+	m.queueWait.Collect(ch)
+}
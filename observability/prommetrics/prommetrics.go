@@ -1,9 +1,12 @@
 package prommetrics
 
 import (
+	"errors"
 	"net/http"
 	"net/http/pprof"
 	"os"
+
+	"github.com/prometheus/client_golang/prometheus"
 )
 
 var (
@@ -19,3 +22,18 @@ func RegisterProfiler(mux *http.ServeMux) {
 	mux.HandleFunc("/debug/pprof/symbol", pprof.Symbol)
 	mux.HandleFunc("/debug/pprof/trace", pprof.Trace)
 }
+
+// Register registers c on reg, returning the collector that is already registered if an
+// identical one exists, so several servers or clients in one process can share metrics.
+func Register[T prometheus.Collector](reg prometheus.Registerer, c T) (T, error) {
+	if err := reg.Register(c); err != nil {
+		var are prometheus.AlreadyRegisteredError
+		if errors.As(err, &are) {
+			if existing, ok := are.ExistingCollector.(T); ok {
+				return existing, nil
+			}
+		}
+		return c, err
+	}
+	return c, nil
+}
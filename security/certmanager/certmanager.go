@@ -0,0 +1,302 @@
+package certmanager
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+	"github.com/harphies/go.microservices.io/observability/prommetrics"
+	"go.uber.org/zap"
+)
+
+const (
+	defaultPollInterval = 30 * time.Second
+	watchSettleDelay    = 250 * time.Millisecond
+)
+
+var (
+	ErrNoCertificate   = errors.New("no certificate loaded")
+	ErrEmptyCABundle   = errors.New("ca bundle contains no certificates")
+	ErrCertExpired     = errors.New("certificate has expired")
+	ErrCertNotYetValid = errors.New("certificate is not valid yet")
+)
+
+// Config describes the certificate material a Manager watches. The certificate, key and
+// client CA bundle are separate files, as mounted by cert-manager or similar tooling.
+type Config struct {
+	// Name identifies the certificate in logs and metrics. Default: the certificate path.
+	Name     string
+	CertFile string
+	KeyFile  string
+	// CAFile is the PEM bundle used to verify client certificates. Leave empty for plain TLS.
+	CAFile string
+	// ClientAuth is the client certificate policy used when CAFile is set.
+	// Default: tls.RequireAndVerifyClientCert.
+	ClientAuth tls.ClientAuthType
+	// PollInterval is how often the files are checked for changes besides watching them.
+	// Default: 30s.
+	PollInterval time.Duration
+}
+
+// Option applies optional configuration to a Manager.
+type Option func(*Manager)
+
+// WithMetrics reports certificate expiry, last reload time and reload failures to m.
+func WithMetrics(m *prommetrics.CertificateMetrics) Option {
+	return func(mgr *Manager) {
+		mgr.metrics = m
+	}
+}
+
+// Manager serves TLS certificates that are reloaded from disk when the underlying files
+// change. New material is validated before being swapped in atomically; invalid material is
+// rejected and the last good set keeps being served.
+type Manager struct {
+	cfg     Config
+	logger  *zap.Logger
+	metrics *prommetrics.CertificateMetrics
+
+	mu      sync.Mutex // serialises reloads
+	current atomic.Pointer[material]
+}
+
+type material struct {
+	cert      *tls.Certificate
+	clientCAs *x509.CertPool
+	notAfter  time.Time
+	loadedAt  time.Time
+	checksum  [sha256.Size]byte
+}
+
+// New creates a Manager and loads the initial certificate material, returning an error if
+// it cannot be loaded.
+func New(logger *zap.Logger, cfg Config, opts ...Option) (*Manager, error) {
+	if cfg.Name == "" {
+		cfg.Name = cfg.CertFile
+	}
+	if cfg.ClientAuth == tls.NoClientCert && cfg.CAFile != "" {
+		cfg.ClientAuth = tls.RequireAndVerifyClientCert
+	}
+	if cfg.PollInterval <= 0 {
+		cfg.PollInterval = defaultPollInterval
+	}
+
+	m := &Manager{
+		cfg:    cfg,
+		logger: logger.With(zap.String("certificate", cfg.Name)),
+	}
+	for _, opt := range opts {
+		opt(m)
+	}
+
+	if err := m.Reload(); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+// Reload reads the certificate files and swaps them in if they changed and are valid.
+func (m *Manager) Reload() error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	next, err := m.load()
+	if err != nil {
+		if m.metrics != nil {
+			m.metrics.ReloadFailed(m.cfg.Name)
+		}
+		if m.current.Load() != nil {
+			m.logger.Error("rejected certificate reload, keeping the last good certificate", zap.Error(err))
+		}
+		return err
+	}
+
+	if prev := m.current.Load(); prev != nil && prev.checksum == next.checksum {
+		return nil
+	}
+
+	m.current.Store(next)
+	if m.metrics != nil {
+		m.metrics.Loaded(m.cfg.Name, next.notAfter)
+	}
+	m.logger.Info("certificate loaded", zap.Time("not_after", next.notAfter))
+	return nil
+}
+
+func (m *Manager) load() (*material, error) {
+	certPEM, err := os.ReadFile(m.cfg.CertFile)
+	if err != nil {
+		return nil, fmt.Errorf("read certificate: %w", err)
+	}
+	keyPEM, err := os.ReadFile(m.cfg.KeyFile)
+	if err != nil {
+		return nil, fmt.Errorf("read key: %w", err)
+	}
+	var caPEM []byte
+	if m.cfg.CAFile != "" {
+		caPEM, err = os.ReadFile(m.cfg.CAFile)
+		if err != nil {
+			return nil, fmt.Errorf("read ca bundle: %w", err)
+		}
+	}
+
+	checksum := sha256.Sum256(bytes.Join([][]byte{certPEM, keyPEM, caPEM}, []byte{0}))
+	if prev := m.current.Load(); prev != nil && prev.checksum == checksum {
+		return prev, nil
+	}
+
+	cert, err := tls.X509KeyPair(certPEM, keyPEM)
+	if err != nil {
+		return nil, fmt.Errorf("parse key pair: %w", err)
+	}
+
+	now := time.Now()
+	leaf := cert.Leaf
+	if now.After(leaf.NotAfter) {
+		return nil, fmt.Errorf("%w: not after %s", ErrCertExpired, leaf.NotAfter)
+	}
+	if now.Before(leaf.NotBefore) {
+		return nil, fmt.Errorf("%w: not before %s", ErrCertNotYetValid, leaf.NotBefore)
+	}
+
+	var clientCAs *x509.CertPool
+	if caPEM != nil {
+		clientCAs = x509.NewCertPool()
+		if !clientCAs.AppendCertsFromPEM(caPEM) {
+			return nil, ErrEmptyCABundle
+		}
+	}
+
+	return &material{
+		cert:      &cert,
+		clientCAs: clientCAs,
+		notAfter:  leaf.NotAfter,
+		loadedAt:  now,
+		checksum:  checksum,
+	}, nil
+}
+
+// Run reloads the certificate files when they change, until ctx is done. The directories of
+// the files are watched rather than the files, so the symlink swaps Kubernetes uses to update
+// mounted secrets are seen as well. The files are also polled every PollInterval, for file
+// systems without change notifications.
+func (m *Manager) Run(ctx context.Context) {
+	ticker := time.NewTicker(m.cfg.PollInterval)
+	defer ticker.Stop()
+
+	var events <-chan fsnotify.Event
+	var watchErrs <-chan error
+	if w, err := m.watch(); err != nil {
+		m.logger.Warn("watching certificate files failed, polling only", zap.Error(err))
+	} else {
+		defer w.Close()
+		events, watchErrs = w.Events, w.Errors
+	}
+
+	// a rotation touches several files, reload once they settled
+	var settled <-chan time.Time
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case _, ok := <-events:
+			if !ok {
+				events = nil
+				continue
+			}
+			settled = time.After(watchSettleDelay)
+		case err, ok := <-watchErrs:
+			if !ok {
+				watchErrs = nil
+				continue
+			}
+			m.logger.Warn("certificate watcher failed", zap.Error(err))
+		case <-settled:
+			settled = nil
+			// errors are logged and counted by Reload; the last good material stays in use
+			_ = m.Reload()
+		case <-ticker.C:
+			_ = m.Reload()
+		}
+	}
+}
+
+// watch watches the directories holding the certificate files.
+func (m *Manager) watch() (*fsnotify.Watcher, error) {
+	w, err := fsnotify.NewWatcher()
+	if err != nil {
+		return nil, err
+	}
+	dirs := map[string]bool{}
+	for _, file := range []string{m.cfg.CertFile, m.cfg.KeyFile, m.cfg.CAFile} {
+		if file == "" || dirs[filepath.Dir(file)] {
+			continue
+		}
+		dirs[filepath.Dir(file)] = true
+		if err := w.Add(filepath.Dir(file)); err != nil {
+			w.Close()
+			return nil, fmt.Errorf("watch %s: %w", filepath.Dir(file), err)
+		}
+	}
+	return w, nil
+}
+
+// NotAfter returns the expiry time of the certificate currently being served.
+func (m *Manager) NotAfter() time.Time {
+	return m.current.Load().notAfter
+}
+
+// LastReload returns the time the certificate currently being served was loaded.
+func (m *Manager) LastReload() time.Time {
+	return m.current.Load().loadedAt
+}
+
+// GetCertificate implements tls.Config.GetCertificate.
+func (m *Manager) GetCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	cur := m.current.Load()
+	if cur == nil {
+		return nil, ErrNoCertificate
+	}
+	return cur.cert, nil
+}
+
+// GetConfigForClient implements tls.Config.GetConfigForClient, so every handshake uses the
+// client CA bundle that is current at that moment.
+func (m *Manager) GetConfigForClient(*tls.ClientHelloInfo) (*tls.Config, error) {
+	cur := m.current.Load()
+	if cur == nil {
+		return nil, ErrNoCertificate
+	}
+	cfg := m.baseConfig()
+	cfg.GetCertificate = func(*tls.ClientHelloInfo) (*tls.Certificate, error) { return cur.cert, nil }
+	if cur.clientCAs != nil {
+		cfg.ClientCAs = cur.clientCAs
+		cfg.ClientAuth = m.cfg.ClientAuth
+	}
+	return cfg, nil
+}
+
+// TLSConfig returns a server TLS configuration backed by the Manager.
+func (m *Manager) TLSConfig() *tls.Config {
+	cfg := m.baseConfig()
+	cfg.GetCertificate = m.GetCertificate
+	cfg.GetConfigForClient = m.GetConfigForClient
+	return cfg
+}
+
+func (m *Manager) baseConfig() *tls.Config {
+	return &tls.Config{
+		MinVersion: tls.VersionTLS12,
+		NextProtos: []string{"h2", "http/1.1"},
+	}
+}
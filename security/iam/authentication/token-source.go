@@ -0,0 +1,85 @@
+package authentication
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/harphies/go.microservices.io/utils"
+	"go.uber.org/zap"
+)
+
+// tokenExpiryDelta refreshes tokens this long before they expire, so a token is never
+// sent that expires in flight.
+const tokenExpiryDelta = 30 * time.Second
+
+// ErrEmptyAccessToken is returned when the token endpoint answers without an access token.
+var ErrEmptyAccessToken = errors.New("token endpoint returned no access token")
+
+// RequestToken requests an access token with the client credentials grant flow and
+// returns the full token response. Unlike GenerateToken it reports failures.
+func (oauth *OauthServiceProvider) RequestToken(ctx context.Context, endpoint string, qs map[string]string) (*OauthAccessResponse, error) {
+	params := map[string]string{
+		"grant_type":    "client_credentials",
+		"client_id":     oauth.clientID,
+		"client_secret": oauth.clientSecret,
+	}
+	for k, v := range qs {
+		params[k] = v
+	}
+
+	response, err := utils.HTTPRequest(ctx, oauth.logger, http.MethodPost, endpoint, "", nil, params, nil)
+	if err != nil {
+		return nil, fmt.Errorf("request access token: %w", err)
+	}
+	var resp OauthAccessResponse
+	if err := json.Unmarshal(response, &resp); err != nil {
+		return nil, fmt.Errorf("decode token response: %w", err)
+	}
+	if resp.AccessToken == "" {
+		return nil, ErrEmptyAccessToken
+	}
+	return &resp, nil
+}
+
+// A TokenSource hands out client credentials access tokens, fetching a new one only when
+// the cached token is about to expire. It is safe for concurrent use.
+type TokenSource struct {
+	provider *OauthServiceProvider
+	endpoint string
+	qs       map[string]string
+
+	mu      sync.Mutex
+	token   string
+	expires time.Time
+}
+
+// TokenSource returns a TokenSource requesting tokens from endpoint with the extra query
+// params in qs, e.g. scope or audience.
+func (oauth *OauthServiceProvider) TokenSource(endpoint string, qs map[string]string) *TokenSource {
+	return &TokenSource{provider: oauth, endpoint: endpoint, qs: qs}
+}
+
+// Token returns the cached access token, or requests a new one once it is within 30s of
+// expiring. Tokens without an expires_in are requested again every time.
+func (ts *TokenSource) Token(ctx context.Context) (string, error) {
+	ts.mu.Lock()
+	defer ts.mu.Unlock()
+
+	if ts.token != "" && time.Now().Before(ts.expires) {
+		return ts.token, nil
+	}
+
+	resp, err := ts.provider.RequestToken(ctx, ts.endpoint, ts.qs)
+	if err != nil {
+		ts.provider.logger.Error("failed to refresh access token", zap.String("endpoint", ts.endpoint), zap.Error(err))
+		return "", err
+	}
+	ts.token = resp.AccessToken
+	ts.expires = time.Now().Add(time.Duration(resp.ExpiresIn)*time.Second - tokenExpiryDelta)
+	return ts.token, nil
+}
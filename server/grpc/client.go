@@ -0,0 +1,316 @@
+package grpc
+
+import (
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+
+	"github.com/harphies/go.microservices.io/observability/prommetrics"
+	"github.com/harphies/go.microservices.io/utils"
+	"github.com/prometheus/client_golang/prometheus"
+	"go.uber.org/zap"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/keepalive"
+	"google.golang.org/grpc/status"
+)
+
+/*
+Client connections to gRPC services, the client-side companion of Server.
+
+	conn, err := grpc.NewClient(logger, grpc.ClientConfig{
+		Target:      "dns:///orders.internal:50051",
+		Timeout:     5 * time.Second,
+		MTLS:        true, // certificates from the mTLS_* environment variables
+		TokenSource: oauth.TokenSource(tokenURL, map[string]string{"scope": "orders"}),
+	})
+	defer conn.Close()
+	client := pb.NewOrdersClient(conn)
+Refs
+https://github.com/grpc/grpc/blob/master/doc/service_config.md
+https://github.com/grpc/proposal/blob/master/A6-client-retries.md
+*/
+
+// RetryPolicy is the retry policy applied to every method of a client connection.
+// Retries are transparent to the caller and only happen for RetryableStatusCodes.
+type RetryPolicy struct {
+	// MaxAttempts includes the original attempt; grpc-go caps it at 5. 1 disables retries.
+	MaxAttempts       int
+	InitialBackoff    time.Duration
+	MaxBackoff        time.Duration
+	BackoffMultiplier float64
+	// RetryableStatusCodes should only list codes where the call is known not to have had
+	// an effect, or methods must be idempotent.
+	RetryableStatusCodes []codes.Code
+}
+
+// DefaultRetryPolicy retries calls rejected because the server was unavailable, e.g. while
+// a replica is restarting.
+var DefaultRetryPolicy = RetryPolicy{
+	MaxAttempts:          3,
+	InitialBackoff:       100 * time.Millisecond,
+	MaxBackoff:           time.Second,
+	BackoffMultiplier:    2,
+	RetryableStatusCodes: []codes.Code{codes.Unavailable},
+}
+
+// TokenSource supplies the bearer tokens sent with every RPC. The TokenSource returned by
+// authentication.OauthServiceProvider implements it.
+type TokenSource interface {
+	Token(ctx context.Context) (string, error)
+}
+
+// ClientConfig configures a connection created with NewClient. Only Target is required.
+type ClientConfig struct {
+	// Target is a gRPC target name such as "dns:///orders.internal:50051". DNS targets
+	// resolve to every address of the service and calls are balanced across them.
+	Target string
+	// Timeout is the deadline applied to unary calls whose context has none. Zero leaves
+	// such calls without a deadline.
+	Timeout time.Duration
+	// Retry replaces DefaultRetryPolicy when MaxAttempts is set.
+	Retry RetryPolicy
+	// LoadBalancing is the load balancing policy, "round_robin" by default.
+	LoadBalancing string
+
+	// TLS connects over TLS, verifying the server against the system roots.
+	TLS bool
+	// MTLS connects over mutual TLS with the key pair in CertFile and KeyFile and the CA
+	// bundle in CAFile. Without CertFile the files are taken from the mTLS_* environment
+	// variables, as for utils.MtlsRequest.
+	MTLS                      bool
+	CAFile, CertFile, KeyFile string
+	// ServerName overrides the name the server certificate is verified against.
+	ServerName string
+
+	// TokenSource attaches "authorization: Bearer <token>" to every RPC. Tokens are only
+	// sent over TLS unless InsecureTokens is set.
+	TokenSource    TokenSource
+	InsecureTokens bool
+
+	// Keepalive replaces the default client keepalive parameters when Time is set.
+	Keepalive keepalive.ClientParameters
+	// MaxMessageSize is the largest message in bytes the client receives and sends,
+	// 4MB by default.
+	MaxMessageSize int
+
+	// Registerer is where the client metrics are registered, prometheus.DefaultRegisterer
+	// by default, under MetricsNamespace or prommetrics.DefaultPromMetricsNamespace.
+	Registerer       prometheus.Registerer
+	MetricsNamespace string
+	DisableMetrics   bool
+
+	// UnaryInterceptors and StreamInterceptors run after the default ones.
+	UnaryInterceptors  []grpc.UnaryClientInterceptor
+	StreamInterceptors []grpc.StreamClientInterceptor
+	// DialOptions are passed to grpc.NewClient after the defaults.
+	DialOptions []grpc.DialOption
+}
+
+// NewClient creates a client connection to cfg.Target with retries, round-robin load
+// balancing and the tracing, logging, deadline and metrics interceptors. The connection
+// is established lazily on the first RPC. Close it when done.
+func NewClient(logger *zap.Logger, cfg ClientConfig) (*grpc.ClientConn, error) {
+	if cfg.Target == "" {
+		return nil, fmt.Errorf("grpc client: target is required")
+	}
+	logger = logger.With(zap.String("grpc.target", cfg.Target))
+
+	serviceConfig, err := clientServiceConfig(cfg)
+	if err != nil {
+		return nil, err
+	}
+	creds, err := clientTransportCredentials(cfg)
+	if err != nil {
+		return nil, err
+	}
+
+	unary := []grpc.UnaryClientInterceptor{UnaryClientTracingInterceptor(), UnaryClientLoggingInterceptor(logger)}
+	stream := []grpc.StreamClientInterceptor{StreamClientTracingInterceptor(), StreamClientLoggingInterceptor(logger)}
+	if cfg.Timeout > 0 {
+		unary = append(unary, UnaryClientTimeoutInterceptor(cfg.Timeout))
+	}
+	if !cfg.DisableMetrics {
+		reg := cfg.Registerer
+		if reg == nil {
+			reg = prometheus.DefaultRegisterer
+		}
+		namespace := cfg.MetricsNamespace
+		if namespace == "" {
+			namespace = prommetrics.DefaultPromMetricsNamespace
+		}
+		metrics, err := NewClientMetrics(namespace, reg)
+		if err != nil {
+			return nil, err
+		}
+		unary = append(unary, metrics.UnaryClientInterceptor())
+		stream = append(stream, metrics.StreamClientInterceptor())
+	}
+
+	ka := cfg.Keepalive
+	if ka.Time == 0 {
+		ka = keepalive.ClientParameters{
+			Time:                time.Minute, // the server rejects pings more frequent than every 30s
+			Timeout:             20 * time.Second,
+			PermitWithoutStream: true,
+		}
+	}
+	maxMsgSize := cfg.MaxMessageSize
+	if maxMsgSize == 0 {
+		maxMsgSize = defaultMaxMsgSize
+	}
+
+	dialOpts := []grpc.DialOption{
+		grpc.WithTransportCredentials(creds),
+		grpc.WithDefaultServiceConfig(serviceConfig),
+		grpc.WithChainUnaryInterceptor(append(unary, cfg.UnaryInterceptors...)...),
+		grpc.WithChainStreamInterceptor(append(stream, cfg.StreamInterceptors...)...),
+		grpc.WithKeepaliveParams(ka),
+		grpc.WithDefaultCallOptions(grpc.MaxCallRecvMsgSize(maxMsgSize), grpc.MaxCallSendMsgSize(maxMsgSize)),
+	}
+	if cfg.TokenSource != nil {
+		dialOpts = append(dialOpts, grpc.WithPerRPCCredentials(&bearerCredentials{
+			source:     cfg.TokenSource,
+			requireTLS: !cfg.InsecureTokens,
+		}))
+	}
+	dialOpts = append(dialOpts, cfg.DialOptions...)
+
+	conn, err := grpc.NewClient(cfg.Target, dialOpts...)
+	if err != nil {
+		return nil, fmt.Errorf("grpc client for %s: %w", cfg.Target, err)
+	}
+	return conn, nil
+}
+
+func clientTransportCredentials(cfg ClientConfig) (credentials.TransportCredentials, error) {
+	var tlsConfig *tls.Config
+	switch {
+	case cfg.MTLS && cfg.CertFile != "":
+		caFile := cfg.CAFile
+		if caFile == "" {
+			caFile = cfg.CertFile
+		}
+		c, err := utils.NewMTLSConfig(caFile, cfg.CertFile, cfg.KeyFile)
+		if err != nil {
+			return nil, fmt.Errorf("grpc client mtls: %w", err)
+		}
+		tlsConfig = c
+	case cfg.MTLS:
+		c, err := utils.MTLSConfigFromEnv()
+		if err != nil {
+			return nil, fmt.Errorf("grpc client mtls: %w", err)
+		}
+		tlsConfig = c
+	case cfg.TLS:
+		tlsConfig = &tls.Config{MinVersion: tls.VersionTLS12}
+	default:
+		return insecure.NewCredentials(), nil
+	}
+	tlsConfig.ServerName = cfg.ServerName
+	return credentials.NewTLS(tlsConfig), nil
+}
+
+// serviceConfig is the JSON service config understood by grpc-go; only the fields set
+// by NewClient are modelled.
+type serviceConfig struct {
+	LoadBalancingConfig []map[string]struct{} `json:"loadBalancingConfig"`
+	MethodConfig        []methodConfig        `json:"methodConfig"`
+}
+
+type methodConfig struct {
+	Name        []struct{}         `json:"name"`
+	RetryPolicy *retryPolicyConfig `json:"retryPolicy,omitempty"`
+}
+
+type retryPolicyConfig struct {
+	MaxAttempts          int      `json:"maxAttempts"`
+	InitialBackoff       string   `json:"initialBackoff"`
+	MaxBackoff           string   `json:"maxBackoff"`
+	BackoffMultiplier    float64  `json:"backoffMultiplier"`
+	RetryableStatusCodes []string `json:"retryableStatusCodes"`
+}
+
+// clientServiceConfig builds the service config applying the load balancing policy and
+// the retry policy to every method ("name": [{}] matches all services).
+func clientServiceConfig(cfg ClientConfig) (string, error) {
+	lb := cfg.LoadBalancing
+	if lb == "" {
+		lb = "round_robin"
+	}
+	policy := cfg.Retry
+	if policy.MaxAttempts == 0 {
+		policy = DefaultRetryPolicy
+	}
+
+	mc := methodConfig{Name: []struct{}{{}}}
+	if policy.MaxAttempts > 1 {
+		if len(policy.RetryableStatusCodes) == 0 {
+			return "", fmt.Errorf("grpc client: retry policy needs at least one retryable status code")
+		}
+		rp := &retryPolicyConfig{
+			MaxAttempts:       policy.MaxAttempts,
+			InitialBackoff:    durationJSON(policy.InitialBackoff),
+			MaxBackoff:        durationJSON(policy.MaxBackoff),
+			BackoffMultiplier: policy.BackoffMultiplier,
+		}
+		for _, code := range policy.RetryableStatusCodes {
+			rp.RetryableStatusCodes = append(rp.RetryableStatusCodes, codeName(code))
+		}
+		mc.RetryPolicy = rp
+	}
+
+	b, err := json.Marshal(serviceConfig{
+		LoadBalancingConfig: []map[string]struct{}{{lb: {}}},
+		MethodConfig:        []methodConfig{mc},
+	})
+	if err != nil {
+		return "", fmt.Errorf("grpc client service config: %w", err)
+	}
+	return string(b), nil
+}
+
+// durationJSON formats d as a protobuf JSON duration, e.g. "0.1s".
+func durationJSON(d time.Duration) string {
+	return strconv.FormatFloat(d.Seconds(), 'f', -1, 64) + "s"
+}
+
+// codeName returns the canonical name of code used in service configs, e.g.
+// "DEADLINE_EXCEEDED" for codes.DeadlineExceeded.
+func codeName(code codes.Code) string {
+	var b strings.Builder
+	prev := rune(0)
+	for _, r := range code.String() {
+		if unicode.IsUpper(r) && unicode.IsLower(prev) {
+			b.WriteByte('_')
+		}
+		b.WriteRune(unicode.ToUpper(r))
+		prev = r
+	}
+	return b.String()
+}
+
+// bearerCredentials implements credentials.PerRPCCredentials with tokens from a TokenSource.
+type bearerCredentials struct {
+	source     TokenSource
+	requireTLS bool
+}
+
+func (c *bearerCredentials) GetRequestMetadata(ctx context.Context, _ ...string) (map[string]string, error) {
+	token, err := c.source.Token(ctx)
+	if err != nil {
+		return nil, status.Errorf(codes.Unauthenticated, "get access token: %v", err)
+	}
+	return map[string]string{"authorization": "Bearer " + token}, nil
+}
+
+func (c *bearerCredentials) RequireTransportSecurity() bool {
+	return c.requireTLS
+}
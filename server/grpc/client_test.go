@@ -0,0 +1,361 @@
+package grpc
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"errors"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"go.uber.org/zap"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials"
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/peer"
+	"google.golang.org/grpc/status"
+	"google.golang.org/grpc/test/bufconn"
+)
+
+// checkFunc implements the health Check method of a test server.
+type checkFunc func(ctx context.Context, req *healthpb.HealthCheckRequest) (*healthpb.HealthCheckResponse, error)
+
+type testHealthServer struct {
+	healthpb.UnimplementedHealthServer
+	check checkFunc
+}
+
+func (s *testHealthServer) Check(ctx context.Context, req *healthpb.HealthCheckRequest) (*healthpb.HealthCheckResponse, error) {
+	return s.check(ctx, req)
+}
+
+var serving = &healthpb.HealthCheckResponse{Status: healthpb.HealthCheckResponse_SERVING}
+
+// newBufconnClient serves check on an in-memory listener and returns a health client
+// connected to it by NewClient with cfg. cfg.Target and the dialer are set here.
+func newBufconnClient(t *testing.T, cfg ClientConfig, check checkFunc, serverOpts ...grpc.ServerOption) healthpb.HealthClient {
+	t.Helper()
+	lis := bufconn.Listen(1024 * 1024)
+	srv := grpc.NewServer(serverOpts...)
+	healthpb.RegisterHealthServer(srv, &testHealthServer{check: check})
+	go srv.Serve(lis)
+	t.Cleanup(srv.Stop)
+
+	cfg.Target = "passthrough:///bufnet"
+	if cfg.Registerer == nil {
+		cfg.Registerer = prometheus.NewRegistry()
+	}
+	cfg.DialOptions = append(cfg.DialOptions, grpc.WithContextDialer(func(ctx context.Context, _ string) (net.Conn, error) {
+		return lis.DialContext(ctx)
+	}))
+	conn, err := NewClient(zap.NewNop(), cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	return healthpb.NewHealthClient(conn)
+}
+
+func TestNewClientRequiresTarget(t *testing.T) {
+	if _, err := NewClient(zap.NewNop(), ClientConfig{}); err == nil {
+		t.Fatal("client without a target was created")
+	}
+}
+
+func TestNewClientRetriesUnavailable(t *testing.T) {
+	var calls atomic.Int32
+	client := newBufconnClient(t, ClientConfig{
+		Retry: RetryPolicy{
+			MaxAttempts:          3,
+			InitialBackoff:       time.Millisecond,
+			MaxBackoff:           10 * time.Millisecond,
+			BackoffMultiplier:    2,
+			RetryableStatusCodes: []codes.Code{codes.Unavailable},
+		},
+	}, func(ctx context.Context, req *healthpb.HealthCheckRequest) (*healthpb.HealthCheckResponse, error) {
+		if calls.Add(1) < 3 {
+			return nil, status.Error(codes.Unavailable, "restarting")
+		}
+		return serving, nil
+	})
+
+	if _, err := client.Check(context.Background(), &healthpb.HealthCheckRequest{}); err != nil {
+		t.Fatalf("call failed after retries: %v", err)
+	}
+	if n := calls.Load(); n != 3 {
+		t.Fatalf("server saw %d attempts, want 3", n)
+	}
+}
+
+func TestNewClientDoesNotRetryOtherCodes(t *testing.T) {
+	var calls atomic.Int32
+	client := newBufconnClient(t, ClientConfig{}, func(ctx context.Context, req *healthpb.HealthCheckRequest) (*healthpb.HealthCheckResponse, error) {
+		calls.Add(1)
+		return nil, status.Error(codes.InvalidArgument, "bad request")
+	})
+
+	_, err := client.Check(context.Background(), &healthpb.HealthCheckRequest{})
+	if status.Code(err) != codes.InvalidArgument {
+		t.Fatalf("got %v, want InvalidArgument", err)
+	}
+	if n := calls.Load(); n != 1 {
+		t.Fatalf("server saw %d attempts, want 1", n)
+	}
+}
+
+func TestNewClientAppliesDefaultTimeout(t *testing.T) {
+	client := newBufconnClient(t, ClientConfig{Timeout: 50 * time.Millisecond}, func(ctx context.Context, req *healthpb.HealthCheckRequest) (*healthpb.HealthCheckResponse, error) {
+		if _, ok := ctx.Deadline(); !ok {
+			return nil, status.Error(codes.FailedPrecondition, "no deadline")
+		}
+		if req.Service == "slow" {
+			<-ctx.Done()
+			return nil, ctx.Err()
+		}
+		return serving, nil
+	})
+
+	if _, err := client.Check(context.Background(), &healthpb.HealthCheckRequest{}); err != nil {
+		t.Fatalf("call without a deadline did not get one: %v", err)
+	}
+	_, err := client.Check(context.Background(), &healthpb.HealthCheckRequest{Service: "slow"})
+	if status.Code(err) != codes.DeadlineExceeded {
+		t.Fatalf("got %v, want DeadlineExceeded", err)
+	}
+
+	// a deadline set by the caller is kept
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	start := time.Now()
+	if _, err := client.Check(ctx, &healthpb.HealthCheckRequest{Service: "slow"}); status.Code(err) != codes.DeadlineExceeded {
+		t.Fatalf("got %v, want DeadlineExceeded", err)
+	}
+	if elapsed := time.Since(start); elapsed < 500*time.Millisecond {
+		t.Fatalf("caller deadline replaced by the default timeout, call took %v", elapsed)
+	}
+}
+
+type staticTokenSource struct {
+	token string
+	err   error
+}
+
+func (s staticTokenSource) Token(context.Context) (string, error) {
+	return s.token, s.err
+}
+
+func authorization(ctx context.Context, req *healthpb.HealthCheckRequest) (*healthpb.HealthCheckResponse, error) {
+	md, _ := metadata.FromIncomingContext(ctx)
+	if got := md.Get("authorization"); len(got) != 1 || got[0] != "Bearer secret" {
+		return nil, status.Errorf(codes.Unauthenticated, "authorization %v", got)
+	}
+	return serving, nil
+}
+
+func TestNewClientSendsBearerTokens(t *testing.T) {
+	client := newBufconnClient(t, ClientConfig{
+		TokenSource:    staticTokenSource{token: "secret"},
+		InsecureTokens: true,
+	}, authorization)
+	if _, err := client.Check(context.Background(), &healthpb.HealthCheckRequest{}); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestNewClientRefusesTokensWithoutTLS(t *testing.T) {
+	_, err := NewClient(zap.NewNop(), ClientConfig{
+		Target:      "passthrough:///bufnet",
+		TokenSource: staticTokenSource{token: "secret"},
+		Registerer:  prometheus.NewRegistry(),
+	})
+	if err == nil {
+		t.Fatal("client sending tokens over an insecure connection was created")
+	}
+}
+
+func TestNewClientTokenErrorIsUnauthenticated(t *testing.T) {
+	client := newBufconnClient(t, ClientConfig{
+		TokenSource:    staticTokenSource{err: errors.New("token endpoint down")},
+		InsecureTokens: true,
+	}, authorization)
+	_, err := client.Check(context.Background(), &healthpb.HealthCheckRequest{})
+	if status.Code(err) != codes.Unauthenticated {
+		t.Fatalf("got %v, want Unauthenticated", err)
+	}
+}
+
+func TestNewClientRecordsMetrics(t *testing.T) {
+	reg := prometheus.NewRegistry()
+	client := newBufconnClient(t, ClientConfig{Registerer: reg, MetricsNamespace: "test"}, func(ctx context.Context, req *healthpb.HealthCheckRequest) (*healthpb.HealthCheckResponse, error) {
+		if req.Service == "missing" {
+			return nil, status.Error(codes.NotFound, "unknown service")
+		}
+		return serving, nil
+	})
+	client.Check(context.Background(), &healthpb.HealthCheckRequest{})
+	client.Check(context.Background(), &healthpb.HealthCheckRequest{})
+	client.Check(context.Background(), &healthpb.HealthCheckRequest{Service: "missing"})
+
+	// a second client on the same registerer shares the metrics instead of failing
+	if _, err := NewClient(zap.NewNop(), ClientConfig{Target: "passthrough:///other", Registerer: reg, MetricsNamespace: "test"}); err != nil {
+		t.Fatalf("second client: %v", err)
+	}
+
+	families, err := reg.Gather()
+	if err != nil {
+		t.Fatal(err)
+	}
+	handled := map[string]float64{}
+	for _, mf := range families {
+		if mf.GetName() != "test_grpc_client_handled_total" {
+			continue
+		}
+		for _, m := range mf.GetMetric() {
+			labels := map[string]string{}
+			for _, l := range m.GetLabel() {
+				labels[l.GetName()] = l.GetValue()
+			}
+			if labels["grpc_service"] != "grpc.health.v1.Health" || labels["grpc_method"] != "Check" {
+				t.Errorf("unexpected labels %v", labels)
+			}
+			handled[labels["grpc_code"]] = m.GetCounter().GetValue()
+		}
+	}
+	if handled["OK"] != 2 || handled["NotFound"] != 1 {
+		t.Fatalf("handled = %v, want 2 OK and 1 NotFound", handled)
+	}
+}
+
+func TestNewClientMTLS(t *testing.T) {
+	dir := t.TempDir()
+	ca, caKey := newTestCertificate(t, nil, nil, &x509.Certificate{
+		Subject:               pkix.Name{CommonName: "test ca"},
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign,
+	})
+	writePEM(t, filepath.Join(dir, "ca.pem"), "CERTIFICATE", ca.Raw)
+
+	serverCert, serverKey := newTestCertificate(t, ca, caKey, &x509.Certificate{
+		Subject:     pkix.Name{CommonName: "orders"},
+		DNSNames:    []string{"orders.internal"},
+		ExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	})
+	clientCert, clientKey := newTestCertificate(t, ca, caKey, &x509.Certificate{
+		Subject:     pkix.Name{CommonName: "payments"},
+		ExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	})
+	writePEM(t, filepath.Join(dir, "client.pem"), "CERTIFICATE", clientCert.Raw)
+	keyDER, err := x509.MarshalPKCS8PrivateKey(clientKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	writePEM(t, filepath.Join(dir, "client-key.pem"), "PRIVATE KEY", keyDER)
+
+	pool := x509.NewCertPool()
+	pool.AddCert(ca)
+	serverCreds := credentials.NewTLS(&tls.Config{
+		Certificates: []tls.Certificate{{Certificate: [][]byte{serverCert.Raw}, PrivateKey: serverKey}},
+		ClientCAs:    pool,
+		ClientAuth:   tls.RequireAndVerifyClientCert,
+	})
+
+	client := newBufconnClient(t, ClientConfig{
+		MTLS:        true,
+		CAFile:      filepath.Join(dir, "ca.pem"),
+		CertFile:    filepath.Join(dir, "client.pem"),
+		KeyFile:     filepath.Join(dir, "client-key.pem"),
+		ServerName:  "orders.internal",
+		TokenSource: staticTokenSource{token: "secret"},
+	}, func(ctx context.Context, req *healthpb.HealthCheckRequest) (*healthpb.HealthCheckResponse, error) {
+		p, _ := peer.FromContext(ctx)
+		info, ok := p.AuthInfo.(credentials.TLSInfo)
+		if !ok || len(info.State.VerifiedChains) == 0 || info.State.VerifiedChains[0][0].Subject.CommonName != "payments" {
+			return nil, status.Error(codes.PermissionDenied, "no verified client certificate")
+		}
+		// tokens are sent over TLS without InsecureTokens
+		return authorization(ctx, req)
+	}, grpc.Creds(serverCreds))
+
+	if _, err := client.Check(context.Background(), &healthpb.HealthCheckRequest{}); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestClientServiceConfig(t *testing.T) {
+	got, err := clientServiceConfig(ClientConfig{Retry: RetryPolicy{
+		MaxAttempts:          4,
+		InitialBackoff:       100 * time.Millisecond,
+		MaxBackoff:           2 * time.Second,
+		BackoffMultiplier:    1.5,
+		RetryableStatusCodes: []codes.Code{codes.Unavailable, codes.DeadlineExceeded, codes.ResourceExhausted},
+	}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := `{"loadBalancingConfig":[{"round_robin":{}}],"methodConfig":[{"name":[{}],"retryPolicy":{"maxAttempts":4,"initialBackoff":"0.1s","maxBackoff":"2s","backoffMultiplier":1.5,"retryableStatusCodes":["UNAVAILABLE","DEADLINE_EXCEEDED","RESOURCE_EXHAUSTED"]}}]}`
+	if got != want {
+		t.Fatalf("service config\n got %s\nwant %s", got, want)
+	}
+
+	got, err = clientServiceConfig(ClientConfig{LoadBalancing: "pick_first", Retry: RetryPolicy{MaxAttempts: 1}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := `{"loadBalancingConfig":[{"pick_first":{}}],"methodConfig":[{"name":[{}]}]}`; got != want {
+		t.Fatalf("service config without retries\n got %s\nwant %s", got, want)
+	}
+
+	if _, err := clientServiceConfig(ClientConfig{Retry: RetryPolicy{MaxAttempts: 2}}); err == nil {
+		t.Fatal("retry policy without retryable codes was accepted")
+	}
+}
+
+// newTestCertificate creates a certificate for tmpl signed by parent, or self-signed
+// when parent is nil.
+func newTestCertificate(t *testing.T, parent *x509.Certificate, parentKey *ecdsa.PrivateKey, tmpl *x509.Certificate) (*x509.Certificate, *ecdsa.PrivateKey) {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	serial, err := rand.Int(rand.Reader, big.NewInt(1<<62))
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl.SerialNumber = serial
+	tmpl.NotBefore = time.Now().Add(-time.Hour)
+	tmpl.NotAfter = time.Now().Add(time.Hour)
+	if parent == nil {
+		parent, parentKey = tmpl, key
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, parent, &key.PublicKey, parentKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return cert, key
+}
+
+func writePEM(t *testing.T, path, blockType string, der []byte) {
+	t.Helper()
+	if err := os.WriteFile(path, pem.EncodeToMemory(&pem.Block{Type: blockType, Bytes: der}), 0o600); err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,162 @@
+package grpc
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/textproto"
+	"strings"
+
+	"github.com/grpc-ecosystem/grpc-gateway/v2/runtime"
+	"github.com/harphies/go.microservices.io/utils"
+	"go.uber.org/zap"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/status"
+)
+
+/*
+REST/JSON transcoding for the services registered on a Server, using grpc-gateway v2.
+The gateway talks to the gRPC server over an in-memory connection, so every call goes
+through the same interceptors (auth, logging, metrics, tracing) as native gRPC calls and
+the whole service runs in a single process.
+
+	srv, _ := grpc.NewServer(logger)
+	pb.RegisterOrdersServer(srv, ordersService)
+	gw, _ := srv.NewGateway(ctx, grpc.GatewayConfig{}, pb.RegisterOrdersHandler)
+	mux.Handle("/v1/", gw) // mount on the server/http server
+Refs
+https://github.com/grpc-ecosystem/grpc-gateway
+*/
+
+// GatewayRegisterFunc matches the RegisterXxxHandler functions generated by
+// protoc-gen-grpc-gateway.
+type GatewayRegisterFunc func(ctx context.Context, mux *runtime.ServeMux, conn *grpc.ClientConn) error
+
+// GatewayConfig configures the REST gateway.
+type GatewayConfig struct {
+	// ForwardHeaders are passed to the gRPC services as metadata under their lower-cased
+	// name, in addition to Authorization, X-Request-ID and the trace context headers.
+	ForwardHeaders []string
+	// DialOptions replace the options used for the in-memory connection to the server.
+	// Servers using TLS need matching transport credentials here.
+	DialOptions []grpc.DialOption
+	// MuxOptions are passed to runtime.NewServeMux after the defaults.
+	MuxOptions []runtime.ServeMuxOption
+}
+
+// NewGateway returns an http.Handler that transcodes REST/JSON requests to the services
+// added by register. Requests without an X-Request-ID get one, and errors are returned as
+// application/problem+json.
+func (s *Server) NewGateway(ctx context.Context, cfg GatewayConfig, register ...GatewayRegisterFunc) (http.Handler, error) {
+	conn, err := s.inProcessConn(cfg.DialOptions)
+	if err != nil {
+		return nil, err
+	}
+	s.RegisterOnShutdown(func(context.Context) error { return conn.Close() })
+
+	forward := map[string]bool{
+		utils.RequestIDHeader: true,
+		"Traceparent":         true,
+		"Tracestate":          true,
+		"Baggage":             true,
+	}
+	for _, h := range cfg.ForwardHeaders {
+		forward[textproto.CanonicalMIMEHeaderKey(h)] = true
+	}
+
+	muxOpts := append([]runtime.ServeMuxOption{
+		runtime.WithIncomingHeaderMatcher(func(key string) (string, bool) {
+			if forward[textproto.CanonicalMIMEHeaderKey(key)] {
+				return strings.ToLower(key), true
+			}
+			return runtime.DefaultHeaderMatcher(key)
+		}),
+		runtime.WithErrorHandler(s.gatewayErrorHandler),
+		runtime.WithRoutingErrorHandler(func(ctx context.Context, mux *runtime.ServeMux, m runtime.Marshaler, w http.ResponseWriter, r *http.Request, httpStatus int) {
+			utils.WriteProblemResponse(w, r, utils.Problem{Status: httpStatus})
+		}),
+	}, cfg.MuxOptions...)
+
+	mux := runtime.NewServeMux(muxOpts...)
+	for _, fn := range register {
+		if err := fn(ctx, mux, conn); err != nil {
+			return nil, fmt.Errorf("register gateway handler: %w", err)
+		}
+	}
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		id := r.Header.Get(utils.RequestIDHeader)
+		if id == "" {
+			id, _ = utils.GenerateID()
+			r.Header.Set(utils.RequestIDHeader, id)
+		}
+		w.Header().Set(utils.RequestIDHeader, id)
+		mux.ServeHTTP(w, r.WithContext(utils.ContextWithRequestID(r.Context(), id)))
+	}), nil
+}
+
+// gatewayErrorHandler maps a gRPC status to the equivalent HTTP status and writes it as
+// application/problem+json.
+func (s *Server) gatewayErrorHandler(ctx context.Context, mux *runtime.ServeMux, m runtime.Marshaler, w http.ResponseWriter, r *http.Request, err error) {
+	httpStatus := http.StatusInternalServerError
+	var httpErr *runtime.HTTPStatusError
+	if errors.As(err, &httpErr) {
+		httpStatus = httpErr.HTTPStatus
+		err = httpErr.Err
+	}
+
+	st := status.Convert(err)
+	if httpErr == nil {
+		httpStatus = runtime.HTTPStatusFromCode(st.Code())
+	}
+	if httpStatus >= http.StatusInternalServerError {
+		s.logger.Error("gateway request failed", zap.String("path", r.URL.Path), zap.Error(err))
+	}
+
+	utils.WriteProblemResponse(w, r, utils.Problem{
+		Status: httpStatus,
+		Detail: st.Message(),
+		Code:   st.Code().String(),
+	})
+}
+
+// inProcessConn serves the gRPC server on an in-memory listener and connects to it.
+func (s *Server) inProcessConn(dialOpts []grpc.DialOption) (*grpc.ClientConn, error) {
+	lis := newPipeListener()
+	go func() {
+		// returns once the server is stopped
+		if err := s.grpcServer.Serve(lis); err != nil && !errors.Is(err, grpc.ErrServerStopped) {
+			s.logger.Error("in-process listener stopped", zap.Error(err))
+		}
+	}()
+
+	if len(dialOpts) == 0 {
+		dialOpts = []grpc.DialOption{grpc.WithTransportCredentials(insecure.NewCredentials())}
+	}
+	dialOpts = append(dialOpts, grpc.WithContextDialer(func(ctx context.Context, _ string) (net.Conn, error) {
+		return lis.dial(ctx)
+	}))
+
+	conn, err := grpc.NewClient("passthrough:///in-process", dialOpts...)
+	if err != nil {
+		return nil, fmt.Errorf("connect gateway to in-process server: %w", err)
+	}
+	return conn, nil
+}
+
+// HTTPHandler serves gRPC requests with the server and everything else with next, so
+// gRPC and REST/HTTP/1.1 clients can share one port. Run it on a server/http Server with
+// WithUnencryptedHTTP2 (or TLS) so gRPC clients can connect over HTTP/2, and register
+// Shutdown as a shutdown hook of that server instead of calling Run.
+func (s *Server) HTTPHandler(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.ProtoMajor == 2 && strings.HasPrefix(r.Header.Get("Content-Type"), "application/grpc") {
+			s.grpcServer.ServeHTTP(w, r)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
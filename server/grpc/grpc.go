@@ -1 +1,233 @@
 package grpc
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"sync"
+	"time"
+
+	httpserver "github.com/harphies/go.microservices.io/server/http"
+	"go.uber.org/zap"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/health"
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
+	"google.golang.org/grpc/reflection"
+)
+
+// A Server is the gRPC counterpart of server/http's Server: a wrapper around grpc.Server
+// with the standard health service, default interceptors and a managed lifecycle.
+// Register services on it before calling Run.
+type Server struct {
+	logger          *zap.Logger
+	cfg             *config
+	grpcServer      *grpc.Server
+	health          *health.Server
+	shutdownTimeout time.Duration
+
+	mu           sync.Mutex
+	boundAddr    net.Addr
+	hooks        []func(ctx context.Context) error
+	shutdownOnce sync.Once
+	shutdownErr  error
+	done         chan struct{}
+}
+
+// NewServer creates a Server. Without options it listens on ":50051", serves the
+// grpc.health.v1 service and installs the tracing, logging, metrics and recovery interceptors.
+func NewServer(logger *zap.Logger, opts ...Option) (*Server, error) {
+	cfg := defaultConfig()
+	for _, opt := range opts {
+		opt(cfg)
+	}
+
+	s := &Server{
+		logger:          logger.With(zap.String("server", cfg.name)),
+		cfg:             cfg,
+		health:          health.NewServer(),
+		shutdownTimeout: cfg.shutdownTimeout,
+		done:            make(chan struct{}),
+	}
+
+	unary := []grpc.UnaryServerInterceptor{UnaryTracingInterceptor(), UnaryLoggingInterceptor(s.logger)}
+	stream := []grpc.StreamServerInterceptor{StreamTracingInterceptor(), StreamLoggingInterceptor(s.logger)}
+	if cfg.registerer != nil {
+		metrics, err := NewServerMetrics(cfg.metricsNamespace, cfg.registerer)
+		if err != nil {
+			return nil, err
+		}
+		unary = append(unary, metrics.UnaryServerInterceptor())
+		stream = append(stream, metrics.StreamServerInterceptor())
+	}
+	unary = append(unary, UnaryRecoveryInterceptor(s.logger))
+	stream = append(stream, StreamRecoveryInterceptor(s.logger))
+
+	serverOpts := []grpc.ServerOption{
+		grpc.ChainUnaryInterceptor(append(unary, cfg.unaryInterceptors...)...),
+		grpc.ChainStreamInterceptor(append(stream, cfg.streamInterceptors...)...),
+		grpc.KeepaliveParams(cfg.keepalive),
+		grpc.KeepaliveEnforcementPolicy(cfg.keepalivePolicy),
+		grpc.MaxRecvMsgSize(cfg.maxRecvMsgSize),
+		grpc.MaxSendMsgSize(cfg.maxSendMsgSize),
+	}
+	if cfg.certManager != nil {
+		serverOpts = append(serverOpts, grpc.Creds(credentials.NewTLS(cfg.certManager.TLSConfig())))
+	}
+	serverOpts = append(serverOpts, cfg.serverOptions...)
+
+	s.grpcServer = grpc.NewServer(serverOpts...)
+	healthpb.RegisterHealthServer(s.grpcServer, s.health)
+	if cfg.reflection {
+		reflection.Register(s.grpcServer)
+	}
+	return s, nil
+}
+
+// RegisterService implements grpc.ServiceRegistrar, so generated RegisterXxxServer
+// functions accept the Server directly.
+func (s *Server) RegisterService(desc *grpc.ServiceDesc, impl any) {
+	s.grpcServer.RegisterService(desc, impl)
+}
+
+// GRPCServer returns the underlying grpc.Server.
+func (s *Server) GRPCServer() *grpc.Server {
+	return s.grpcServer
+}
+
+// SetServingStatus reports service as serving or not on the health service. The empty
+// service name is the overall server status.
+func (s *Server) SetServingStatus(service string, serving bool) {
+	status := healthpb.HealthCheckResponse_NOT_SERVING
+	if serving {
+		status = healthpb.HealthCheckResponse_SERVING
+	}
+	s.health.SetServingStatus(service, status)
+}
+
+// Addr returns the address the server is listening on, or nil if it is not listening yet.
+func (s *Server) Addr() net.Addr {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.boundAddr
+}
+
+// RegisterOnShutdown registers a hook that runs after the server stopped. Hooks run in
+// reverse registration order and receive the shutdown context.
+func (s *Server) RegisterOnShutdown(fn func(ctx context.Context) error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.hooks = append(s.hooks, fn)
+}
+
+// Run listens and serves RPCs until ctx is cancelled or Shutdown is called, then waits for
+// the shutdown to complete. It returns nil on a clean shutdown.
+func (s *Server) Run(ctx context.Context) error {
+	ln := s.cfg.listener
+	if ln == nil {
+		var err error
+		ln, err = net.Listen("tcp", s.cfg.addr)
+		if err != nil {
+			return fmt.Errorf("listen on %s: %w", s.cfg.addr, err)
+		}
+	}
+
+	s.mu.Lock()
+	s.boundAddr = ln.Addr()
+	s.mu.Unlock()
+
+	if s.cfg.certManager != nil {
+		reloadCtx, stopReload := context.WithCancel(ctx)
+		defer stopReload()
+		go s.cfg.certManager.Run(reloadCtx)
+	}
+
+	s.health.Resume()
+	serveErr := make(chan error, 1)
+	go func() {
+		s.logger.Info("Server started", zap.String("addr", ln.Addr().String()))
+		serveErr <- s.grpcServer.Serve(ln)
+	}()
+
+	select {
+	case err := <-serveErr:
+		if err != nil && !errors.Is(err, grpc.ErrServerStopped) {
+			return err
+		}
+	case <-ctx.Done():
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), s.shutdownTimeout)
+		defer cancel()
+		// Shutdown records its own result; it is returned below once the server is done.
+		_ = s.Shutdown(shutdownCtx)
+		if err := <-serveErr; err != nil && !errors.Is(err, grpc.ErrServerStopped) {
+			return err
+		}
+	}
+
+	// wait for whoever initiated the shutdown to finish draining and running hooks
+	<-s.done
+	if s.shutdownErr != nil {
+		return s.shutdownErr
+	}
+
+	// server successfully shut down
+	s.logger.Info("Server successfully shutdown!")
+	return nil
+}
+
+// Shutdown marks the server as not serving on the health service, stops accepting new
+// RPCs and waits for in-flight RPCs until ctx is done, after which they are cancelled.
+// It then runs the shutdown hooks. Later calls return the result of the first.
+func (s *Server) Shutdown(ctx context.Context) error {
+	s.shutdownOnce.Do(func() {
+		defer close(s.done)
+
+		s.logger.Info("Shutting down server", zap.Duration("grace_period", s.shutdownTimeout))
+		s.health.Shutdown()
+
+		var errs []error
+		stopped := make(chan struct{})
+		go func() {
+			s.grpcServer.GracefulStop()
+			close(stopped)
+		}()
+		select {
+		case <-stopped:
+		case <-ctx.Done():
+			s.grpcServer.Stop()
+			<-stopped
+			errs = append(errs, fmt.Errorf("graceful stop: %w", ctx.Err()))
+		}
+
+		s.mu.Lock()
+		hooks := append([]func(context.Context) error(nil), s.hooks...)
+		s.mu.Unlock()
+
+		for i := len(hooks) - 1; i >= 0; i-- {
+			if err := hooks[i](ctx); err != nil {
+				errs = append(errs, err)
+			}
+		}
+		s.shutdownErr = errors.Join(errs...)
+	})
+	return s.shutdownErr
+}
+
+// New starts a gRPC server on port with the services added by register and blocks until
+// SIGINT or SIGTERM is received, then drains in-flight RPCs and waits for the goroutines
+// tracked by wg.
+func New(logger *zap.Logger, port int, wg *sync.WaitGroup, register func(grpc.ServiceRegistrar), opts ...Option) error {
+	ctx, cancel := httpserver.SignalContext(context.Background(), logger)
+	defer cancel()
+
+	srv, err := NewServer(logger, append([]Option{WithPort(port)}, opts...)...)
+	if err != nil {
+		return err
+	}
+	register(srv)
+	if wg != nil {
+		srv.RegisterOnShutdown(httpserver.WaitGroupHook(logger, wg))
+	}
+	return srv.Run(ctx)
+}
@@ -0,0 +1,403 @@
+package grpc
+
+import (
+	"context"
+	"errors"
+	"io"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/harphies/go.microservices.io/observability/logging"
+	"github.com/harphies/go.microservices.io/utils"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	otelcodes "go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+)
+
+const otelName = "server/grpc"
+
+// requestIDMetadataKey is utils.RequestIDHeader as a gRPC metadata key, which are lowercase.
+var requestIDMetadataKey = strings.ToLower(utils.RequestIDHeader)
+
+// wrappedStream overrides the context of a server stream so interceptors can pass values
+// such as the request logger and span down to the handler.
+type wrappedStream struct {
+	grpc.ServerStream
+	ctx context.Context
+}
+
+func (w *wrappedStream) Context() context.Context {
+	return w.ctx
+}
+
+// metadataCarrier adapts gRPC metadata to an OpenTelemetry TextMapCarrier.
+type metadataCarrier metadata.MD
+
+func (c metadataCarrier) Get(key string) string {
+	if v := metadata.MD(c).Get(key); len(v) > 0 {
+		return v[0]
+	}
+	return ""
+}
+
+func (c metadataCarrier) Set(key, value string) {
+	metadata.MD(c).Set(key, value)
+}
+
+func (c metadataCarrier) Keys() []string {
+	keys := make([]string, 0, len(c))
+	for k := range c {
+		keys = append(keys, k)
+	}
+	return keys
+}
+
+// splitMethod splits "/package.Service/Method" into service and method.
+func splitMethod(fullMethod string) (service, method string) {
+	fullMethod = strings.TrimPrefix(fullMethod, "/")
+	if i := strings.LastIndex(fullMethod, "/"); i >= 0 {
+		return fullMethod[:i], fullMethod[i+1:]
+	}
+	return "unknown", fullMethod
+}
+
+// --- Tracing ---
+
+// startServerSpan continues the trace propagated in the incoming metadata.
+func startServerSpan(ctx context.Context, fullMethod string) (context.Context, trace.Span) {
+	md, _ := metadata.FromIncomingContext(ctx)
+	ctx = otel.GetTextMapPropagator().Extract(ctx, metadataCarrier(md))
+
+	service, method := splitMethod(fullMethod)
+	return otel.Tracer(otelName).Start(ctx, strings.TrimPrefix(fullMethod, "/"),
+		trace.WithSpanKind(trace.SpanKindServer),
+		trace.WithAttributes(
+			attribute.String("rpc.system", "grpc"),
+			attribute.String("rpc.service", service),
+			attribute.String("rpc.method", method),
+		),
+	)
+}
+
+func endSpan(span trace.Span, err error) {
+	code := status.Code(err)
+	span.SetAttributes(attribute.Int64("rpc.grpc.status_code", int64(code)))
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(otelcodes.Error, status.Convert(err).Message())
+	}
+	span.End()
+}
+
+// UnaryTracingInterceptor starts a server span for every RPC, continuing the trace
+// propagated by the client.
+func UnaryTracingInterceptor() grpc.UnaryServerInterceptor {
+	return func(ctx context.Context, req any, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (any, error) {
+		ctx, span := startServerSpan(ctx, info.FullMethod)
+		resp, err := handler(ctx, req)
+		endSpan(span, err)
+		return resp, err
+	}
+}
+
+// StreamTracingInterceptor is the streaming counterpart of UnaryTracingInterceptor.
+func StreamTracingInterceptor() grpc.StreamServerInterceptor {
+	return func(srv any, ss grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+		ctx, span := startServerSpan(ss.Context(), info.FullMethod)
+		err := handler(srv, &wrappedStream{ServerStream: ss, ctx: ctx})
+		endSpan(span, err)
+		return err
+	}
+}
+
+// --- Logging ---
+
+// contextWithRequestID stores the x-request-id sent by the client on ctx, or a new ID when
+// it sent none or an invalid one, like the HTTP request ID middleware.
+func contextWithRequestID(ctx context.Context) context.Context {
+	if utils.RequestIDFromContext(ctx) != "" {
+		return ctx
+	}
+	md, _ := metadata.FromIncomingContext(ctx)
+	id := metadataCarrier(md).Get(requestIDMetadataKey)
+	if !utils.ValidRequestID(id) {
+		var err error
+		if id, err = utils.GenerateID(); err != nil {
+			return ctx
+		}
+	}
+	return utils.ContextWithRequestID(ctx, id)
+}
+
+// requestLogger returns a logger carrying the RPC method, request ID and trace identifiers.
+func requestLogger(ctx context.Context, logger *zap.Logger, fullMethod string) *zap.Logger {
+	fields := []zap.Field{zap.String("grpc.method", fullMethod)}
+	if id := utils.RequestIDFromContext(ctx); id != "" {
+		fields = append(fields, zap.String("request_id", id))
+	}
+	if sc := trace.SpanContextFromContext(ctx); sc.IsValid() {
+		fields = append(fields, zap.String("trace_id", sc.TraceID().String()), zap.String("span_id", sc.SpanID().String()))
+	}
+	return logger.With(fields...)
+}
+
+// logLevel maps a status code to a log level: codes caused by the server are errors,
+// codes caused by the client are warnings.
+func logLevel(code codes.Code) zapcore.Level {
+	switch code {
+	case codes.OK:
+		return zapcore.InfoLevel
+	case codes.Unknown, codes.DeadlineExceeded, codes.Unimplemented, codes.Internal, codes.Unavailable, codes.DataLoss:
+		return zapcore.ErrorLevel
+	default:
+		return zapcore.WarnLevel
+	}
+}
+
+func logRPC(logger *zap.Logger, fullMethod string, start time.Time, err error) {
+	code := status.Code(err)
+	if code == codes.OK && strings.HasPrefix(fullMethod, "/grpc.health.v1.Health/") {
+		return // probes run every few seconds and would drown out real traffic
+	}
+	fields := []zap.Field{zap.String("grpc.code", code.String()), zap.Duration("duration", time.Since(start))}
+	if err != nil {
+		fields = append(fields, zap.Error(err))
+	}
+	logger.Log(logLevel(code), "grpc request", fields...)
+}
+
+// UnaryLoggingInterceptor places a request-scoped logger on the context, retrievable with
+// logging.LoggerFromContext, and logs every RPC once it completes. The request ID from the
+// x-request-id metadata, or a generated one, is stored on the context
+// (utils.RequestIDFromContext) and logged as "request_id".
+func UnaryLoggingInterceptor(logger *zap.Logger) grpc.UnaryServerInterceptor {
+	return func(ctx context.Context, req any, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (any, error) {
+		start := time.Now()
+		ctx = contextWithRequestID(ctx)
+		l := requestLogger(ctx, logger, info.FullMethod)
+		resp, err := handler(logging.ContextWithLogger(ctx, l), req)
+		logRPC(l, info.FullMethod, start, err)
+		return resp, err
+	}
+}
+
+// StreamLoggingInterceptor is the streaming counterpart of UnaryLoggingInterceptor.
+func StreamLoggingInterceptor(logger *zap.Logger) grpc.StreamServerInterceptor {
+	return func(srv any, ss grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+		start := time.Now()
+		ctx := contextWithRequestID(ss.Context())
+		l := requestLogger(ctx, logger, info.FullMethod)
+		ctx = logging.ContextWithLogger(ctx, l)
+		err := handler(srv, &wrappedStream{ServerStream: ss, ctx: ctx})
+		logRPC(l, info.FullMethod, start, err)
+		return err
+	}
+}
+
+// --- Recovery ---
+
+func recoverPanic(logger *zap.Logger, fullMethod string, err *error) {
+	if p := recover(); p != nil {
+		logger.Error("recovered from panic in grpc handler",
+			zap.String("grpc.method", fullMethod),
+			zap.Any("panic", p),
+			zap.StackSkip("stack", 2),
+		)
+		*err = status.Error(codes.Internal, "internal error")
+	}
+}
+
+// UnaryRecoveryInterceptor turns a panic in a handler into an Internal error instead of
+// crashing the process.
+func UnaryRecoveryInterceptor(logger *zap.Logger) grpc.UnaryServerInterceptor {
+	return func(ctx context.Context, req any, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (resp any, err error) {
+		defer recoverPanic(logger, info.FullMethod, &err)
+		return handler(ctx, req)
+	}
+}
+
+// StreamRecoveryInterceptor is the streaming counterpart of UnaryRecoveryInterceptor.
+func StreamRecoveryInterceptor(logger *zap.Logger) grpc.StreamServerInterceptor {
+	return func(srv any, ss grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) (err error) {
+		defer recoverPanic(logger, info.FullMethod, &err)
+		return handler(srv, ss)
+	}
+}
+
+// --- Client ---
+
+// monitoredClientStream calls finish once the stream ends: when RecvMsg fails, after the
+// single response of a client-streaming RPC, or when the caller's context is done, which
+// covers callers that stop reading early. io.EOF is reported as success.
+type monitoredClientStream struct {
+	grpc.ClientStream
+	desc     *grpc.StreamDesc
+	once     sync.Once
+	finish   func(err error)
+	finished chan struct{}
+}
+
+// newMonitoredClientStream wraps cs, opened with ctx, and calls finish with the context
+// error if ctx is done before the stream ends.
+func newMonitoredClientStream(ctx context.Context, cs grpc.ClientStream, desc *grpc.StreamDesc, finish func(err error)) *monitoredClientStream {
+	s := &monitoredClientStream{ClientStream: cs, desc: desc, finish: finish, finished: make(chan struct{})}
+	go func() {
+		select {
+		case <-ctx.Done():
+			s.done(status.FromContextError(ctx.Err()).Err())
+		case <-s.finished:
+		}
+	}()
+	return s
+}
+
+func (s *monitoredClientStream) done(err error) {
+	s.once.Do(func() {
+		s.finish(err)
+		close(s.finished)
+	})
+}
+
+func (s *monitoredClientStream) RecvMsg(m any) error {
+	err := s.ClientStream.RecvMsg(m)
+	switch {
+	case errors.Is(err, io.EOF):
+		s.done(nil)
+	case err != nil:
+		s.done(err)
+	case !s.desc.ServerStreams:
+		s.done(nil)
+	}
+	return err
+}
+
+// startClientSpan starts a client span and propagates its context in the outgoing metadata.
+func startClientSpan(ctx context.Context, fullMethod string) (context.Context, trace.Span) {
+	service, method := splitMethod(fullMethod)
+	ctx, span := otel.Tracer(otelName).Start(ctx, strings.TrimPrefix(fullMethod, "/"),
+		trace.WithSpanKind(trace.SpanKindClient),
+		trace.WithAttributes(
+			attribute.String("rpc.system", "grpc"),
+			attribute.String("rpc.service", service),
+			attribute.String("rpc.method", method),
+		),
+	)
+
+	md, ok := metadata.FromOutgoingContext(ctx)
+	if ok {
+		md = md.Copy()
+	} else {
+		md = metadata.MD{}
+	}
+	otel.GetTextMapPropagator().Inject(ctx, metadataCarrier(md))
+	return metadata.NewOutgoingContext(ctx, md), span
+}
+
+// UnaryClientTracingInterceptor starts a client span for every call and propagates the
+// trace to the server in the request metadata.
+func UnaryClientTracingInterceptor() grpc.UnaryClientInterceptor {
+	return func(ctx context.Context, method string, req, reply any, cc *grpc.ClientConn, invoker grpc.UnaryInvoker, opts ...grpc.CallOption) error {
+		ctx, span := startClientSpan(ctx, method)
+		err := invoker(ctx, method, req, reply, cc, opts...)
+		endSpan(span, err)
+		return err
+	}
+}
+
+// StreamClientTracingInterceptor is the streaming counterpart of UnaryClientTracingInterceptor.
+// The span ends when the stream does.
+func StreamClientTracingInterceptor() grpc.StreamClientInterceptor {
+	return func(ctx context.Context, desc *grpc.StreamDesc, cc *grpc.ClientConn, method string, streamer grpc.Streamer, opts ...grpc.CallOption) (grpc.ClientStream, error) {
+		ctx, span := startClientSpan(ctx, method)
+		cs, err := streamer(ctx, desc, cc, method, opts...)
+		if err != nil {
+			endSpan(span, err)
+			return nil, err
+		}
+		return newMonitoredClientStream(ctx, cs, desc, func(err error) { endSpan(span, err) }), nil
+	}
+}
+
+// contextWithOutgoingRequestID sends the request ID on ctx as x-request-id metadata,
+// unless the caller set it already, so the server logs under the same ID.
+func contextWithOutgoingRequestID(ctx context.Context) context.Context {
+	id := utils.RequestIDFromContext(ctx)
+	if id == "" {
+		return ctx
+	}
+	if md, ok := metadata.FromOutgoingContext(ctx); ok && len(md.Get(requestIDMetadataKey)) > 0 {
+		return ctx
+	}
+	return metadata.AppendToOutgoingContext(ctx, requestIDMetadataKey, id)
+}
+
+// clientLogger adds the request ID on ctx to logger.
+func clientLogger(ctx context.Context, logger *zap.Logger) *zap.Logger {
+	if id := utils.RequestIDFromContext(ctx); id != "" {
+		return logger.With(zap.String("request_id", id))
+	}
+	return logger
+}
+
+// logClientRPC logs failed calls like the server does; successful calls are only logged at
+// debug level since the server already logs them.
+func logClientRPC(logger *zap.Logger, fullMethod string, start time.Time, err error) {
+	code := status.Code(err)
+	level := logLevel(code)
+	if code == codes.OK {
+		level = zapcore.DebugLevel
+	}
+	fields := []zap.Field{zap.String("grpc.method", fullMethod), zap.String("grpc.code", code.String()), zap.Duration("duration", time.Since(start))}
+	if err != nil {
+		fields = append(fields, zap.Error(err))
+	}
+	logger.Log(level, "grpc call", fields...)
+}
+
+// UnaryClientLoggingInterceptor logs every call once it completes. The request ID on the
+// context (utils.RequestIDFromContext) is logged and sent to the server as x-request-id.
+func UnaryClientLoggingInterceptor(logger *zap.Logger) grpc.UnaryClientInterceptor {
+	return func(ctx context.Context, method string, req, reply any, cc *grpc.ClientConn, invoker grpc.UnaryInvoker, opts ...grpc.CallOption) error {
+		start := time.Now()
+		ctx = contextWithOutgoingRequestID(ctx)
+		err := invoker(ctx, method, req, reply, cc, opts...)
+		logClientRPC(clientLogger(ctx, logger), method, start, err)
+		return err
+	}
+}
+
+// StreamClientLoggingInterceptor is the streaming counterpart of UnaryClientLoggingInterceptor.
+func StreamClientLoggingInterceptor(logger *zap.Logger) grpc.StreamClientInterceptor {
+	return func(ctx context.Context, desc *grpc.StreamDesc, cc *grpc.ClientConn, method string, streamer grpc.Streamer, opts ...grpc.CallOption) (grpc.ClientStream, error) {
+		start := time.Now()
+		ctx = contextWithOutgoingRequestID(ctx)
+		logger := clientLogger(ctx, logger)
+		cs, err := streamer(ctx, desc, cc, method, opts...)
+		if err != nil {
+			logClientRPC(logger, method, start, err)
+			return nil, err
+		}
+		return newMonitoredClientStream(ctx, cs, desc, func(err error) { logClientRPC(logger, method, start, err) }), nil
+	}
+}
+
+// UnaryClientTimeoutInterceptor applies timeout to calls whose context has no deadline,
+// so a hanging server cannot block the caller forever.
+func UnaryClientTimeoutInterceptor(timeout time.Duration) grpc.UnaryClientInterceptor {
+	return func(ctx context.Context, method string, req, reply any, cc *grpc.ClientConn, invoker grpc.UnaryInvoker, opts ...grpc.CallOption) error {
+		if _, ok := ctx.Deadline(); !ok {
+			var cancel context.CancelFunc
+			ctx, cancel = context.WithTimeout(ctx, timeout)
+			defer cancel()
+		}
+		return invoker(ctx, method, req, reply, cc, opts...)
+	}
+}
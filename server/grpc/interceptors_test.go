@@ -0,0 +1,93 @@
+package grpc
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/harphies/go.microservices.io/observability/logging"
+	"github.com/harphies/go.microservices.io/utils"
+	"go.uber.org/zap"
+	"go.uber.org/zap/zaptest/observer"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+)
+
+func TestLoggingInterceptorStoresTheRequestID(t *testing.T) {
+	core, logs := observer.New(zap.InfoLevel)
+	client := newBufconnClient(t, ClientConfig{}, func(ctx context.Context, req *healthpb.HealthCheckRequest) (*healthpb.HealthCheckResponse, error) {
+		id := utils.RequestIDFromContext(ctx)
+		if id == "" {
+			return nil, status.Error(codes.FailedPrecondition, "no request id")
+		}
+		logging.LoggerFromContext(ctx).Info("checked", zap.String("seen", id))
+		return serving, nil
+	}, grpc.ChainUnaryInterceptor(UnaryLoggingInterceptor(zap.New(core))))
+
+	ctx := metadata.AppendToOutgoingContext(context.Background(), "x-request-id", "req-1")
+	if _, err := client.Check(ctx, &healthpb.HealthCheckRequest{}); err != nil {
+		t.Fatal(err)
+	}
+	// an invalid ID is replaced by a generated one
+	ctx = metadata.AppendToOutgoingContext(context.Background(), "x-request-id", "two words")
+	if _, err := client.Check(ctx, &healthpb.HealthCheckRequest{}); err != nil {
+		t.Fatal(err)
+	}
+
+	entries := logs.FilterMessage("checked").AllUntimed()
+	if len(entries) != 2 {
+		t.Fatalf("got %d log entries, want 2", len(entries))
+	}
+	if fields := entries[0].ContextMap(); fields["request_id"] != "req-1" || fields["seen"] != "req-1" {
+		t.Errorf("request with an ID logged %v", fields)
+	}
+	if fields := entries[1].ContextMap(); fields["request_id"] == "two words" || fields["request_id"] != fields["seen"] {
+		t.Errorf("request with an invalid ID logged %v", fields)
+	}
+}
+
+func TestClientSendsTheRequestID(t *testing.T) {
+	client := newBufconnClient(t, ClientConfig{}, func(ctx context.Context, req *healthpb.HealthCheckRequest) (*healthpb.HealthCheckResponse, error) {
+		if got := utils.RequestIDFromContext(ctx); got != req.Service {
+			return nil, status.Errorf(codes.InvalidArgument, "request id %q, want %q", got, req.Service)
+		}
+		return serving, nil
+	}, grpc.ChainUnaryInterceptor(UnaryLoggingInterceptor(zap.NewNop())))
+
+	ctx := utils.ContextWithRequestID(context.Background(), "req-1")
+	if _, err := client.Check(ctx, &healthpb.HealthCheckRequest{Service: "req-1"}); err != nil {
+		t.Fatal(err)
+	}
+	// metadata set by the caller wins
+	ctx = metadata.AppendToOutgoingContext(ctx, "x-request-id", "req-2")
+	if _, err := client.Check(ctx, &healthpb.HealthCheckRequest{Service: "req-2"}); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestClientStreamFinishesWhenTheCallerCancels(t *testing.T) {
+	core, logs := observer.New(zap.InfoLevel)
+	client := newBufconnClient(t, ClientConfig{
+		StreamInterceptors: []grpc.StreamClientInterceptor{StreamClientLoggingInterceptor(zap.New(core))},
+	}, func(ctx context.Context, req *healthpb.HealthCheckRequest) (*healthpb.HealthCheckResponse, error) {
+		return serving, nil
+	})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	if _, err := client.Watch(ctx, &healthpb.HealthCheckRequest{}); err != nil {
+		t.Fatal(err)
+	}
+	cancel() // without reading the stream
+
+	deadline := time.Now().Add(5 * time.Second)
+	for logs.Len() == 0 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	entries := logs.AllUntimed()
+	if len(entries) != 1 || entries[0].ContextMap()["grpc.code"] != codes.Canceled.String() {
+		t.Fatalf("got %v, want one Canceled call", entries)
+	}
+}
@@ -0,0 +1,186 @@
+package grpc
+
+import (
+	"context"
+	"time"
+
+	"github.com/harphies/go.microservices.io/observability/prommetrics"
+	"github.com/prometheus/client_golang/prometheus"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/status"
+)
+
+// ServerMetrics records RED metrics (rate, errors, duration) for every RPC, labelled by
+// service, method, RPC type and status code.
+type ServerMetrics struct {
+	started  *prometheus.CounterVec
+	handled  *prometheus.CounterVec
+	duration *prometheus.HistogramVec
+}
+
+// NewServerMetrics creates the server metrics and registers them on reg. Metrics already
+// registered by another server in the same process are shared.
+func NewServerMetrics(namespace string, reg prometheus.Registerer) (*ServerMetrics, error) {
+	m := &ServerMetrics{
+		started: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "grpc_server_started_total",
+			Help:      "Total number of RPCs started on the server",
+		}, []string{"grpc_type", "grpc_service", "grpc_method"}),
+		handled: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "grpc_server_handled_total",
+			Help:      "Total number of RPCs completed on the server, regardless of success or failure",
+		}, []string{"grpc_type", "grpc_service", "grpc_method", "grpc_code"}),
+		duration: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Namespace: namespace,
+			Name:      "grpc_server_handling_seconds",
+			Help:      "Time taken by the server to handle RPCs",
+			Buckets:   prometheus.DefBuckets,
+		}, []string{"grpc_type", "grpc_service", "grpc_method", "grpc_code"}),
+	}
+
+	var err error
+	if m.started, err = prommetrics.Register(reg, m.started); err != nil {
+		return nil, err
+	}
+	if m.handled, err = prommetrics.Register(reg, m.handled); err != nil {
+		return nil, err
+	}
+	if m.duration, err = prommetrics.Register(reg, m.duration); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+func (m *ServerMetrics) observe(rpcType, fullMethod string, start time.Time, err error) {
+	service, method := splitMethod(fullMethod)
+	code := status.Code(err).String()
+	m.handled.WithLabelValues(rpcType, service, method, code).Inc()
+	m.duration.WithLabelValues(rpcType, service, method, code).Observe(time.Since(start).Seconds())
+}
+
+func streamType(info *grpc.StreamServerInfo) string {
+	switch {
+	case info.IsClientStream && info.IsServerStream:
+		return "bidi_stream"
+	case info.IsClientStream:
+		return "client_stream"
+	default:
+		return "server_stream"
+	}
+}
+
+// UnaryServerInterceptor records metrics for unary RPCs.
+func (m *ServerMetrics) UnaryServerInterceptor() grpc.UnaryServerInterceptor {
+	return func(ctx context.Context, req any, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (any, error) {
+		service, method := splitMethod(info.FullMethod)
+		m.started.WithLabelValues("unary", service, method).Inc()
+		start := time.Now()
+		resp, err := handler(ctx, req)
+		m.observe("unary", info.FullMethod, start, err)
+		return resp, err
+	}
+}
+
+// StreamServerInterceptor records metrics for streaming RPCs.
+func (m *ServerMetrics) StreamServerInterceptor() grpc.StreamServerInterceptor {
+	return func(srv any, ss grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+		rpcType := streamType(info)
+		service, method := splitMethod(info.FullMethod)
+		m.started.WithLabelValues(rpcType, service, method).Inc()
+		start := time.Now()
+		err := handler(srv, ss)
+		m.observe(rpcType, info.FullMethod, start, err)
+		return err
+	}
+}
+
+// ClientMetrics is the client-side counterpart of ServerMetrics, observing calls as seen by
+// the caller, including retries and time spent waiting for a connection.
+type ClientMetrics struct {
+	started  *prometheus.CounterVec
+	handled  *prometheus.CounterVec
+	duration *prometheus.HistogramVec
+}
+
+// NewClientMetrics creates the client metrics and registers them on reg. Metrics already
+// registered by another client in the same process are shared.
+func NewClientMetrics(namespace string, reg prometheus.Registerer) (*ClientMetrics, error) {
+	m := &ClientMetrics{
+		started: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "grpc_client_started_total",
+			Help:      "Total number of RPCs started by the client",
+		}, []string{"grpc_type", "grpc_service", "grpc_method"}),
+		handled: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "grpc_client_handled_total",
+			Help:      "Total number of RPCs completed by the client, regardless of success or failure",
+		}, []string{"grpc_type", "grpc_service", "grpc_method", "grpc_code"}),
+		duration: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Namespace: namespace,
+			Name:      "grpc_client_handling_seconds",
+			Help:      "Time taken by RPCs made by the client until completion",
+			Buckets:   prometheus.DefBuckets,
+		}, []string{"grpc_type", "grpc_service", "grpc_method", "grpc_code"}),
+	}
+
+	var err error
+	if m.started, err = prommetrics.Register(reg, m.started); err != nil {
+		return nil, err
+	}
+	if m.handled, err = prommetrics.Register(reg, m.handled); err != nil {
+		return nil, err
+	}
+	if m.duration, err = prommetrics.Register(reg, m.duration); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+func (m *ClientMetrics) observe(rpcType, fullMethod string, start time.Time, err error) {
+	service, method := splitMethod(fullMethod)
+	code := status.Code(err).String()
+	m.handled.WithLabelValues(rpcType, service, method, code).Inc()
+	m.duration.WithLabelValues(rpcType, service, method, code).Observe(time.Since(start).Seconds())
+}
+
+func clientStreamType(desc *grpc.StreamDesc) string {
+	switch {
+	case desc.ClientStreams && desc.ServerStreams:
+		return "bidi_stream"
+	case desc.ClientStreams:
+		return "client_stream"
+	default:
+		return "server_stream"
+	}
+}
+
+// UnaryClientInterceptor records metrics for unary calls.
+func (m *ClientMetrics) UnaryClientInterceptor() grpc.UnaryClientInterceptor {
+	return func(ctx context.Context, fullMethod string, req, reply any, cc *grpc.ClientConn, invoker grpc.UnaryInvoker, opts ...grpc.CallOption) error {
+		service, method := splitMethod(fullMethod)
+		m.started.WithLabelValues("unary", service, method).Inc()
+		start := time.Now()
+		err := invoker(ctx, fullMethod, req, reply, cc, opts...)
+		m.observe("unary", fullMethod, start, err)
+		return err
+	}
+}
+
+// StreamClientInterceptor records metrics for streaming calls once the stream ends.
+func (m *ClientMetrics) StreamClientInterceptor() grpc.StreamClientInterceptor {
+	return func(ctx context.Context, desc *grpc.StreamDesc, cc *grpc.ClientConn, fullMethod string, streamer grpc.Streamer, opts ...grpc.CallOption) (grpc.ClientStream, error) {
+		rpcType := clientStreamType(desc)
+		service, method := splitMethod(fullMethod)
+		m.started.WithLabelValues(rpcType, service, method).Inc()
+		start := time.Now()
+		cs, err := streamer(ctx, desc, cc, fullMethod, opts...)
+		if err != nil {
+			m.observe(rpcType, fullMethod, start, err)
+			return nil, err
+		}
+		return newMonitoredClientStream(ctx, cs, desc, func(err error) { m.observe(rpcType, fullMethod, start, err) }), nil
+	}
+}
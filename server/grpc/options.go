@@ -0,0 +1,159 @@
+package grpc
+
+import (
+	"fmt"
+	"net"
+	"time"
+
+	"github.com/harphies/go.microservices.io/observability/prommetrics"
+	"github.com/harphies/go.microservices.io/security/certmanager"
+	"github.com/prometheus/client_golang/prometheus"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/keepalive"
+)
+
+const (
+	defaultShutdownTimeout = 5 * time.Second
+	defaultMaxMsgSize      = 4 * 1024 * 1024 // grpc-go's default receive limit
+)
+
+type config struct {
+	name               string
+	addr               string
+	listener           net.Listener
+	shutdownTimeout    time.Duration
+	keepalive          keepalive.ServerParameters
+	keepalivePolicy    keepalive.EnforcementPolicy
+	maxRecvMsgSize     int
+	maxSendMsgSize     int
+	reflection         bool
+	certManager        *certmanager.Manager
+	registerer         prometheus.Registerer
+	metricsNamespace   string
+	unaryInterceptors  []grpc.UnaryServerInterceptor
+	streamInterceptors []grpc.StreamServerInterceptor
+	serverOptions      []grpc.ServerOption
+}
+
+func defaultConfig() *config {
+	return &config{
+		name:            "grpc",
+		addr:            ":50051",
+		shutdownTimeout: defaultShutdownTimeout,
+		keepalive: keepalive.ServerParameters{
+			MaxConnectionIdle:     15 * time.Minute,
+			MaxConnectionAge:      30 * time.Minute, // rebalance long-lived clients across replicas
+			MaxConnectionAgeGrace: 5 * time.Minute,
+			Time:                  2 * time.Minute,
+			Timeout:               20 * time.Second,
+		},
+		keepalivePolicy: keepalive.EnforcementPolicy{
+			MinTime:             30 * time.Second,
+			PermitWithoutStream: true,
+		},
+		maxRecvMsgSize:   defaultMaxMsgSize,
+		maxSendMsgSize:   defaultMaxMsgSize,
+		registerer:       prometheus.DefaultRegisterer,
+		metricsNamespace: prommetrics.DefaultPromMetricsNamespace,
+	}
+}
+
+// Option configures a Server.
+type Option func(*config)
+
+// WithAddr sets the TCP address the server listens on, e.g. ":50051".
+func WithAddr(addr string) Option {
+	return func(c *config) {
+		c.addr = addr
+	}
+}
+
+// WithPort sets the TCP port the server listens on for all interfaces.
+func WithPort(port int) Option {
+	return func(c *config) {
+		c.addr = fmt.Sprintf(":%d", port)
+	}
+}
+
+// WithListener serves on an existing listener instead of opening a new one.
+func WithListener(ln net.Listener) Option {
+	return func(c *config) {
+		c.listener = ln
+	}
+}
+
+// WithName sets the name used in the server's log entries.
+func WithName(name string) Option {
+	return func(c *config) {
+		c.name = name
+	}
+}
+
+// WithShutdownTimeout sets how long in-flight RPCs may run once shutdown starts before
+// they are cancelled.
+func WithShutdownTimeout(d time.Duration) Option {
+	return func(c *config) {
+		c.shutdownTimeout = d
+	}
+}
+
+// WithKeepalive replaces the default keepalive parameters and enforcement policy.
+func WithKeepalive(params keepalive.ServerParameters, policy keepalive.EnforcementPolicy) Option {
+	return func(c *config) {
+		c.keepalive = params
+		c.keepalivePolicy = policy
+	}
+}
+
+// WithMaxMessageSize sets the largest message in bytes the server receives and sends.
+func WithMaxMessageSize(recv, send int) Option {
+	return func(c *config) {
+		c.maxRecvMsgSize = recv
+		c.maxSendMsgSize = send
+	}
+}
+
+// WithReflection registers the server reflection service, used by grpcurl and similar tools.
+func WithReflection() Option {
+	return func(c *config) {
+		c.reflection = true
+	}
+}
+
+// WithCertificateManager serves TLS with certificates from m, which the server keeps
+// reloading while it runs. Client certificates are required when m has a CA bundle.
+func WithCertificateManager(m *certmanager.Manager) Option {
+	return func(c *config) {
+		c.certManager = m
+	}
+}
+
+// WithMetrics registers the RED metrics on reg under namespace instead of on
+// prometheus.DefaultRegisterer. A nil reg disables the metrics interceptors.
+func WithMetrics(reg prometheus.Registerer, namespace string) Option {
+	return func(c *config) {
+		c.registerer = reg
+		c.metricsNamespace = namespace
+	}
+}
+
+// WithUnaryInterceptors appends interceptors that run after the default ones.
+func WithUnaryInterceptors(interceptors ...grpc.UnaryServerInterceptor) Option {
+	return func(c *config) {
+		c.unaryInterceptors = append(c.unaryInterceptors, interceptors...)
+	}
+}
+
+// WithStreamInterceptors appends interceptors that run after the default ones.
+func WithStreamInterceptors(interceptors ...grpc.StreamServerInterceptor) Option {
+	return func(c *config) {
+		c.streamInterceptors = append(c.streamInterceptors, interceptors...)
+	}
+}
+
+// WithServerOptions passes additional options to grpc.NewServer.
+func WithServerOptions(opts ...grpc.ServerOption) Option {
+	return func(c *config) {
+		c.serverOptions = append(c.serverOptions, opts...)
+	}
+}
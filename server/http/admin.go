@@ -0,0 +1,97 @@
+package http
+
+import (
+	"encoding/json"
+	"net/http"
+	"runtime"
+	"runtime/debug"
+
+	"github.com/harphies/go.microservices.io/observability/health"
+	"github.com/harphies/go.microservices.io/observability/prommetrics"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+// defaultAdminAddr keeps the admin endpoints off public interfaces unless an address is set.
+const defaultAdminAddr = "127.0.0.1:9090"
+
+// AdminConfig configures the admin listener that runs alongside the main server.
+type AdminConfig struct {
+	// Addr must not be exposed publicly, e.g. a pod-internal port such as ":9090" that the
+	// service does not publish. Default: "127.0.0.1:9090".
+	Addr string
+	// Gatherer is the Prometheus registry served on /metrics. Default: prometheus.DefaultGatherer.
+	Gatherer prometheus.Gatherer
+	// Health serves /livez, /readyz and /healthz when set.
+	Health *health.Health
+	// EnableProfiler serves the pprof endpoints under /debug/pprof/.
+	EnableProfiler bool
+	// Version is reported on /buildinfo next to the details embedded by the go toolchain.
+	Version string
+}
+
+// WithAdmin runs an admin listener serving metrics, pprof, health and build info alongside
+// the server. It starts before the server accepts traffic and is shut down after the server
+// has drained, so probes and scrapes keep working during shutdown.
+func WithAdmin(cfg AdminConfig) Option {
+	if cfg.Addr == "" {
+		cfg.Addr = defaultAdminAddr
+	}
+	return func(s *Server) {
+		s.admin = NewServer(s.logger, newAdminMux(cfg), WithName("admin"), WithAddr(cfg.Addr))
+	}
+}
+
+func newAdminMux(cfg AdminConfig) *http.ServeMux {
+	gatherer := cfg.Gatherer
+	if gatherer == nil {
+		gatherer = prometheus.DefaultGatherer
+	}
+
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", promhttp.HandlerFor(gatherer, promhttp.HandlerOpts{}))
+	if cfg.EnableProfiler {
+		prommetrics.RegisterProfiler(mux)
+	}
+	if cfg.Health != nil {
+		cfg.Health.RegisterHandlers(mux)
+	}
+	mux.Handle("/buildinfo", buildInfoHandler(cfg.Version))
+	return mux
+}
+
+// BuildInfo is the JSON body served on /buildinfo.
+type BuildInfo struct {
+	Version   string `json:"version,omitempty"`
+	Module    string `json:"module,omitempty"`
+	GoVersion string `json:"go_version"`
+	Revision  string `json:"revision,omitempty"`
+	Time      string `json:"time,omitempty"`
+	Modified  bool   `json:"modified,omitempty"`
+}
+
+func buildInfoHandler(version string) http.Handler {
+	info := BuildInfo{Version: version, GoVersion: runtime.Version()}
+	if bi, ok := debug.ReadBuildInfo(); ok {
+		info.Module = bi.Main.Path
+		if info.Version == "" {
+			info.Version = bi.Main.Version
+		}
+		for _, setting := range bi.Settings {
+			switch setting.Key {
+			case "vcs.revision":
+				info.Revision = setting.Value
+			case "vcs.time":
+				info.Time = setting.Value
+			case "vcs.modified":
+				info.Modified = setting.Value == "true"
+			}
+		}
+	}
+
+	body, _ := json.Marshal(info)
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.Write(body)
+	})
+}
@@ -3,159 +3,384 @@ package http
 import (
 	"context"
 	"crypto/tls"
-	"crypto/x509"
 	"errors"
 	"fmt"
-	"go.uber.org/zap"
-	"io/ioutil"
+	"net"
 	"net/http"
 	"os"
 	"os/signal"
 	"sync"
 	"syscall"
 	"time"
+
+	"github.com/harphies/go.microservices.io/observability/prommetrics"
+	"github.com/harphies/go.microservices.io/security/certmanager"
+	"github.com/prometheus/client_golang/prometheus"
+	"go.uber.org/zap"
 )
 
 // A Server defines parameters for serve HTTP requests, a wrapper around http.Server
+// with a managed lifecycle: Run serves until its context is cancelled, Shutdown drains
+// in-flight requests within the configured grace period and then runs the registered
+// shutdown hooks.
 type Server struct {
-	logger *zap.Logger
+	logger          *zap.Logger
+	srv             *http.Server
+	name            string
+	addr            string
+	listener        net.Listener
+	certFile        string
+	keyFile         string
+	certManager     *certmanager.Manager
+	admin           *Server
+	upgrader        *Upgrader
+	socketMode      os.FileMode
+	socketUID       int
+	socketGID       int
+	shutdownTimeout time.Duration
+
+	mu           sync.Mutex
+	boundAddr    net.Addr
+	hooks        []func(ctx context.Context) error
+	drainHooks   []func()
+	drainDelay   time.Duration
+	shutdownOnce sync.Once
+	shutdownErr  error
+	done         chan struct{}
 }
 
-func New(logger *zap.Logger, routes http.Handler, port int, wg sync.WaitGroup) error {
+// NewServer creates a Server for the given handler. Without options it listens on ":http"
+// with the same timeouts New has always used.
+func NewServer(logger *zap.Logger, handler http.Handler, opts ...Option) *Server {
+	s := &Server{
+		logger: logger,
+		srv: &http.Server{
+			Handler:           handler,
+			IdleTimeout:       defaultIdleTimeout,
+			ReadHeaderTimeout: defaultReadHeaderTimeout,
+			ReadTimeout:       defaultReadTimeout,
+			WriteTimeout:      defaultWriteTimeout,
+		},
+		name:            "http",
+		addr:            ":http",
+		shutdownTimeout: defaultShutdownTimeout,
+		socketUID:       -1,
+		socketGID:       -1,
+		done:            make(chan struct{}),
+	}
+	s.srv.ConnContext = s.connContext
+	for _, opt := range opts {
+		opt(s)
+	}
+	s.logger = s.logger.With(zap.String("server", s.name))
 
-	srv := &http.Server{
-		Addr:              fmt.Sprintf(":%d", port),
-		Handler:           routes,
-		IdleTimeout:       time.Minute,
-		ReadHeaderTimeout: 1 * time.Second,
-		ReadTimeout:       30 * time.Second,
-		WriteTimeout:      60 * time.Second,
+	// route net/http's internal errors (TLS handshakes, panics, accept failures) through zap
+	if errorLog, err := zap.NewStdLogAt(s.logger, zap.ErrorLevel); err == nil {
+		s.srv.ErrorLog = errorLog
 	}
+	return s
+}
 
-	// make a channel to communicate error within processes
-	shutDownError := make(chan error)
-	go func() {
-		// make a channel to receive os signal signals
-		quit := make(chan os.Signal, 1) // buffered channel with maximum value of 1
+// Addr returns the address the server is listening on, or nil if it is not listening yet.
+func (s *Server) Addr() net.Addr {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.boundAddr
+}
 
-		// listen to SIGINT and SIGTERM signals and put it in quit channel
-		signal.Notify(quit, syscall.SIGINT, syscall.SIGTERM)
+// RegisterOnShutdown registers a hook that runs after the server has stopped accepting
+// requests and in-flight requests have drained. Hooks run in reverse registration order
+// and receive the shutdown context, so they should return once it is done.
+func (s *Server) RegisterOnShutdown(fn func(ctx context.Context) error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.hooks = append(s.hooks, fn)
+}
 
-		// read the signal receive in quit channel into a variable
-		receivedSignal := <-quit // this blocks until it receives a SIGINT or SIGTERM signal
+// RegisterOnDrain registers a hook that runs as soon as shutdown starts, before the server
+// stops accepting connections. Use it to fail readiness so load balancers stop routing
+// traffic while in-flight requests are still being served.
+func (s *Server) RegisterOnDrain(fn func()) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.drainHooks = append(s.drainHooks, fn)
+}
 
-		// Log a message when a signal is received and stringify the received signal
-		logger.Info("caught signal", zap.String("received signal", receivedSignal.String()))
+// Run listens and serves requests until ctx is cancelled or Shutdown is called, then
+// waits for the shutdown to complete. It returns nil on a clean shutdown.
+func (s *Server) Run(ctx context.Context) error {
+	ctx, cancel := s.runUntilUpgraded(ctx)
+	defer cancel()
 
-		// Create a context with 5-second timeout
-		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
-		defer cancel()
-
-		// once a SIGTERM or SIGINT signal is received, make a call to shut down the signal
-		if err := srv.Shutdown(ctx); err != nil {
-			shutDownError <- err // put the error in the error channel if error occurs during shutting down the server
-		}
+	if err := s.Listen(); err != nil {
+		return err
+	}
+	if s.admin != nil {
+		go func() {
+			// the admin server is stopped by Shutdown once this server has drained
+			if err := s.admin.Run(context.Background()); err != nil {
+				s.logger.Error("admin server stopped", zap.Error(err))
+			}
+		}()
+	}
+	ln := s.listener
 
-		// Wait for all background processes to complete their task
-		logger.Info("Waiting for all background processes to complete their task!")
+	if s.certManager != nil {
+		reloadCtx, stopReload := context.WithCancel(ctx)
+		defer stopReload()
+		go s.certManager.Run(reloadCtx)
+	}
 
-		wg.Wait() // wait for all background goroutines to complete
-		shutDownError <- nil
+	serveErr := make(chan error, 1)
+	go func() {
+		s.logger.Info("Server started", zap.String("addr", ln.Addr().String()))
+		if s.srv.TLSConfig != nil || s.certFile != "" {
+			serveErr <- s.srv.ServeTLS(ln, s.certFile, s.keyFile)
+			return
+		}
+		serveErr <- s.srv.Serve(ln)
 	}()
 
-	err := srv.ListenAndServe()
-	if !errors.Is(err, http.ErrServerClosed) {
-		return err
+	select {
+	case err := <-serveErr:
+		if !errors.Is(err, http.ErrServerClosed) {
+			// stop the admin server and run the hooks as on any other exit
+			shutdownCtx, cancel := context.WithTimeout(context.Background(), s.shutdownTimeout)
+			defer cancel()
+			return errors.Join(fmt.Errorf("serve: %w", err), s.Shutdown(shutdownCtx))
+		}
+	case <-ctx.Done():
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), s.shutdownTimeout)
+		defer cancel()
+		// Shutdown records its own result; it is returned below once the server is done.
+		_ = s.Shutdown(shutdownCtx)
+		if err := <-serveErr; !errors.Is(err, http.ErrServerClosed) {
+			return err
+		}
 	}
 
-	// wait to receive the value in the shutdown channel
-	err = <-shutDownError
-	// check if the shutdown channel returns an error
-	if err != nil {
-		return err
+	// wait for whoever initiated the shutdown to finish draining and running hooks
+	<-s.done
+	if s.shutdownErr != nil {
+		return s.shutdownErr
 	}
 
 	// server successfully shut down
-	logger.Info("Server successfully shutdown!")
-
+	s.logger.Info("Server successfully shutdown!")
 	return nil
 }
 
-// Starting mTLS server
-
-func NewmTLS(logger *zap.Logger, routes http.Handler, port int, wg sync.WaitGroup) error {
+// Listen opens the listeners of the server and of its admin listener without serving yet.
+// Run calls it, so it is only needed to have every server of a process listening before
+// calling Upgrader.Ready. It is safe to call more than once.
+func (s *Server) Listen() error {
+	if s.admin != nil {
+		s.admin.upgrader = s.upgrader
+		// the admin listener has to be up before traffic arrives so probes and scrapes succeed
+		if err := s.admin.listen(); err != nil {
+			return err
+		}
+	}
+	if err := s.listen(); err != nil {
+		if s.admin != nil {
+			s.admin.closeListener()
+		}
+		return err
+	}
+	return nil
+}
 
-	// Create a CA certificate pool and add  cert.pem to it
-	caCert, err := ioutil.ReadFile(os.Getenv("mTLS_CERT_FILE_PATH"))
-	if err != nil {
-		logger.Error(err.Error())
+// listen opens the server's listener unless one was provided or already opened.
+func (s *Server) listen() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.listener == nil {
+		var (
+			ln  net.Listener
+			err error
+		)
+		if s.upgrader != nil {
+			ln, err = s.upgrader.listen(s.name, s.openListener)
+		} else {
+			ln, err = s.openListener()
+		}
+		if err != nil {
+			return fmt.Errorf("listen on %s: %w", s.addr, err)
+		}
+		s.listener = ln
 	}
-	caCertPool := x509.NewCertPool()
-	caCertPool.AppendCertsFromPEM(caCert)
+	s.boundAddr = s.listener.Addr()
+	return nil
+}
 
-	// Create the TLS Config with the CA pool and enable Client certificate validation
-	tlsConfig := &tls.Config{
-		ClientCAs:  caCertPool,
-		ClientAuth: tls.RequireAndVerifyClientCert,
+func (s *Server) closeListener() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.listener != nil {
+		s.listener.Close()
 	}
-	tlsConfig.BuildNameToCertificate()
+}
 
-	srv := &http.Server{
-		Addr:              fmt.Sprintf(":%d", port), // start mTLS server on port 8443 or similar
-		Handler:           routes,
-		IdleTimeout:       time.Minute,
-		ReadHeaderTimeout: 1 * time.Second,
-		ReadTimeout:       30 * time.Second,
-		WriteTimeout:      60 * time.Second,
-		TLSConfig:         tlsConfig,
+// AdminAddr returns the address the admin listener is bound to, or nil if there is none.
+func (s *Server) AdminAddr() net.Addr {
+	if s.admin == nil {
+		return nil
 	}
+	return s.admin.Addr()
+}
 
-	// make a channel to communicate error within processes
-	shutDownError := make(chan error)
-	go func() {
-		// make a channel to receive os signal signals
-		quit := make(chan os.Signal, 1) // buffered channel with maximum value of 1
+// Shutdown gracefully stops the server: it stops accepting new connections, waits for
+// in-flight requests until ctx is done and then runs the shutdown hooks. It is safe to
+// call more than once; later calls wait for and return the result of the first.
+func (s *Server) Shutdown(ctx context.Context) error {
+	s.shutdownOnce.Do(func() {
+		defer close(s.done)
 
-		// listen to SIGINT and SIGTERM signals and put it in quit channel
-		signal.Notify(quit, syscall.SIGINT, syscall.SIGTERM)
+		s.logger.Info("Shutting down server", zap.Duration("grace_period", s.shutdownTimeout))
 
-		// read the signal receive in quit channel into a variable
-		receivedSignal := <-quit // this blocks until it receives a SIGINT or SIGTERM signal
+		s.mu.Lock()
+		drainHooks := append([]func(){}, s.drainHooks...)
+		s.mu.Unlock()
+		for _, fn := range drainHooks {
+			fn()
+		}
 
-		// Log a message when a signal is received and stringify the received signal
-		logger.Info("caught signal", zap.String("received signal", receivedSignal.String()))
+		// keep serving while load balancers notice the failing readiness
+		if s.drainDelay > 0 {
+			select {
+			case <-time.After(s.drainDelay):
+			case <-ctx.Done():
+			}
+		}
 
-		// Create a context with 5-second timeout
-		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
-		defer cancel()
+		var errs []error
+		if err := s.srv.Shutdown(ctx); err != nil {
+			errs = append(errs, fmt.Errorf("shutdown http server: %w", err))
+		}
+
+		s.mu.Lock()
+		hooks := append([]func(context.Context) error(nil), s.hooks...)
+		s.mu.Unlock()
 
-		// once a SIGTERM or SIGINT signal is received, make a call to shut down the signal
-		if err := srv.Shutdown(ctx); err != nil {
-			shutDownError <- err // put the error in the error channel if error occurs during shutting down the server
+		for i := len(hooks) - 1; i >= 0; i-- {
+			if err := hooks[i](ctx); err != nil {
+				errs = append(errs, err)
+			}
 		}
+		if s.admin != nil {
+			if err := s.admin.Shutdown(ctx); err != nil {
+				errs = append(errs, fmt.Errorf("shutdown admin server: %w", err))
+			}
+		}
+		s.shutdownErr = errors.Join(errs...)
+	})
+	return s.shutdownErr
+}
 
+// SignalContext returns a context that is cancelled when the process receives SIGINT or
+// SIGTERM. Pass it to Run on one or more servers to stop them all on the same signal.
+func SignalContext(parent context.Context, logger *zap.Logger) (context.Context, context.CancelFunc) {
+	ctx, cancel := context.WithCancel(parent)
+
+	// make a channel to receive os signal signals
+	quit := make(chan os.Signal, 1) // buffered channel with maximum value of 1
+
+	// listen to SIGINT and SIGTERM signals and put it in quit channel
+	signal.Notify(quit, syscall.SIGINT, syscall.SIGTERM)
+
+	go func() {
+		defer signal.Stop(quit)
+		select {
+		case receivedSignal := <-quit:
+			// Log a message when a signal is received and stringify the received signal
+			logger.Info("caught signal", zap.String("received signal", receivedSignal.String()))
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+
+	return ctx, cancel
+}
+
+// WaitGroupHook returns a shutdown hook that waits for all background goroutines tracked
+// by wg to complete, giving up when the shutdown context is done.
+func WaitGroupHook(logger *zap.Logger, wg *sync.WaitGroup) func(ctx context.Context) error {
+	return func(ctx context.Context) error {
 		// Wait for all background processes to complete their task
 		logger.Info("Waiting for all background processes to complete their task!")
 
-		wg.Wait() // wait for all background goroutines to complete
-		shutDownError <- nil
-	}()
+		finished := make(chan struct{})
+		go func() {
+			wg.Wait() // wait for all background goroutines to complete
+			close(finished)
+		}()
+
+		select {
+		case <-finished:
+			return nil
+		case <-ctx.Done():
+			return fmt.Errorf("waiting for background processes: %w", ctx.Err())
+		}
+	}
+}
 
-	// Listen to HTTPS connections with the server certificate and wait
-	err = srv.ListenAndServeTLS(os.Getenv("mTLS_CERT_FILE_PATH"), os.Getenv("mTLS_CERT_KEY_PATH"))
-	if !errors.Is(err, http.ErrServerClosed) {
-		return err
+// New starts an HTTP server on port and blocks until SIGINT or SIGTERM is received, then
+// drains in-flight requests and waits for the goroutines tracked by wg.
+func New(logger *zap.Logger, routes http.Handler, port int, wg *sync.WaitGroup, opts ...Option) error {
+	ctx, cancel := SignalContext(context.Background(), logger)
+	defer cancel()
+
+	srv := NewServer(logger, routes, append([]Option{WithPort(port)}, opts...)...)
+	if wg != nil {
+		srv.RegisterOnShutdown(WaitGroupHook(logger, wg))
+	}
+	if srv.upgrader != nil {
+		// this is the only server of the process, so it is ready once it listens
+		if err := srv.Listen(); err != nil {
+			return err
+		}
+		if err := srv.upgrader.Ready(); err != nil {
+			logger.Error("failed to notify the previous process", zap.Error(err))
+		}
+	}
+	return srv.Run(ctx)
+}
+
+// Starting mTLS server
+
+// NewmTLS starts an HTTPS server on port (8443 or similar) that requires client certificates
+// and otherwise behaves like New. The server certificate and key are read from
+// mTLS_CERT_FILE_PATH and mTLS_CERT_KEY_PATH, and client certificates are verified against
+// the CA bundle in mTLS_CA_FILE_PATH. All three files are reloaded when they change, and
+// their expiry and reloads are reported on the default Prometheus registry.
+func NewmTLS(logger *zap.Logger, routes http.Handler, port int, wg *sync.WaitGroup, opts ...Option) error {
+	caFile := os.Getenv("mTLS_CA_FILE_PATH")
+	if caFile == "" {
+		// older deployments mount a single file that is both the CA and the server certificate
+		caFile = os.Getenv("mTLS_CERT_FILE_PATH")
+		logger.Warn("mTLS_CA_FILE_PATH is not set, verifying clients against mTLS_CERT_FILE_PATH")
 	}
 
-	// wait to receive the value in the shutdown channel
-	err = <-shutDownError
-	// check if the shutdown channel returns an error
+	metrics, err := prommetrics.Register(prometheus.DefaultRegisterer,
+		prommetrics.NewCertificateMetrics(prommetrics.DefaultPromMetricsNamespace, ""))
 	if err != nil {
-		return err
+		return fmt.Errorf("register certificate metrics: %w", err)
+	}
+	certs, err := certmanager.New(logger, certmanager.Config{
+		Name:       "mtls",
+		CertFile:   os.Getenv("mTLS_CERT_FILE_PATH"),
+		KeyFile:    os.Getenv("mTLS_CERT_KEY_PATH"),
+		CAFile:     caFile,
+		ClientAuth: tls.RequireAndVerifyClientCert,
+	}, certmanager.WithMetrics(metrics))
+	if err != nil {
+		return fmt.Errorf("load mTLS certificates: %w", err)
 	}
 
-	// server successfully shut down
-	logger.Info("Server successfully shutdown!")
+	return New(logger, routes, port, wg, append([]Option{WithCertificateManager(certs)}, opts...)...)
+}
 
-	return nil
+func portAddr(port int) string {
+	return fmt.Sprintf(":%d", port)
 }
@@ -0,0 +1,51 @@
+package http
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/http"
+	"testing"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// failingListener fails Accept with a permanent error, making Serve return it.
+type failingListener struct {
+	net.Listener
+}
+
+var errAcceptFailed = errors.New("accept failed")
+
+func (l failingListener) Accept() (net.Conn, error) {
+	return nil, errAcceptFailed
+}
+
+func TestRunShutsDownWhenServeFails(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := NewServer(zap.NewNop(), http.NotFoundHandler(),
+		WithListener(failingListener{ln}),
+		WithAdmin(AdminConfig{Addr: "127.0.0.1:0"}),
+		WithShutdownTimeout(time.Second),
+	)
+	hookRan := false
+	s.RegisterOnShutdown(func(context.Context) error {
+		hookRan = true
+		return nil
+	})
+
+	if err := s.Run(context.Background()); !errors.Is(err, errAcceptFailed) {
+		t.Fatalf("Run returned %v, want the serve error", err)
+	}
+	if !hookRan {
+		t.Error("shutdown hook did not run")
+	}
+	if conn, err := net.Dial("tcp", s.AdminAddr().String()); err == nil {
+		conn.Close()
+		t.Error("admin server still accepts connections")
+	}
+}
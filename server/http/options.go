@@ -0,0 +1,178 @@
+package http
+
+import (
+	"context"
+	"crypto/tls"
+	"net"
+	"net/http"
+	"os"
+	"time"
+
+	"github.com/harphies/go.microservices.io/observability/health"
+	"github.com/harphies/go.microservices.io/security/certmanager"
+)
+
+const (
+	defaultIdleTimeout       = time.Minute
+	defaultReadHeaderTimeout = 1 * time.Second
+	defaultReadTimeout       = 30 * time.Second
+	defaultWriteTimeout      = 60 * time.Second
+	defaultShutdownTimeout   = 5 * time.Second
+)
+
+// Option configures a Server.
+type Option func(*Server)
+
+// WithAddr sets the address the server listens on, e.g. ":8080" or "127.0.0.1:9090" for TCP,
+// "unix:///run/app/app.sock" for a Unix domain socket or "unix://@app" for a socket in the
+// Linux abstract namespace.
+func WithAddr(addr string) Option {
+	return func(s *Server) {
+		s.addr = addr
+	}
+}
+
+// WithPort sets the TCP port the server listens on for all interfaces.
+func WithPort(port int) Option {
+	return func(s *Server) {
+		s.addr = portAddr(port)
+	}
+}
+
+// WithListener serves on an existing listener instead of opening a new one.
+// The listener is closed by the server when it shuts down.
+func WithListener(ln net.Listener) Option {
+	return func(s *Server) {
+		s.listener = ln
+	}
+}
+
+// WithSocketMode sets the permissions of the Unix domain socket file, e.g. 0660 to allow
+// only the owner and group to connect.
+func WithSocketMode(mode os.FileMode) Option {
+	return func(s *Server) {
+		s.socketMode = mode
+	}
+}
+
+// WithSocketOwner sets the owner and group of the Unix domain socket file. Pass -1 to keep
+// either one unchanged.
+func WithSocketOwner(uid, gid int) Option {
+	return func(s *Server) {
+		s.socketUID = uid
+		s.socketGID = gid
+	}
+}
+
+// WithIdleTimeout sets the maximum time to wait for the next request on a keep-alive connection.
+func WithIdleTimeout(d time.Duration) Option {
+	return func(s *Server) {
+		s.srv.IdleTimeout = d
+	}
+}
+
+// WithReadHeaderTimeout sets the time allowed to read request headers.
+func WithReadHeaderTimeout(d time.Duration) Option {
+	return func(s *Server) {
+		s.srv.ReadHeaderTimeout = d
+	}
+}
+
+// WithReadTimeout sets the maximum duration for reading the entire request, including the body.
+func WithReadTimeout(d time.Duration) Option {
+	return func(s *Server) {
+		s.srv.ReadTimeout = d
+	}
+}
+
+// WithWriteTimeout sets the maximum duration before timing out writes of the response.
+func WithWriteTimeout(d time.Duration) Option {
+	return func(s *Server) {
+		s.srv.WriteTimeout = d
+	}
+}
+
+// WithShutdownTimeout sets the grace period given to in-flight requests once shutdown starts.
+func WithShutdownTimeout(d time.Duration) Option {
+	return func(s *Server) {
+		s.shutdownTimeout = d
+	}
+}
+
+// WithDrainDelay keeps serving requests for d after shutdown starts and the drain hooks
+// have run, giving load balancers time to stop routing traffic. The delay counts towards
+// the shutdown grace period.
+func WithDrainDelay(d time.Duration) Option {
+	return func(s *Server) {
+		s.drainDelay = d
+	}
+}
+
+// WithHealth fails h's readiness as soon as the server starts draining.
+func WithHealth(h *health.Health) Option {
+	return func(s *Server) {
+		s.drainHooks = append(s.drainHooks, h.Drain)
+	}
+}
+
+// WithUnencryptedHTTP2 accepts HTTP/2 without TLS (h2c) next to HTTP/1.1, e.g. for gRPC
+// served on the same port behind a TLS-terminating proxy.
+func WithUnencryptedHTTP2() Option {
+	return func(s *Server) {
+		protocols := new(http.Protocols)
+		protocols.SetHTTP1(true)
+		protocols.SetHTTP2(true)
+		protocols.SetUnencryptedHTTP2(true)
+		s.srv.Protocols = protocols
+	}
+}
+
+// WithBaseContext sets the context every incoming request context is derived from.
+func WithBaseContext(ctx context.Context) Option {
+	return func(s *Server) {
+		s.srv.BaseContext = func(net.Listener) context.Context { return ctx }
+	}
+}
+
+// WithTLSConfig serves HTTPS using the given TLS configuration. The configuration must
+// provide its own certificates (Certificates or GetCertificate) unless WithTLSCertFiles is used.
+func WithTLSConfig(cfg *tls.Config) Option {
+	return func(s *Server) {
+		s.srv.TLSConfig = cfg
+	}
+}
+
+// WithTLSCertFiles serves HTTPS using the certificate and key stored at the given paths.
+func WithTLSCertFiles(certFile, keyFile string) Option {
+	return func(s *Server) {
+		s.certFile = certFile
+		s.keyFile = keyFile
+	}
+}
+
+// WithCertificateManager serves HTTPS with certificates from m, which the server keeps
+// reloading from disk for as long as it runs.
+func WithCertificateManager(m *certmanager.Manager) Option {
+	return func(s *Server) {
+		s.certManager = m
+		s.srv.TLSConfig = m.TLSConfig()
+	}
+}
+
+// WithUpgrader listens through u, so the server reuses sockets passed in by systemd socket
+// activation or a previous process, and drains and stops once a new process took over on
+// SIGHUP. Listeners are matched by the server name (see WithName), which is what the
+// FileDescriptorName= of a systemd .socket unit should be set to. Call Upgrader.Ready once
+// every server of the process is listening, see Server.Listen.
+func WithUpgrader(u *Upgrader) Option {
+	return func(s *Server) {
+		s.upgrader = u
+	}
+}
+
+// WithName sets the name used in the server's log entries, useful when a service runs several servers.
+func WithName(name string) Option {
+	return func(s *Server) {
+		s.name = name
+	}
+}
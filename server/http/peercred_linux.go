@@ -0,0 +1,28 @@
+package http
+
+import (
+	"net"
+	"syscall"
+)
+
+func peerCredentials(c *net.UnixConn) (PeerCredentials, error) {
+	raw, err := c.SyscallConn()
+	if err != nil {
+		return PeerCredentials{}, err
+	}
+
+	var (
+		cred    *syscall.Ucred
+		credErr error
+	)
+	err = raw.Control(func(fd uintptr) {
+		cred, credErr = syscall.GetsockoptUcred(int(fd), syscall.SOL_SOCKET, syscall.SO_PEERCRED)
+	})
+	if err != nil {
+		return PeerCredentials{}, err
+	}
+	if credErr != nil {
+		return PeerCredentials{}, credErr
+	}
+	return PeerCredentials{PID: cred.Pid, UID: cred.Uid, GID: cred.Gid}, nil
+}
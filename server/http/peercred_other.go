@@ -0,0 +1,12 @@
+//go:build !linux
+
+package http
+
+import (
+	"errors"
+	"net"
+)
+
+func peerCredentials(*net.UnixConn) (PeerCredentials, error) {
+	return PeerCredentials{}, errors.ErrUnsupported
+}
@@ -0,0 +1,124 @@
+package http
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/fs"
+	"net"
+	"os"
+	"strings"
+	"syscall"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+const unixScheme = "unix://"
+
+// PeerCredentials identifies the process on the other end of a Unix domain socket.
+type PeerCredentials struct {
+	PID int32
+	UID uint32
+	GID uint32
+}
+
+type peerCredentialsKey struct{}
+
+// PeerCredentialsFromContext returns the credentials of the process that opened the
+// connection the request arrived on. It is only set for Unix domain socket connections on
+// platforms that support SO_PEERCRED.
+func PeerCredentialsFromContext(ctx context.Context) (PeerCredentials, bool) {
+	creds, ok := ctx.Value(peerCredentialsKey{}).(PeerCredentials)
+	return creds, ok
+}
+
+// connContext stores the peer credentials of Unix domain socket connections on the
+// connection context, from which every request context is derived.
+func (s *Server) connContext(ctx context.Context, c net.Conn) context.Context {
+	if nc, ok := c.(interface{ NetConn() net.Conn }); ok {
+		c = nc.NetConn() // unwrap TLS connections
+	}
+	uc, ok := c.(*net.UnixConn)
+	if !ok {
+		return ctx
+	}
+
+	creds, err := peerCredentials(uc)
+	if err != nil {
+		if !errors.Is(err, errors.ErrUnsupported) {
+			s.logger.Warn("failed to read unix socket peer credentials", zap.Error(err))
+		}
+		return ctx
+	}
+	return context.WithValue(ctx, peerCredentialsKey{}, creds)
+}
+
+// splitAddr maps "unix:///run/app.sock" and "unix://@name" (abstract namespace, Linux only)
+// to the "unix" network and everything else to "tcp".
+func splitAddr(addr string) (network, address string) {
+	if path, ok := strings.CutPrefix(addr, unixScheme); ok {
+		return "unix", path
+	}
+	return "tcp", addr
+}
+
+// openListener listens on the server's address, preparing the socket file for Unix
+// domain sockets.
+func (s *Server) openListener() (net.Listener, error) {
+	network, address := splitAddr(s.addr)
+	if network != "unix" || strings.HasPrefix(address, "@") {
+		return net.Listen(network, address)
+	}
+
+	if err := removeStaleSocket(address); err != nil {
+		return nil, err
+	}
+	ln, err := net.Listen(network, address)
+	if err != nil {
+		return nil, err
+	}
+	if s.upgrader != nil {
+		// the socket file is shared with the next process after an upgrade
+		ln.(*net.UnixListener).SetUnlinkOnClose(false)
+	}
+
+	if s.socketMode != 0 {
+		if err := os.Chmod(address, s.socketMode); err != nil {
+			ln.Close()
+			return nil, fmt.Errorf("chmod %s: %w", address, err)
+		}
+	}
+	if s.socketUID >= 0 || s.socketGID >= 0 {
+		if err := os.Chown(address, s.socketUID, s.socketGID); err != nil {
+			ln.Close()
+			return nil, fmt.Errorf("chown %s: %w", address, err)
+		}
+	}
+	return ln, nil
+}
+
+// removeStaleSocket deletes a socket file left behind by a process that did not shut down
+// cleanly. A socket somebody is still accepting on is left alone, as is any other file type.
+func removeStaleSocket(path string) error {
+	info, err := os.Lstat(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if info.Mode().Type() != fs.ModeSocket {
+		return fmt.Errorf("%s exists and is not a socket", path)
+	}
+
+	conn, err := net.DialTimeout("unix", path, time.Second)
+	if err == nil {
+		conn.Close()
+		return fmt.Errorf("%s is in use by another process", path)
+	}
+	if !errors.Is(err, syscall.ECONNREFUSED) {
+		return fmt.Errorf("probe %s: %w", path, err)
+	}
+	return os.Remove(path)
+}
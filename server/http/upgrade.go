@@ -0,0 +1,379 @@
+package http
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"os/exec"
+	"os/signal"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+/*
+Zero-downtime restarts for services running under systemd or any other supervisor on a VM.
+
+Listeners are inherited using the systemd socket activation protocol (LISTEN_FDS, LISTEN_PID,
+LISTEN_FDNAMES), so a service can be started by a .socket unit. On SIGHUP the Upgrader starts
+the new binary with the same arguments and hands it the listening sockets the same way. Once
+the new process reports it is serving, the old one drains its in-flight requests and exits.
+Connections are never refused: both processes accept on the same sockets during the handover.
+
+	upgrader, err := httpserver.NewUpgrader(logger, 0)
+	api := httpserver.NewServer(logger, mux, httpserver.WithUpgrader(upgrader), httpserver.WithAdmin(adminCfg))
+	internal := httpserver.NewServer(logger, internalMux, httpserver.WithName("internal"), httpserver.WithUpgrader(upgrader))
+	for _, srv := range []*httpserver.Server{api, internal} {
+		if err := srv.Listen(); err != nil {
+			return err
+		}
+	}
+	// every inherited socket is claimed; the previous process can drain now
+	if err := upgrader.Ready(); err != nil {
+		logger.Error("failed to notify the previous process", zap.Error(err))
+	}
+	go api.Run(ctx)
+	internal.Run(ctx)
+
+Refs
+https://www.freedesktop.org/software/systemd/man/latest/sd_listen_fds.html
+https://github.com/cloudflare/tableflip
+*/
+
+const (
+	listenFDsStart     = 3
+	envListenPID       = "LISTEN_PID"
+	envListenFDs       = "LISTEN_FDS"
+	envListenFDNames   = "LISTEN_FDNAMES"
+	envUpgradeReadyFD  = "UPGRADE_READY_FD"
+	defaultUpgradeWait = 30 * time.Second
+)
+
+var ErrUpgradeInProgress = errors.New("upgrade already in progress")
+
+// An Upgrader hands listening sockets from one process to the next. Create one per process,
+// pass it to every Server with WithUpgrader and call Ready once they all listen. The servers
+// reuse inherited sockets and stop once a new process has taken over.
+type Upgrader struct {
+	logger      *zap.Logger
+	readyWait   time.Duration
+	mu          sync.Mutex
+	inherited   map[string][]net.Listener
+	listeners   map[string]net.Listener
+	upgrading   bool
+	readyFile   *os.File
+	readyOnce   sync.Once
+	exit        chan struct{}
+	exitOnce    sync.Once
+	stopSignals func()
+}
+
+// NewUpgrader collects the listeners passed in by systemd or a parent process and starts
+// handling SIGHUP. readyWait bounds how long the new process has to start serving before the
+// upgrade is abandoned; 0 means 30s.
+func NewUpgrader(logger *zap.Logger, readyWait time.Duration) (*Upgrader, error) {
+	if readyWait <= 0 {
+		readyWait = defaultUpgradeWait
+	}
+	u := &Upgrader{
+		logger:    logger,
+		readyWait: readyWait,
+		listeners: make(map[string]net.Listener),
+		exit:      make(chan struct{}),
+	}
+
+	inherited, err := listenersFromEnv()
+	if err != nil {
+		return nil, err
+	}
+	u.inherited = inherited
+
+	if fd, ok := os.LookupEnv(envUpgradeReadyFD); ok {
+		os.Unsetenv(envUpgradeReadyFD)
+		n, err := strconv.Atoi(fd)
+		if err != nil {
+			return nil, fmt.Errorf("invalid %s: %w", envUpgradeReadyFD, err)
+		}
+		u.readyFile = os.NewFile(uintptr(n), "upgrade-ready")
+	}
+
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	done := make(chan struct{})
+	u.stopSignals = sync.OnceFunc(func() {
+		signal.Stop(hup)
+		close(done)
+	})
+	go func() {
+		for {
+			select {
+			case <-hup:
+				logger.Info("caught signal", zap.String("received signal", syscall.SIGHUP.String()))
+				if err := u.Upgrade(); err != nil {
+					logger.Error("upgrade failed, keep serving from the current process", zap.Error(err))
+				}
+			case <-done:
+				return
+			}
+		}
+	}()
+
+	return u, nil
+}
+
+// listenersFromEnv turns the file descriptors announced in LISTEN_FDS into listeners, keyed
+// by their LISTEN_FDNAMES entry. The variables are unset so they do not leak into children.
+func listenersFromEnv() (map[string][]net.Listener, error) {
+	defer func() {
+		os.Unsetenv(envListenPID)
+		os.Unsetenv(envListenFDs)
+		os.Unsetenv(envListenFDNames)
+	}()
+
+	listeners := make(map[string][]net.Listener)
+	count := os.Getenv(envListenFDs)
+	if count == "" {
+		return listeners, nil
+	}
+	// systemd sets LISTEN_PID to the activated process; a handover from an older process
+	// cannot know the child's pid in advance and leaves it unset.
+	if pid := os.Getenv(envListenPID); pid != "" && pid != strconv.Itoa(os.Getpid()) {
+		return listeners, nil
+	}
+
+	n, err := strconv.Atoi(count)
+	if err != nil {
+		return nil, fmt.Errorf("invalid %s: %w", envListenFDs, err)
+	}
+	names := strings.Split(os.Getenv(envListenFDNames), ":")
+
+	for i := 0; i < n; i++ {
+		name := "unknown"
+		if i < len(names) && names[i] != "" {
+			name = names[i]
+		}
+		f := os.NewFile(uintptr(listenFDsStart+i), name)
+		ln, err := net.FileListener(f)
+		f.Close() // FileListener holds its own duplicate
+		if err != nil {
+			return nil, fmt.Errorf("inherit listener %q (fd %d): %w", name, listenFDsStart+i, err)
+		}
+		listeners[name] = append(listeners[name], ln)
+	}
+	return listeners, nil
+}
+
+// Listen returns the inherited listener registered under name, or opens a new one on
+// network and addr. Unnamed sockets from systemd ("unknown") are handed out in order when
+// nothing matches the name. The listener is passed on to the next process on upgrade.
+func (u *Upgrader) Listen(name, network, addr string) (net.Listener, error) {
+	return u.listen(name, func() (net.Listener, error) {
+		return net.Listen(network, addr)
+	})
+}
+
+func (u *Upgrader) listen(name string, open func() (net.Listener, error)) (net.Listener, error) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+
+	if ln, ok := u.listeners[name]; ok {
+		return nil, fmt.Errorf("listener %q is already in use by %s", name, ln.Addr())
+	}
+
+	ln := u.takeInherited(name)
+	if ln == nil {
+		ln = u.takeInherited("unknown")
+	}
+	if ln != nil {
+		u.logger.Info("using inherited listener", zap.String("name", name), zap.String("addr", ln.Addr().String()))
+	} else {
+		var err error
+		ln, err = open()
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	u.listeners[name] = ln
+	return ln, nil
+}
+
+func (u *Upgrader) takeInherited(name string) net.Listener {
+	lns := u.inherited[name]
+	if len(lns) == 0 {
+		return nil
+	}
+	u.inherited[name] = lns[1:]
+	return lns[0]
+}
+
+// Ready tells the parent process, if any, that this process has taken over the listeners
+// and the parent can start draining, and closes the inherited listeners nobody claimed.
+// Call it once every listener of the process is open, e.g. after Server.Listen on every
+// server; calling it again is a no-op.
+func (u *Upgrader) Ready() error {
+	var err error
+	u.readyOnce.Do(func() {
+		// close listeners nobody asked for so their sockets do not stay half-open
+		u.mu.Lock()
+		for name, lns := range u.inherited {
+			for _, ln := range lns {
+				u.logger.Warn("closing unused inherited listener", zap.String("name", name), zap.String("addr", ln.Addr().String()))
+				ln.Close()
+			}
+		}
+		u.inherited = nil
+		u.mu.Unlock()
+
+		if u.readyFile == nil {
+			return
+		}
+		defer u.readyFile.Close()
+		_, err = u.readyFile.Write([]byte{1})
+	})
+	return err
+}
+
+// Upgrade starts a new instance of the running binary with the current listeners and waits
+// for it to report ready. On success Exit is closed and every server using the Upgrader
+// drains and stops; on failure the current process keeps serving.
+func (u *Upgrader) Upgrade() error {
+	select {
+	case <-u.exit:
+		return errors.New("a new process has already taken over")
+	default:
+	}
+
+	u.mu.Lock()
+	if u.upgrading {
+		u.mu.Unlock()
+		return ErrUpgradeInProgress
+	}
+	u.upgrading = true
+
+	names := make([]string, 0, len(u.listeners))
+	files := make([]*os.File, 0, len(u.listeners)+1)
+	for name, ln := range u.listeners {
+		f, err := listenerFile(ln)
+		if err != nil {
+			u.upgrading = false
+			u.mu.Unlock()
+			closeFiles(files)
+			return fmt.Errorf("listener %q: %w", name, err)
+		}
+		names = append(names, name)
+		files = append(files, f)
+	}
+	u.mu.Unlock()
+
+	defer func() {
+		u.mu.Lock()
+		u.upgrading = false
+		u.mu.Unlock()
+	}()
+	defer closeFiles(files)
+
+	readyR, readyW, err := os.Pipe()
+	if err != nil {
+		return fmt.Errorf("create readiness pipe: %w", err)
+	}
+	defer readyR.Close()
+
+	executable, err := os.Executable()
+	if err != nil {
+		readyW.Close()
+		return fmt.Errorf("locate executable: %w", err)
+	}
+
+	cmd := exec.Command(executable, os.Args[1:]...)
+	cmd.Stdin = os.Stdin
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	cmd.ExtraFiles = append(files, readyW)
+	cmd.Env = append(os.Environ(),
+		fmt.Sprintf("%s=%d", envListenFDs, len(names)),
+		fmt.Sprintf("%s=%s", envListenFDNames, strings.Join(names, ":")),
+		fmt.Sprintf("%s=%d", envUpgradeReadyFD, listenFDsStart+len(names)),
+	)
+
+	err = cmd.Start()
+	readyW.Close() // the child holds its own copy; EOF on readyR now means the child is gone
+	if err != nil {
+		return fmt.Errorf("start %s: %w", executable, err)
+	}
+	u.logger.Info("started new process, waiting for it to become ready", zap.Int("pid", cmd.Process.Pid))
+
+	ready := make(chan error, 1)
+	go func() {
+		buf := make([]byte, 1)
+		if _, err := io.ReadFull(readyR, buf); err != nil {
+			ready <- fmt.Errorf("new process exited before becoming ready: %w", err)
+			return
+		}
+		ready <- nil
+	}()
+
+	select {
+	case err = <-ready:
+	case <-time.After(u.readyWait):
+		err = fmt.Errorf("new process did not become ready within %s", u.readyWait)
+	}
+	if err != nil {
+		cmd.Process.Kill()
+		go cmd.Wait()
+		return err
+	}
+
+	u.logger.Info("new process is ready, draining the current process", zap.Int("pid", cmd.Process.Pid))
+	// the new process outlives this one; release it so it is not reaped as our child
+	cmd.Process.Release()
+	u.exitOnce.Do(func() { close(u.exit) })
+	return nil
+}
+
+// Exit is closed once a new process has taken over the listeners.
+func (u *Upgrader) Exit() <-chan struct{} {
+	return u.exit
+}
+
+// Stop stops handling SIGHUP.
+func (u *Upgrader) Stop() {
+	u.stopSignals()
+}
+
+func listenerFile(ln net.Listener) (*os.File, error) {
+	fl, ok := ln.(interface{ File() (*os.File, error) })
+	if !ok {
+		return nil, fmt.Errorf("%T cannot be passed to another process", ln)
+	}
+	return fl.File()
+}
+
+func closeFiles(files []*os.File) {
+	for _, f := range files {
+		f.Close()
+	}
+}
+
+// runUntilUpgraded derives a context that is also cancelled once a new process has taken
+// over the listeners.
+func (s *Server) runUntilUpgraded(ctx context.Context) (context.Context, context.CancelFunc) {
+	ctx, cancel := context.WithCancel(ctx)
+	if s.upgrader != nil {
+		go func() {
+			select {
+			case <-s.upgrader.Exit():
+				cancel()
+			case <-ctx.Done():
+			}
+		}()
+	}
+	return ctx, cancel
+}
@@ -0,0 +1,167 @@
+package http
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// upgradeRoleEnv makes the process started by Upgrade, which runs this test binary with the
+// same arguments, act as the new process instead of running the test again.
+const upgradeRoleEnv = "HTTP_UPGRADE_TEST_ROLE"
+
+func TestUpgradeHandsOverListenersToChildProcess(t *testing.T) {
+	if os.Getenv(upgradeRoleEnv) == "child" {
+		runUpgradeChild()
+		return
+	}
+
+	logger := zap.NewNop()
+	u, err := NewUpgrader(logger, 10*time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer u.Stop()
+
+	slowStarted := make(chan struct{})
+	mux := http.NewServeMux()
+	mux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, "parent")
+	})
+	mux.HandleFunc("/slow", func(w http.ResponseWriter, r *http.Request) {
+		close(slowStarted)
+		time.Sleep(500 * time.Millisecond)
+		fmt.Fprint(w, "parent")
+	})
+	api := NewServer(logger, mux, WithName("api"), WithAddr("127.0.0.1:0"), WithUpgrader(u))
+	internal := NewServer(logger, mux, WithName("internal"), WithAddr("127.0.0.1:0"), WithUpgrader(u))
+	for _, srv := range []*Server{api, internal} {
+		if err := srv.Listen(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := u.Ready(); err != nil {
+		t.Fatal(err)
+	}
+
+	stopped := make(chan error, 2)
+	for _, srv := range []*Server{api, internal} {
+		go func() { stopped <- srv.Run(context.Background()) }()
+	}
+	apiURL := "http://" + api.Addr().String()
+	internalURL := "http://" + internal.Addr().String()
+	if body := get(t, apiURL); body != "parent" {
+		t.Fatalf("before the upgrade got %q, want parent", body)
+	}
+
+	// a request in flight during the handover must complete on the old process
+	slow := make(chan string, 1)
+	go func() { slow <- get(t, apiURL+"/slow") }()
+	<-slowStarted
+
+	t.Setenv(upgradeRoleEnv, "child")
+	if err := u.Upgrade(); err != nil {
+		t.Fatalf("upgrade: %v", err)
+	}
+
+	if body := <-slow; body != "parent" {
+		t.Fatalf("in-flight request got %q, want parent", body)
+	}
+	for range 2 {
+		select {
+		case err := <-stopped:
+			if err != nil {
+				t.Fatalf("old server did not stop cleanly: %v", err)
+			}
+		case <-time.After(10 * time.Second):
+			t.Fatal("old servers did not drain after the upgrade")
+		}
+	}
+
+	// both sockets, including the one of the server that listened second, now reach the child
+	apiBody := get(t, apiURL)
+	internalBody := get(t, internalURL)
+	if !strings.HasPrefix(apiBody, "child ") || internalBody != apiBody {
+		t.Fatalf("after the upgrade got %q and %q, want the child on both", apiBody, internalBody)
+	}
+	pid, err := strconv.Atoi(strings.TrimPrefix(apiBody, "child "))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := syscall.Kill(pid, syscall.SIGTERM); err != nil {
+		t.Fatal(err)
+	}
+	var status syscall.WaitStatus
+	if _, err := syscall.Wait4(pid, &status, 0, nil); err != nil {
+		t.Fatal(err)
+	}
+	if status.ExitStatus() != 0 {
+		t.Fatalf("child exited with %d", status.ExitStatus())
+	}
+}
+
+// runUpgradeChild serves both inherited listeners until SIGTERM and exits without test
+// output. Deferred calls don't run, the process ends either way.
+func runUpgradeChild() {
+	logger := zap.NewNop()
+	u, err := NewUpgrader(logger, 0)
+	if err != nil {
+		exitChild(2)
+	}
+	defer u.Stop()
+
+	body := "child " + strconv.Itoa(os.Getpid())
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, body)
+	})
+	// the addresses are ignored, both servers must get the inherited sockets
+	api := NewServer(logger, handler, WithName("api"), WithAddr("127.0.0.1:1"), WithUpgrader(u))
+	internal := NewServer(logger, handler, WithName("internal"), WithAddr("127.0.0.1:1"), WithUpgrader(u))
+	for _, srv := range []*Server{api, internal} {
+		if err := srv.Listen(); err != nil {
+			exitChild(3)
+		}
+	}
+	if err := u.Ready(); err != nil {
+		exitChild(4)
+	}
+
+	ctx, cancel := SignalContext(context.Background(), logger)
+	defer cancel()
+	ctx, stop := context.WithTimeout(ctx, 30*time.Second)
+	defer stop()
+	go api.Run(ctx)
+	if err := internal.Run(ctx); err != nil {
+		exitChild(5)
+	}
+	exitChild(0)
+}
+
+// exitChild exits without running the rest of the test binary; os.Exit(0) panics under
+// the -test.paniconexit0 flag the child inherits.
+func exitChild(code int) {
+	syscall.Exit(code)
+}
+
+func get(t *testing.T, url string) string {
+	t.Helper()
+	client := &http.Client{Timeout: 5 * time.Second, Transport: &http.Transport{DisableKeepAlives: true}}
+	resp, err := client.Get(url)
+	if err != nil {
+		t.Errorf("GET %s: %v", url, err)
+		return ""
+	}
+	defer resp.Body.Close()
+	body, _ := io.ReadAll(resp.Body)
+	return string(body)
+}
@@ -0,0 +1,81 @@
+package redis
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	goredis "github.com/redis/go-redis/v9"
+)
+
+/*
+Conditional writes that only apply while a key still holds the value the caller stored,
+evaluated atomically in Lua. They let the holder of a lock or reservation with a unique
+value extend, replace or release it without touching a key another holder took over after
+it expired.
+Refs
+https://redis.io/docs/latest/develop/use/patterns/distributed-locks/
+*/
+
+var compareAndDeleteScript = goredis.NewScript(`
+if redis.call("GET", KEYS[1]) == ARGV[1] then
+  return redis.call("DEL", KEYS[1])
+end
+return 0
+`)
+
+var compareAndExpireScript = goredis.NewScript(`
+if redis.call("GET", KEYS[1]) == ARGV[1] then
+  return redis.call("PEXPIRE", KEYS[1], ARGV[2])
+end
+return 0
+`)
+
+var compareAndSwapScript = goredis.NewScript(`
+if redis.call("GET", KEYS[1]) ~= ARGV[1] then
+  return 0
+end
+if tonumber(ARGV[3]) > 0 then
+  redis.call("SET", KEYS[1], ARGV[2], "PX", ARGV[3])
+else
+  redis.call("SET", KEYS[1], ARGV[2])
+end
+return 1
+`)
+
+// CompareAndDelete deletes key if it holds expected, and reports whether it did.
+func (c *CacheStore) CompareAndDelete(ctx context.Context, key string, expected []byte) (bool, error) {
+	span := newOTELSpan(ctx, "CompareAndDelete")
+	defer span.End()
+
+	n, err := compareAndDeleteScript.Run(ctx, c.client, []string{key}, expected).Int()
+	if err != nil {
+		return false, fmt.Errorf("redis compare and delete %s: %w", key, err)
+	}
+	return n == 1, nil
+}
+
+// CompareAndExpire sets the ttl of key if it holds expected, and reports whether it did.
+func (c *CacheStore) CompareAndExpire(ctx context.Context, key string, expected []byte, ttl time.Duration) (bool, error) {
+	span := newOTELSpan(ctx, "CompareAndExpire")
+	defer span.End()
+
+	n, err := compareAndExpireScript.Run(ctx, c.client, []string{key}, expected, ttl.Milliseconds()).Int()
+	if err != nil {
+		return false, fmt.Errorf("redis compare and expire %s: %w", key, err)
+	}
+	return n == 1, nil
+}
+
+// CompareAndSwap replaces the value of key with value for ttl if it holds expected, and
+// reports whether it did. Zero ttl keeps the value until it is deleted.
+func (c *CacheStore) CompareAndSwap(ctx context.Context, key string, expected, value []byte, ttl time.Duration) (bool, error) {
+	span := newOTELSpan(ctx, "CompareAndSwap")
+	defer span.End()
+
+	n, err := compareAndSwapScript.Run(ctx, c.client, []string{key}, expected, value, ttl.Milliseconds()).Int()
+	if err != nil {
+		return false, fmt.Errorf("redis compare and swap %s: %w", key, err)
+	}
+	return n == 1, nil
+}
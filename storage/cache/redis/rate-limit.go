@@ -0,0 +1,111 @@
+package redis
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"time"
+
+	goredis "github.com/redis/go-redis/v9"
+)
+
+/*
+GCRA (generic cell rate algorithm) rate limiting, evaluated atomically in a Lua script so
+every replica of a service shares one limit. The key stores the theoretical arrival time
+(TAT) of the next request and expires once the bucket is full again.
+Refs
+https://brandur.org/rate-limiting
+https://github.com/go-redis/redis_rate
+*/
+
+const rateLimitKeyPrefix = "ratelimit:"
+
+// gcraScript returns {allowed, remaining, retry_after, reset_after}; the durations are
+// strings since Lua numbers are truncated to integers when returned.
+var gcraScript = goredis.NewScript(`
+local key = KEYS[1]
+local burst = tonumber(ARGV[1])
+local rate = tonumber(ARGV[2])
+local period = tonumber(ARGV[3])
+local cost = tonumber(ARGV[4])
+
+local emission_interval = period / rate
+local increment = emission_interval * cost
+local burst_offset = emission_interval * burst
+
+-- the server clock keeps replicas with skewed clocks consistent; the offset
+-- (2017-01-01) keeps enough precision in the float
+redis.replicate_commands()
+local t = redis.call("TIME")
+local now = (tonumber(t[1]) - 1483228800) + tonumber(t[2]) / 1000000
+
+local tat = tonumber(redis.call("GET", key))
+if not tat or tat < now then
+  tat = now
+end
+
+local new_tat = tat + increment
+local diff = now - (new_tat - burst_offset)
+if diff < 0 then
+  return {0, 0, tostring(-diff), tostring(tat - now)}
+end
+
+local reset_after = new_tat - now
+redis.call("SET", key, new_tat, "EX", math.ceil(reset_after))
+return {1, math.floor(diff / emission_interval), "-1", tostring(reset_after)}
+`)
+
+// RateLimitResult is the outcome of a GCRA check.
+type RateLimitResult struct {
+	Allowed   bool
+	Remaining int
+	// RetryAfter is how long until the request would be allowed, zero when allowed.
+	RetryAfter time.Duration
+	// ResetAfter is how long until the bucket is full again.
+	ResetAfter time.Duration
+}
+
+// AllowGCRA takes one request from the bucket of key, which allows rate requests per period
+// with bursts of up to burst requests.
+func (c *CacheStore) AllowGCRA(ctx context.Context, key string, rate int, period time.Duration, burst int) (*RateLimitResult, error) {
+	span := newOTELSpan(ctx, "AllowGCRA")
+	defer span.End()
+
+	values, err := gcraScript.Run(ctx, c.client, []string{rateLimitKeyPrefix + key},
+		burst, rate, period.Seconds(), 1).Slice()
+	if err != nil {
+		return nil, fmt.Errorf("redis rate limit %s: %w", key, err)
+	}
+	if len(values) != 4 {
+		return nil, fmt.Errorf("redis rate limit %s: unexpected script result %v", key, values)
+	}
+
+	allowed, _ := values[0].(int64)
+	remaining, _ := values[1].(int64)
+	retryAfter, err := scriptSeconds(values[2])
+	if err != nil {
+		return nil, err
+	}
+	resetAfter, err := scriptSeconds(values[3])
+	if err != nil {
+		return nil, err
+	}
+	return &RateLimitResult{
+		Allowed:    allowed == 1,
+		Remaining:  int(remaining),
+		RetryAfter: max(retryAfter, 0),
+		ResetAfter: resetAfter,
+	}, nil
+}
+
+func scriptSeconds(v any) (time.Duration, error) {
+	s, ok := v.(string)
+	if !ok {
+		return 0, fmt.Errorf("redis rate limit: unexpected duration %v", v)
+	}
+	f, err := strconv.ParseFloat(s, 64)
+	if err != nil {
+		return 0, fmt.Errorf("redis rate limit: %w", err)
+	}
+	return time.Duration(f * float64(time.Second)), nil
+}
@@ -3,6 +3,7 @@ package redis
 import (
 	"context"
 	"crypto/tls"
+	"errors"
 	"fmt"
 	goredis "github.com/redis/go-redis/v9"
 	"go.opentelemetry.io/otel"
@@ -75,8 +76,74 @@ func (c *CacheStore) Updated() {
 	// When an item is updated, update it in the cache system
 }
 
+// Ping performs a lightweight health check by sending PING to every shard of the cluster.
+func (c *CacheStore) Ping(ctx context.Context) error {
+	err := c.client.ForEachShard(ctx, func(ctx context.Context, shard *goredis.Client) error {
+		return shard.Ping(ctx).Err()
+	})
+	if err != nil {
+		return fmt.Errorf("redis health check failed: %w", err)
+	}
+	return nil
+}
+
 func newOTELSpan(ctx context.Context, name string) trace.Span {
 	_, span := otel.Tracer(otelName).Start(ctx, name)
 
 	return span
 }
+
+// ErrCacheMiss is returned by Get when the key does not exist.
+var ErrCacheMiss = errors.New("redis: cache miss")
+
+// Get returns the value stored at key, or ErrCacheMiss.
+func (c *CacheStore) Get(ctx context.Context, key string) ([]byte, error) {
+	span := newOTELSpan(ctx, "Get")
+	defer span.End()
+
+	value, err := c.client.Get(ctx, key).Bytes()
+	if errors.Is(err, goredis.Nil) {
+		return nil, ErrCacheMiss
+	}
+	if err != nil {
+		return nil, fmt.Errorf("redis get %s: %w", key, err)
+	}
+	return value, nil
+}
+
+// Set stores value at key for ttl; zero ttl keeps it until it is deleted.
+func (c *CacheStore) Set(ctx context.Context, key string, value []byte, ttl time.Duration) error {
+	span := newOTELSpan(ctx, "Set")
+	defer span.End()
+
+	if err := c.client.Set(ctx, key, value, ttl).Err(); err != nil {
+		return fmt.Errorf("redis set %s: %w", key, err)
+	}
+	return nil
+}
+
+// SetNX stores value at key for ttl unless the key exists, and reports whether it did.
+func (c *CacheStore) SetNX(ctx context.Context, key string, value []byte, ttl time.Duration) (bool, error) {
+	span := newOTELSpan(ctx, "SetNX")
+	defer span.End()
+
+	ok, err := c.client.SetNX(ctx, key, value, ttl).Result()
+	if err != nil {
+		return false, fmt.Errorf("redis setnx %s: %w", key, err)
+	}
+	return ok, nil
+}
+
+// Delete removes keys. Keys that do not exist are ignored.
+func (c *CacheStore) Delete(ctx context.Context, keys ...string) error {
+	span := newOTELSpan(ctx, "Delete")
+	defer span.End()
+
+	// keys of a cluster may live on different slots, so they are deleted one by one
+	for _, key := range keys {
+		if err := c.client.Del(ctx, key).Err(); err != nil {
+			return fmt.Errorf("redis del %s: %w", key, err)
+		}
+	}
+	return nil
+}
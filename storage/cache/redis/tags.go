@@ -0,0 +1,63 @@
+package redis
+
+import (
+	"context"
+	"fmt"
+	"time"
+)
+
+/*
+Tagged values: each tag is a set of the keys stored with it, so every value carrying a tag
+can be deleted at once, e.g. all cached responses showing an order after it changed.
+A tag set lives as long as the longest-lived value added to it.
+*/
+
+const tagKeyPrefix = "tag:"
+
+// SetTagged stores value at key for ttl and adds key to the set of each tag.
+func (c *CacheStore) SetTagged(ctx context.Context, key string, value []byte, ttl time.Duration, tags ...string) error {
+	span := newOTELSpan(ctx, "SetTagged")
+	defer span.End()
+
+	if err := c.client.Set(ctx, key, value, ttl).Err(); err != nil {
+		return fmt.Errorf("redis set %s: %w", key, err)
+	}
+	for _, tag := range tags {
+		tagKey := tagKeyPrefix + tag
+		if err := c.client.SAdd(ctx, tagKey, key).Err(); err != nil {
+			return fmt.Errorf("redis tag %s: %w", tag, err)
+		}
+		if ttl <= 0 {
+			if err := c.client.Persist(ctx, tagKey).Err(); err != nil {
+				return fmt.Errorf("redis tag %s: %w", tag, err)
+			}
+			continue
+		}
+		// NX gives a new set the ttl of its first value, GT extends it for longer-lived ones
+		if err := c.client.ExpireNX(ctx, tagKey, ttl).Err(); err != nil {
+			return fmt.Errorf("redis tag %s: %w", tag, err)
+		}
+		if err := c.client.ExpireGT(ctx, tagKey, ttl).Err(); err != nil {
+			return fmt.Errorf("redis tag %s: %w", tag, err)
+		}
+	}
+	return nil
+}
+
+// InvalidateTags deletes the values stored with any of tags, and the tags.
+func (c *CacheStore) InvalidateTags(ctx context.Context, tags ...string) error {
+	span := newOTELSpan(ctx, "InvalidateTags")
+	defer span.End()
+
+	for _, tag := range tags {
+		tagKey := tagKeyPrefix + tag
+		keys, err := c.client.SMembers(ctx, tagKey).Result()
+		if err != nil {
+			return fmt.Errorf("redis tag %s: %w", tag, err)
+		}
+		if err := c.Delete(ctx, append(keys, tagKey)...); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,166 @@
+package postgresql
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+)
+
+/*
+Idempotency keys: the first response to a request carrying an Idempotency-Key, stored so
+retries of the request can be answered without running it again. A key is reserved while
+its request runs and expires after its TTL; expired rows are taken over by new requests
+and removed by DeleteExpiredIdempotencyKeys. The reservation carries a token unique to the
+request, so a request whose reservation was taken over can't extend, complete or release
+the key of the request that took it over.
+
+	if err := store.CreateIdempotencyKeysTable(ctx); err != nil {
+		return err
+	}
+*/
+
+const createIdempotencyKeysTable = `
+CREATE TABLE IF NOT EXISTS idempotency_keys (
+	key         text PRIMARY KEY,
+	fingerprint text NOT NULL,
+	token       text NOT NULL DEFAULT '',
+	completed   boolean NOT NULL DEFAULT false,
+	status      integer NOT NULL DEFAULT 0,
+	headers     jsonb,
+	body        bytea,
+	expires_at  timestamptz NOT NULL
+);
+ALTER TABLE idempotency_keys ADD COLUMN IF NOT EXISTS token text NOT NULL DEFAULT '';
+CREATE INDEX IF NOT EXISTS idempotency_keys_expires_at_idx ON idempotency_keys (expires_at);
+`
+
+// ErrIdempotencyKeyNotHeld is returned when the reservation of a key is no longer held by
+// the token, because it expired and was taken over or the key was completed.
+var ErrIdempotencyKeyNotHeld = errors.New("idempotency key not held by the token")
+
+// IdempotencyKey is a stored idempotency key. Headers holds the response headers as JSON.
+type IdempotencyKey struct {
+	Key         string
+	Fingerprint string
+	Completed   bool
+	Status      int
+	Headers     []byte
+	Body        []byte
+}
+
+// CreateIdempotencyKeysTable creates the idempotency_keys table if it does not exist.
+func (p *PostgresSQLDataStore) CreateIdempotencyKeysTable(ctx context.Context) error {
+	span := newOTELSpan(ctx, "CreateIdempotencyKeysTable")
+	defer span.End()
+
+	if _, err := p.pool.Exec(ctx, createIdempotencyKeysTable); err != nil {
+		return fmt.Errorf("create idempotency_keys table: %w", err)
+	}
+	return nil
+}
+
+// ReserveIdempotencyKey reserves key for ttl for a request with fingerprint, identified by
+// token. It returns nil if the key was reserved, and the stored key if another request
+// holds it.
+func (p *PostgresSQLDataStore) ReserveIdempotencyKey(ctx context.Context, key, fingerprint, token string, ttl time.Duration) (*IdempotencyKey, error) {
+	span := newOTELSpan(ctx, "ReserveIdempotencyKey")
+	defer span.End()
+
+	// the stored key may expire or be released between the insert and the select
+	for range 3 {
+		var reserved string
+		err := p.pool.QueryRow(ctx, `
+			INSERT INTO idempotency_keys (key, fingerprint, token, expires_at)
+			VALUES ($1, $2, $3, now() + make_interval(secs => $4))
+			ON CONFLICT (key) DO UPDATE SET
+				fingerprint = EXCLUDED.fingerprint, token = EXCLUDED.token, completed = false,
+				status = 0, headers = NULL, body = NULL, expires_at = EXCLUDED.expires_at
+			WHERE idempotency_keys.expires_at <= now()
+			RETURNING key`, key, fingerprint, token, ttl.Seconds()).Scan(&reserved)
+		if err == nil {
+			return nil, nil
+		}
+		if !errors.Is(err, pgx.ErrNoRows) {
+			return nil, fmt.Errorf("reserve idempotency key: %w", err)
+		}
+
+		stored := IdempotencyKey{Key: key}
+		err = p.pool.QueryRow(ctx, `
+			SELECT fingerprint, completed, status, headers, body FROM idempotency_keys
+			WHERE key = $1 AND expires_at > now()`, key).
+			Scan(&stored.Fingerprint, &stored.Completed, &stored.Status, &stored.Headers, &stored.Body)
+		if err == nil {
+			return &stored, nil
+		}
+		if !errors.Is(err, pgx.ErrNoRows) {
+			return nil, fmt.Errorf("get idempotency key: %w", err)
+		}
+	}
+	return nil, fmt.Errorf("reserve idempotency key %s: too much contention", key)
+}
+
+// ExtendIdempotencyKey keeps the reservation of key by token for another ttl, while its
+// request is still running. It returns ErrIdempotencyKeyNotHeld if token lost the key.
+func (p *PostgresSQLDataStore) ExtendIdempotencyKey(ctx context.Context, key, token string, ttl time.Duration) error {
+	span := newOTELSpan(ctx, "ExtendIdempotencyKey")
+	defer span.End()
+
+	tag, err := p.pool.Exec(ctx, `
+		UPDATE idempotency_keys SET expires_at = now() + make_interval(secs => $3)
+		WHERE key = $1 AND token = $2 AND NOT completed`, key, token, ttl.Seconds())
+	if err != nil {
+		return fmt.Errorf("extend idempotency key: %w", err)
+	}
+	if tag.RowsAffected() == 0 {
+		return ErrIdempotencyKeyNotHeld
+	}
+	return nil
+}
+
+// CompleteIdempotencyKey stores the response of the request holding key by token, and
+// keeps it for ttl. It returns ErrIdempotencyKeyNotHeld if token lost the key.
+func (p *PostgresSQLDataStore) CompleteIdempotencyKey(ctx context.Context, key, token string, status int, headers, body []byte, ttl time.Duration) error {
+	span := newOTELSpan(ctx, "CompleteIdempotencyKey")
+	defer span.End()
+
+	tag, err := p.pool.Exec(ctx, `
+		UPDATE idempotency_keys SET completed = true, status = $3, headers = $4, body = $5,
+			expires_at = now() + make_interval(secs => $6)
+		WHERE key = $1 AND token = $2 AND NOT completed`, key, token, status, headers, body, ttl.Seconds())
+	if err != nil {
+		return fmt.Errorf("complete idempotency key: %w", err)
+	}
+	if tag.RowsAffected() == 0 {
+		return ErrIdempotencyKeyNotHeld
+	}
+	return nil
+}
+
+// ReleaseIdempotencyKey deletes the reservation of key by token if its request has not
+// completed, so it can be retried. A key held by another token is left alone.
+func (p *PostgresSQLDataStore) ReleaseIdempotencyKey(ctx context.Context, key, token string) error {
+	span := newOTELSpan(ctx, "ReleaseIdempotencyKey")
+	defer span.End()
+
+	_, err := p.pool.Exec(ctx, `DELETE FROM idempotency_keys WHERE key = $1 AND token = $2 AND NOT completed`, key, token)
+	if err != nil {
+		return fmt.Errorf("release idempotency key: %w", err)
+	}
+	return nil
+}
+
+// DeleteExpiredIdempotencyKeys deletes expired keys and returns how many were deleted.
+// Run it periodically, e.g. with utils.RunInTheBackground.
+func (p *PostgresSQLDataStore) DeleteExpiredIdempotencyKeys(ctx context.Context) (int64, error) {
+	span := newOTELSpan(ctx, "DeleteExpiredIdempotencyKeys")
+	defer span.End()
+
+	tag, err := p.pool.Exec(ctx, `DELETE FROM idempotency_keys WHERE expires_at <= now()`)
+	if err != nil {
+		return 0, fmt.Errorf("delete expired idempotency keys: %w", err)
+	}
+	return tag.RowsAffected(), nil
+}
@@ -46,6 +46,15 @@ func NewPostgresSQLDatastore(logger *zap.Logger, dbDsn, serviceName string) *Pos
 	}
 }
 
+// Ping performs a lightweight health check by acquiring a pooled connection
+// and round-tripping to the database.
+func (p *PostgresSQLDataStore) Ping(ctx context.Context) error {
+	if err := p.pool.Ping(ctx); err != nil {
+		return fmt.Errorf("postgres health check failed: %w", err)
+	}
+	return nil
+}
+
 func newOTELSpan(ctx context.Context, name string) trace.Span {
 	_, span := otel.Tracer(otelName).Start(ctx, name)
 
@@ -85,6 +85,20 @@ func NewSearchIndex(logger *zap.Logger, endpoint string) (*SearchIndex, error) {
 	}, nil
 }
 
+// Ping performs a lightweight health check by fetching the cluster info.
+func (s *SearchIndex) Ping(ctx context.Context) error {
+	res, err := s.client.Info(s.client.Info.WithContext(ctx))
+	if err != nil {
+		return fmt.Errorf("opensearch health check failed: %w", err)
+	}
+	defer res.Body.Close()
+
+	if res.IsError() {
+		return fmt.Errorf("opensearch health check failed: %s", res.Status())
+	}
+	return nil
+}
+
 func (s *SearchIndex) IndexRecord(baseIndexName, recordId string, item interface{}, indexProperties string) error {
 	timestamp := time.Now()
 	indexName := s.getIndexName(baseIndexName, timestamp)
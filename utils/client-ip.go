@@ -0,0 +1,221 @@
+package utils
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"net/netip"
+	"strings"
+)
+
+/*
+Client IPs behind reverse proxies. Forwarding headers are written by whoever sends the
+request, so they are only read when the request comes from a trusted proxy, and only up to
+the first hop that is not one:
+
+	resolver, err := utils.NewClientIPResolver(utils.ClientIPConfig{
+		TrustedProxies: []string{"10.0.0.0/8", "fd00::/8"},
+	})
+
+With "X-Forwarded-For: 198.51.100.7, 203.0.113.9, 10.0.3.4" from 10.0.1.2, the client is
+203.0.113.9: 198.51.100.7 was written by 203.0.113.9, which may have made it up.
+Header must name the header the proxies actually set; a header they pass through unchanged
+is under the control of the client.
+Refs
+https://www.rfc-editor.org/rfc/rfc7239
+https://developer.mozilla.org/en-US/docs/Web/HTTP/Headers/X-Forwarded-For#security_and_privacy_concerns
+*/
+
+const (
+	ForwardedHeader     = "Forwarded"
+	XForwardedForHeader = "X-Forwarded-For"
+	XRealIPHeader       = "X-Real-IP"
+)
+
+// ClientIPConfig configures a ClientIPResolver.
+type ClientIPConfig struct {
+	// TrustedProxies are the CIDRs or addresses of the reverse proxies in front of the
+	// service. Without any, the client is the peer of the connection.
+	TrustedProxies []string
+	// Header is the header the proxies set: X-Forwarded-For (default), Forwarded or X-Real-IP.
+	Header string
+}
+
+// ClientIPResolver resolves the client address of requests.
+type ClientIPResolver struct {
+	trusted []netip.Prefix
+	header  string
+}
+
+// NewClientIPResolver returns a resolver for cfg.
+func NewClientIPResolver(cfg ClientIPConfig) (*ClientIPResolver, error) {
+	trusted, err := ParsePrefixes(cfg.TrustedProxies)
+	if err != nil {
+		return nil, fmt.Errorf("trusted proxies: %w", err)
+	}
+	header := http.CanonicalHeaderKey(cfg.Header)
+	switch header {
+	case "":
+		header = XForwardedForHeader
+	case ForwardedHeader, XForwardedForHeader, http.CanonicalHeaderKey(XRealIPHeader):
+	default:
+		return nil, fmt.Errorf("unsupported client ip header %q", cfg.Header)
+	}
+	return &ClientIPResolver{trusted: trusted, header: header}, nil
+}
+
+// Resolve returns the client address of r: the rightmost forwarded address not of a
+// trusted proxy, or the peer address if that is not a trusted proxy. The result is invalid
+// if r.RemoteAddr is not an IP address, e.g. for unix sockets.
+func (c *ClientIPResolver) Resolve(r *http.Request) netip.Addr {
+	peer := RemoteAddr(r)
+	if !peer.IsValid() || !c.trustedProxy(peer) {
+		return peer
+	}
+
+	var hops []string
+	for _, v := range r.Header.Values(c.header) {
+		switch c.header {
+		case ForwardedHeader:
+			hops = append(hops, forwardedFor(v)...)
+		case XForwardedForHeader:
+			hops = append(hops, strings.Split(v, ",")...)
+		default:
+			hops = append(hops, v)
+		}
+	}
+	if c.header != ForwardedHeader && c.header != XForwardedForHeader && len(hops) > 1 {
+		// X-Real-IP is a single address, a client may have sent another one
+		hops = hops[len(hops)-1:]
+	}
+
+	client := peer
+	for i := len(hops) - 1; i >= 0; i-- {
+		hop, ok := parseNode(hops[i])
+		if !ok {
+			// the hop was written by the trusted proxy before it, which is the last we know
+			return client
+		}
+		client = hop
+		if !c.trustedProxy(hop) {
+			return client
+		}
+	}
+	return client
+}
+
+func (c *ClientIPResolver) trustedProxy(addr netip.Addr) bool {
+	for _, p := range c.trusted {
+		if p.Contains(addr) {
+			return true
+		}
+	}
+	return false
+}
+
+// ParsePrefixes parses CIDRs and single addresses, e.g. "10.0.0.0/8" and "192.0.2.1".
+func ParsePrefixes(values []string) ([]netip.Prefix, error) {
+	prefixes := make([]netip.Prefix, 0, len(values))
+	for _, v := range values {
+		v = strings.TrimSpace(v)
+		if strings.Contains(v, "/") {
+			p, err := netip.ParsePrefix(v)
+			if err != nil {
+				return nil, err
+			}
+			prefixes = append(prefixes, p.Masked())
+			continue
+		}
+		addr, err := netip.ParseAddr(v)
+		if err != nil {
+			return nil, err
+		}
+		addr = addr.Unmap()
+		prefixes = append(prefixes, netip.PrefixFrom(addr, addr.BitLen()))
+	}
+	return prefixes, nil
+}
+
+// RemoteAddr returns the peer address of the connection of r.
+func RemoteAddr(r *http.Request) netip.Addr {
+	if ap, err := netip.ParseAddrPort(r.RemoteAddr); err == nil {
+		return ap.Addr().Unmap()
+	}
+	addr, _ := netip.ParseAddr(r.RemoteAddr)
+	return addr.Unmap()
+}
+
+// forwardedFor returns the "for" parameters of the elements of a Forwarded header value.
+func forwardedFor(v string) []string {
+	var nodes []string
+	for _, element := range splitQuoted(v, ',') {
+		node := "unknown"
+		for _, pair := range splitQuoted(element, ';') {
+			name, value, _ := strings.Cut(strings.TrimSpace(pair), "=")
+			if strings.EqualFold(name, "for") {
+				node = strings.Trim(value, `"`)
+			}
+		}
+		nodes = append(nodes, node)
+	}
+	return nodes
+}
+
+// splitQuoted splits s at sep outside of quoted strings.
+func splitQuoted(s string, sep byte) []string {
+	var parts []string
+	quoted, start := false, 0
+	for i := 0; i < len(s); i++ {
+		switch s[i] {
+		case '"':
+			quoted = !quoted
+		case sep:
+			if !quoted {
+				parts = append(parts, s[start:i])
+				start = i + 1
+			}
+		}
+	}
+	return append(parts, s[start:])
+}
+
+// parseNode parses an address with an optional port, e.g. "192.0.2.1:4711" or
+// "[2001:db8::1]:4711". Obfuscated and "unknown" nodes are not addresses.
+func parseNode(s string) (netip.Addr, bool) {
+	s = strings.TrimSpace(s)
+	if addr, err := netip.ParseAddr(strings.Trim(s, "[]")); err == nil {
+		return addr.Unmap(), true
+	}
+	host, _, err := net.SplitHostPort(s)
+	if err != nil {
+		return netip.Addr{}, false
+	}
+	addr, err := netip.ParseAddr(host)
+	if err != nil {
+		return netip.Addr{}, false
+	}
+	return addr.Unmap(), true
+}
+
+type clientIPKey struct{}
+
+// ContextWithClientIP stores the client address in ctx.
+func ContextWithClientIP(ctx context.Context, addr netip.Addr) context.Context {
+	return context.WithValue(ctx, clientIPKey{}, addr)
+}
+
+// ClientIPFromContext returns the client address stored in ctx.
+func ClientIPFromContext(ctx context.Context) (netip.Addr, bool) {
+	addr, ok := ctx.Value(clientIPKey{}).(netip.Addr)
+	return addr, ok && addr.IsValid()
+}
+
+// ClientIP returns the client address of r resolved by the middlewares.ClientIP
+// middleware, or the peer address without it. Forwarding headers are never read here.
+func ClientIP(r *http.Request) netip.Addr {
+	if addr, ok := ClientIPFromContext(r.Context()); ok {
+		return addr
+	}
+	return RemoteAddr(r)
+}
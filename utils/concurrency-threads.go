@@ -88,8 +88,8 @@ func BackgroundProcess(backgroundProcess func()) {
 //	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 //		// Only carry out check if rate limiter is enabled
 //		if app.config.limiter.enabled {
-//			// use the realip.ForRequest() method to get the client's real IP address
-//			ip := realip.FromRequest(r)
+//			// use the ClientIP() function to get the client's IP address behind trusted proxies
+//			ip := ClientIP(r).String()
 //			// Lock the mutex to prevent this code from being executed concurrently
 //			mu.Lock()
 //
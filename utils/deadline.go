@@ -0,0 +1,78 @@
+package utils
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// RequestTimeoutHeader carries the time a caller is still waiting for the response, in the
+// grpc-timeout format: at most 8 digits followed by a unit, H, M, S, m (milliseconds),
+// u (microseconds) or n (nanoseconds), e.g. "250m".
+const RequestTimeoutHeader = "Request-Timeout"
+
+var errInvalidTimeout = errors.New("invalid timeout")
+
+var timeoutUnits = []struct {
+	unit byte
+	d    time.Duration
+}{
+	{'n', time.Nanosecond},
+	{'u', time.Microsecond},
+	{'m', time.Millisecond},
+	{'S', time.Second},
+	{'M', time.Minute},
+	{'H', time.Hour},
+}
+
+// FormatTimeout formats d for the Request-Timeout header, in the finest unit that fits in
+// 8 digits, rounding up so callees never see more time than is left.
+func FormatTimeout(d time.Duration) string {
+	if d <= 0 {
+		return "0n"
+	}
+	for _, u := range timeoutUnits {
+		n := (d + u.d - 1) / u.d
+		if n <= 99999999 {
+			return strconv.FormatInt(int64(n), 10) + string(u.unit)
+		}
+	}
+	return "99999999H"
+}
+
+// ParseTimeout parses a Request-Timeout header value.
+func ParseTimeout(s string) (time.Duration, error) {
+	if len(s) < 2 || len(s) > 9 {
+		return 0, errInvalidTimeout
+	}
+	n, err := strconv.ParseInt(s[:len(s)-1], 10, 64)
+	if err != nil || n < 0 {
+		return 0, errInvalidTimeout
+	}
+	for _, u := range timeoutUnits {
+		if u.unit == s[len(s)-1] {
+			return time.Duration(n) * u.d, nil
+		}
+	}
+	return 0, errInvalidTimeout
+}
+
+// RemainingBudget returns the time left until the deadline of ctx, and false if ctx has no
+// deadline.
+func RemainingBudget(ctx context.Context) (time.Duration, bool) {
+	deadline, ok := ctx.Deadline()
+	if !ok {
+		return 0, false
+	}
+	return time.Until(deadline), true
+}
+
+// setRequestTimeoutHeader passes the remaining budget of the context of req on to the
+// callee, unless the caller set the header already.
+func setRequestTimeoutHeader(req *http.Request) {
+	if remaining, ok := RemainingBudget(req.Context()); ok && req.Header.Get(RequestTimeoutHeader) == "" {
+		req.Header.Set(RequestTimeoutHeader, FormatTimeout(remaining))
+	}
+}
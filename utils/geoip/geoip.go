@@ -0,0 +1,61 @@
+package geoip
+
+import (
+	"context"
+	"errors"
+	"net/netip"
+)
+
+/*
+Offline geolocation of client addresses, without calling out to a lookup service on the
+request path.
+
+	provider, err := geoip.NewMMDBProvider(logger, geoip.MMDBConfig{
+		CityPath: "/var/lib/geoip/GeoLite2-City.mmdb",
+		ASNPath:  "/var/lib/geoip/GeoLite2-ASN.mmdb",
+	})
+	go provider.Run(ctx) // picks up new databases, e.g. from geoipupdate
+	handler := middlewares.NewChain(middlewares.ClientIP(resolver), middlewares.NewGeoIP(logger, provider).Handler).Then(mux)
+
+	loc, ok := geoip.LocationFromContext(r.Context())
+
+Tests can point the MMDBProvider at small fixture databases, or implement Provider.
+Refs
+https://maxmind.github.io/MaxMind-DB/
+https://dev.maxmind.com/geoip/updating-databases
+*/
+
+// ErrNotFound is returned for addresses the databases hold no record for, e.g. private ones.
+var ErrNotFound = errors.New("geoip: address not found")
+
+// Location is where an address is registered. Fields unknown to the databases are empty.
+type Location struct {
+	// Country is the ISO 3166-1 alpha-2 code, e.g. "GB".
+	Country     string
+	CountryName string
+	// Region is the ISO 3166-2 subdivision code without the country, e.g. "ENG".
+	Region     string
+	RegionName string
+	City       string
+	// ASN is the autonomous system number of the network, and ASOrg its organisation.
+	ASN   uint
+	ASOrg string
+}
+
+// Provider looks up the location of addresses. Implementations are safe for concurrent use.
+type Provider interface {
+	Lookup(addr netip.Addr) (Location, error)
+}
+
+type locationKey struct{}
+
+// ContextWithLocation stores the location of the client in ctx.
+func ContextWithLocation(ctx context.Context, loc Location) context.Context {
+	return context.WithValue(ctx, locationKey{}, loc)
+}
+
+// LocationFromContext returns the location of the client stored in ctx.
+func LocationFromContext(ctx context.Context) (Location, bool) {
+	loc, ok := ctx.Value(locationKey{}).(Location)
+	return loc, ok
+}
@@ -0,0 +1,256 @@
+package geoip
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/netip"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+	"github.com/oschwald/maxminddb-golang"
+	"go.uber.org/zap"
+)
+
+const (
+	defaultPollInterval = time.Minute
+	defaultLanguage     = "en"
+	// watchSettleDelay lets an update of both databases finish before reloading.
+	watchSettleDelay = 250 * time.Millisecond
+)
+
+// MMDBConfig configures an MMDBProvider. At least one of CityPath and ASNPath is required.
+type MMDBConfig struct {
+	// CityPath is a GeoIP2 or GeoLite2 City database, or a Country database for countries only.
+	CityPath string
+	// ASNPath is a GeoLite2 ASN database.
+	ASNPath string
+	// Language of the names, "en" by default. Names missing in it are returned in English.
+	Language string
+	// PollInterval is how often Run checks the files for changes besides watching them.
+	// Default: 1m.
+	PollInterval time.Duration
+}
+
+// MMDBProvider looks up locations in MaxMind DB files, which are reloaded when they change.
+// Databases are read into memory, so lookups in flight during a reload are not affected.
+type MMDBProvider struct {
+	cfg    MMDBConfig
+	logger *zap.Logger
+
+	mu   sync.Mutex // serialises reloads
+	city atomic.Pointer[mmdb]
+	asn  atomic.Pointer[mmdb]
+}
+
+type mmdb struct {
+	reader  *maxminddb.Reader
+	modTime time.Time
+	size    int64
+}
+
+// NewMMDBProvider returns a provider for cfg, with its databases loaded.
+func NewMMDBProvider(logger *zap.Logger, cfg MMDBConfig) (*MMDBProvider, error) {
+	if cfg.CityPath == "" && cfg.ASNPath == "" {
+		return nil, errors.New("geoip: no database path")
+	}
+	if cfg.Language == "" {
+		cfg.Language = defaultLanguage
+	}
+	if cfg.PollInterval <= 0 {
+		cfg.PollInterval = defaultPollInterval
+	}
+	p := &MMDBProvider{cfg: cfg, logger: logger}
+	if err := p.Reload(); err != nil {
+		return nil, err
+	}
+	return p, nil
+}
+
+// Reload reads the databases whose files changed since they were loaded. A database that
+// can't be read is rejected and the last good one stays in use.
+func (p *MMDBProvider) Reload() error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	return errors.Join(p.reload(&p.city, p.cfg.CityPath), p.reload(&p.asn, p.cfg.ASNPath))
+}
+
+func (p *MMDBProvider) reload(current *atomic.Pointer[mmdb], path string) error {
+	if path == "" {
+		return nil
+	}
+	info, err := os.Stat(path)
+	if err != nil {
+		return p.rejected(current, path, err)
+	}
+	if prev := current.Load(); prev != nil && prev.modTime.Equal(info.ModTime()) && prev.size == info.Size() {
+		return nil
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return p.rejected(current, path, err)
+	}
+	reader, err := maxminddb.FromBytes(data)
+	if err != nil {
+		return p.rejected(current, path, err)
+	}
+	current.Store(&mmdb{reader: reader, modTime: info.ModTime(), size: info.Size()})
+	p.logger.Info("geoip database loaded",
+		zap.String("path", path),
+		zap.String("type", reader.Metadata.DatabaseType),
+		zap.Time("built", time.Unix(int64(reader.Metadata.BuildEpoch), 0)))
+	return nil
+}
+
+func (p *MMDBProvider) rejected(current *atomic.Pointer[mmdb], path string, err error) error {
+	if current.Load() != nil {
+		p.logger.Error("rejected geoip database reload, keeping the last good database", zap.String("path", path), zap.Error(err))
+	}
+	return fmt.Errorf("geoip database %s: %w", path, err)
+}
+
+// Run watches the database files and reloads them when they change until ctx is done. The
+// files are also polled, in case the directories can't be watched or an event is missed.
+func (p *MMDBProvider) Run(ctx context.Context) {
+	ticker := time.NewTicker(p.cfg.PollInterval)
+	defer ticker.Stop()
+
+	var events <-chan fsnotify.Event
+	var watchErrs <-chan error
+	if w, err := p.watch(); err != nil {
+		p.logger.Warn("watching geoip databases failed, polling only", zap.Error(err))
+	} else {
+		defer w.Close()
+		events, watchErrs = w.Events, w.Errors
+	}
+
+	var settled <-chan time.Time
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case _, ok := <-events:
+			if !ok {
+				events = nil
+				continue
+			}
+			settled = time.After(watchSettleDelay)
+		case err, ok := <-watchErrs:
+			if !ok {
+				watchErrs = nil
+				continue
+			}
+			p.logger.Warn("geoip database watcher failed", zap.Error(err))
+		case <-settled:
+			settled = nil
+			// errors are logged by Reload; the last good databases stay in use
+			_ = p.Reload()
+		case <-ticker.C:
+			_ = p.Reload()
+		}
+	}
+}
+
+// watch watches the directories holding the databases, since updates such as geoipupdate's
+// replace the files by renaming new ones over them.
+func (p *MMDBProvider) watch() (*fsnotify.Watcher, error) {
+	w, err := fsnotify.NewWatcher()
+	if err != nil {
+		return nil, err
+	}
+	dirs := map[string]bool{}
+	for _, file := range []string{p.cfg.CityPath, p.cfg.ASNPath} {
+		if file == "" || dirs[filepath.Dir(file)] {
+			continue
+		}
+		dirs[filepath.Dir(file)] = true
+		if err := w.Add(filepath.Dir(file)); err != nil {
+			w.Close()
+			return nil, fmt.Errorf("watch %s: %w", filepath.Dir(file), err)
+		}
+	}
+	return w, nil
+}
+
+type names map[string]string
+
+type cityRecord struct {
+	City struct {
+		Names names `maxminddb:"names"`
+	} `maxminddb:"city"`
+	Country struct {
+		ISOCode string `maxminddb:"iso_code"`
+		Names   names  `maxminddb:"names"`
+	} `maxminddb:"country"`
+	Subdivisions []struct {
+		ISOCode string `maxminddb:"iso_code"`
+		Names   names  `maxminddb:"names"`
+	} `maxminddb:"subdivisions"`
+}
+
+type asnRecord struct {
+	Number       uint   `maxminddb:"autonomous_system_number"`
+	Organization string `maxminddb:"autonomous_system_organization"`
+}
+
+// Lookup implements Provider.
+func (p *MMDBProvider) Lookup(addr netip.Addr) (Location, error) {
+	var loc Location
+	ip := net.IP(addr.Unmap().AsSlice())
+	found := false
+
+	if db := p.city.Load(); db != nil {
+		var rec cityRecord
+		_, ok, err := db.reader.LookupNetwork(ip, &rec)
+		if err != nil {
+			return Location{}, fmt.Errorf("geoip city lookup: %w", err)
+		}
+		if ok {
+			found = true
+			loc.Country = rec.Country.ISOCode
+			loc.CountryName = p.name(rec.Country.Names)
+			if len(rec.Subdivisions) > 0 {
+				// the first subdivision is the largest, e.g. England rather than a county
+				loc.Region = rec.Subdivisions[0].ISOCode
+				loc.RegionName = p.name(rec.Subdivisions[0].Names)
+			}
+			loc.City = p.name(rec.City.Names)
+		}
+	}
+
+	if db := p.asn.Load(); db != nil {
+		var rec asnRecord
+		_, ok, err := db.reader.LookupNetwork(ip, &rec)
+		if err != nil {
+			return Location{}, fmt.Errorf("geoip asn lookup: %w", err)
+		}
+		if ok {
+			found = true
+			loc.ASN = rec.Number
+			loc.ASOrg = rec.Organization
+		}
+	}
+
+	if !found {
+		return Location{}, ErrNotFound
+	}
+	return loc, nil
+}
+
+func (p *MMDBProvider) name(n names) string {
+	if name, ok := n[p.cfg.Language]; ok {
+		return name
+	}
+	if name, ok := n[strings.SplitN(p.cfg.Language, "-", 2)[0]]; ok {
+		return name
+	}
+	return n[defaultLanguage]
+}
@@ -0,0 +1,227 @@
+package geoip
+
+import (
+	"context"
+	"errors"
+	"net/netip"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// The fixtures in testdata are IPv4 databases in the GeoLite2 City and ASN formats:
+//
+//	city.mmdb          81.2.69.0/24 London, England, GB (names in en and de)
+//	                   2.125.160.216/29 GB without a city or region
+//	city-updated.mmdb  as city.mmdb, with the city of 81.2.69.0/24 renamed to Westminster
+//	asn.mmdb           81.2.69.0/24 AS20712 Andrews & Arnold Ltd
+//	                   1.128.0.0/11 AS1221 Telstra Pty Ltd
+
+// copyFixture copies the named testdata database to path, so tests can replace it.
+func copyFixture(t *testing.T, name, path string) {
+	t.Helper()
+	b, err := os.ReadFile(filepath.Join("testdata", name))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(path, b, 0o600); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestMMDBProviderLookup(t *testing.T) {
+	p, err := NewMMDBProvider(zap.NewNop(), MMDBConfig{
+		CityPath: filepath.Join("testdata", "city.mmdb"),
+		ASNPath:  filepath.Join("testdata", "asn.mmdb"),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		addr string
+		want Location
+	}{
+		{"81.2.69.160", Location{
+			Country: "GB", CountryName: "United Kingdom",
+			Region: "ENG", RegionName: "England",
+			City: "London",
+			ASN:  20712, ASOrg: "Andrews & Arnold Ltd",
+		}},
+		{"::ffff:81.2.69.1", Location{
+			Country: "GB", CountryName: "United Kingdom",
+			Region: "ENG", RegionName: "England",
+			City: "London",
+			ASN:  20712, ASOrg: "Andrews & Arnold Ltd",
+		}},
+		// a country-level record without an ASN
+		{"2.125.160.217", Location{Country: "GB", CountryName: "United Kingdom"}},
+		// an ASN without a location
+		{"1.130.4.5", Location{ASN: 1221, ASOrg: "Telstra Pty Ltd"}},
+	}
+	for _, tt := range tests {
+		got, err := p.Lookup(netip.MustParseAddr(tt.addr))
+		if err != nil {
+			t.Errorf("Lookup(%s): %v", tt.addr, err)
+			continue
+		}
+		if got != tt.want {
+			t.Errorf("Lookup(%s) = %+v, want %+v", tt.addr, got, tt.want)
+		}
+	}
+
+	for _, addr := range []string{"10.0.0.1", "81.2.70.1"} {
+		if _, err := p.Lookup(netip.MustParseAddr(addr)); !errors.Is(err, ErrNotFound) {
+			t.Errorf("Lookup(%s) = %v, want ErrNotFound", addr, err)
+		}
+	}
+}
+
+func TestMMDBProviderLanguage(t *testing.T) {
+	cityPath := filepath.Join("testdata", "city.mmdb")
+	addr := netip.MustParseAddr("81.2.69.160")
+
+	for _, tt := range []struct{ language, city, country, region string }{
+		{"de", "London (de)", "Vereinigtes Königreich", "England"},
+		{"de-CH", "London (de)", "Vereinigtes Königreich", "England"},
+		{"fr", "London", "United Kingdom", "England"},
+	} {
+		p, err := NewMMDBProvider(zap.NewNop(), MMDBConfig{CityPath: cityPath, Language: tt.language})
+		if err != nil {
+			t.Fatal(err)
+		}
+		loc, err := p.Lookup(addr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if loc.City != tt.city || loc.CountryName != tt.country || loc.RegionName != tt.region {
+			t.Errorf("language %s: got %q, %q, %q", tt.language, loc.City, loc.RegionName, loc.CountryName)
+		}
+	}
+}
+
+func TestNewMMDBProviderErrors(t *testing.T) {
+	if _, err := NewMMDBProvider(zap.NewNop(), MMDBConfig{}); err == nil {
+		t.Error("provider without databases was created")
+	}
+
+	dir := t.TempDir()
+	if _, err := NewMMDBProvider(zap.NewNop(), MMDBConfig{CityPath: filepath.Join(dir, "missing.mmdb")}); err == nil {
+		t.Error("provider with a missing database was created")
+	}
+	corrupt := filepath.Join(dir, "corrupt.mmdb")
+	if err := os.WriteFile(corrupt, []byte("not a maxmind database"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := NewMMDBProvider(zap.NewNop(), MMDBConfig{CityPath: corrupt}); err == nil {
+		t.Error("provider with a corrupt database was created")
+	}
+}
+
+func TestMMDBProviderReload(t *testing.T) {
+	cityPath := filepath.Join(t.TempDir(), "city.mmdb")
+	copyFixture(t, "city.mmdb", cityPath)
+	p, err := NewMMDBProvider(zap.NewNop(), MMDBConfig{CityPath: cityPath})
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := netip.MustParseAddr("81.2.69.160")
+	assertCity(t, p, addr, "London")
+
+	// an unchanged file is not read again
+	if err := p.Reload(); err != nil {
+		t.Fatal(err)
+	}
+	before := p.city.Load()
+	if err := p.Reload(); err != nil || p.city.Load() != before {
+		t.Fatalf("unchanged database reloaded: %v", err)
+	}
+
+	copyFixture(t, "city-updated.mmdb", cityPath)
+	touch(t, cityPath, time.Now().Add(time.Minute))
+	if err := p.Reload(); err != nil {
+		t.Fatal(err)
+	}
+	assertCity(t, p, addr, "Westminster")
+
+	// a broken update is rejected and the last good database stays in use
+	if err := os.WriteFile(cityPath, []byte("truncated"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	touch(t, cityPath, time.Now().Add(2*time.Minute))
+	if err := p.Reload(); err == nil {
+		t.Fatal("corrupt database was accepted")
+	}
+	assertCity(t, p, addr, "Westminster")
+	if err := os.Remove(cityPath); err != nil {
+		t.Fatal(err)
+	}
+	if err := p.Reload(); err == nil {
+		t.Fatal("missing database was accepted")
+	}
+	assertCity(t, p, addr, "Westminster")
+}
+
+func TestMMDBProviderRunWatchesForNewDatabases(t *testing.T) {
+	cityPath := filepath.Join(t.TempDir(), "city.mmdb")
+	copyFixture(t, "city.mmdb", cityPath)
+	p, err := NewMMDBProvider(zap.NewNop(), MMDBConfig{CityPath: cityPath, PollInterval: time.Hour})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		p.Run(ctx)
+		close(done)
+	}()
+	defer func() {
+		cancel()
+		<-done
+	}()
+
+	addr := netip.MustParseAddr("81.2.69.160")
+	deadline := time.Now().Add(5 * time.Second)
+	for i := 1; ; i++ {
+		// written next to the database and renamed over it, as geoipupdate does; repeated
+		// in case Run was not watching yet
+		tmp := cityPath + ".tmp"
+		copyFixture(t, "city-updated.mmdb", tmp)
+		touch(t, tmp, time.Now().Add(time.Duration(i)*time.Minute))
+		if err := os.Rename(tmp, cityPath); err != nil {
+			t.Fatal(err)
+		}
+
+		for wait := time.Now().Add(500 * time.Millisecond); time.Now().Before(wait); time.Sleep(10 * time.Millisecond) {
+			if loc, err := p.Lookup(addr); err == nil && loc.City == "Westminster" {
+				return
+			}
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("new database not loaded")
+		}
+	}
+}
+
+func assertCity(t *testing.T, p Provider, addr netip.Addr, city string) {
+	t.Helper()
+	loc, err := p.Lookup(addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if loc.City != city {
+		t.Fatalf("city = %q, want %q", loc.City, city)
+	}
+}
+
+// touch sets the modification time, since a rewrite within the resolution of the file
+// system clock may not change it.
+func touch(t *testing.T, path string, mtime time.Time) {
+	t.Helper()
+	if err := os.Chtimes(path, mtime, mtime); err != nil {
+		t.Fatal(err)
+	}
+}
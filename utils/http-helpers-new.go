@@ -90,6 +90,8 @@ func HTTPRequestWithTrace(ctx context.Context, logger *zap.Logger, client *http.
 	for key, value := range headers {
 		req.Header.Set(key, value)
 	}
+	setRequestIDHeader(req)
+	setRequestTimeoutHeader(req)
 
 	q := req.URL.Query()
 	for key, value := range queryParams {
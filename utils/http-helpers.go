@@ -10,7 +10,6 @@ import (
 	"errors"
 	"fmt"
 	"io"
-	"io/ioutil"
 	"net"
 	"net/http"
 	"net/url"
@@ -57,6 +56,36 @@ func NewHTTPClient(timeout time.Duration) *http.Client {
 	}
 }
 
+// UnixSocketDialer returns a DialContext function that connects to the Unix domain socket at
+// socketPath whatever host the request is addressed to. Prefix the path with "@" for a
+// socket in the Linux abstract namespace.
+func UnixSocketDialer(socketPath string) func(ctx context.Context, network, addr string) (net.Conn, error) {
+	dialer := &net.Dialer{Timeout: 30 * time.Second}
+	return func(ctx context.Context, _, _ string) (net.Conn, error) {
+		return dialer.DialContext(ctx, "unix", socketPath)
+	}
+}
+
+// NewUnixSocketHTTPClient returns a client that sends every request over the Unix domain
+// socket at socketPath, e.g. to a sidecar listening on unix:///run/agent.sock. The host in
+// the request URL is only used for the Host header, so "http://localhost/path" is fine.
+func NewUnixSocketHTTPClient(socketPath string, timeout time.Duration) *http.Client {
+	if timeout == 0 {
+		timeout = defaultTimeout
+	}
+
+	transport := &http.Transport{
+		DialContext:     UnixSocketDialer(socketPath),
+		MaxIdleConns:    defaultMaxIdleConns,
+		IdleConnTimeout: defaultIdleConnTimeout,
+	}
+
+	return &http.Client{
+		Timeout:   timeout,
+		Transport: transport,
+	}
+}
+
 // HTTPRequest sends an HTTP request and returns the response body
 func HTTPRequest(ctx context.Context, logger *zap.Logger, method, endpoint, token string, payload interface{}, queryParams, headers map[string]string) ([]byte, error) {
 	client := NewHTTPClient(180 * time.Second)
@@ -83,6 +112,8 @@ func HTTPRequest(ctx context.Context, logger *zap.Logger, method, endpoint, toke
 	for key, value := range headers {
 		req.Header.Set(key, value)
 	}
+	setRequestIDHeader(req)
+	setRequestTimeoutHeader(req)
 
 	q := req.URL.Query()
 	for key, value := range queryParams {
@@ -269,32 +300,95 @@ func WriteJsonResponse(w http.ResponseWriter, r *http.Request, data interface{},
 	w.Write(resp)
 }
 
-// mtlsClient ...
-func mtlsClient() (*http.Client, error) {
-	caCert, err := ioutil.ReadFile(os.Getenv("mTLS_CERT_FILE_PATH"))
-	if err != nil {
-		return nil, errors.New("reading ca certificate")
+// Problem is an RFC 9457 problem details object, served as application/problem+json.
+type Problem struct {
+	Type      string `json:"type"`
+	Title     string `json:"title"`
+	Status    int    `json:"status"`
+	Detail    string `json:"detail,omitempty"`
+	Instance  string `json:"instance,omitempty"`
+	Code      string `json:"code,omitempty"`
+	RequestID string `json:"request_id,omitempty"`
+}
+
+// WriteProblemResponse writes problem as application/problem+json. Type, Title and Instance
+// default to "about:blank", the status text and the request path, and the request ID is
+// taken from the context, or else the X-Request-ID response or request header.
+func WriteProblemResponse(w http.ResponseWriter, r *http.Request, problem Problem) {
+	if problem.Type == "" {
+		problem.Type = "about:blank"
+	}
+	if problem.Title == "" {
+		problem.Title = http.StatusText(problem.Status)
+	}
+	if problem.Instance == "" {
+		problem.Instance = r.URL.Path
+	}
+	if problem.RequestID == "" {
+		problem.RequestID = RequestIDFromContext(r.Context())
+	}
+	if problem.RequestID == "" {
+		problem.RequestID = w.Header().Get(RequestIDHeader)
+	}
+	if problem.RequestID == "" {
+		problem.RequestID = r.Header.Get(RequestIDHeader)
 	}
 
-	caCertPool := x509.NewCertPool() //x509.SystemCertPool()
+	w.Header().Set("Content-Type", "application/problem+json")
+	w.Header().Del("Content-Length")
+	w.WriteHeader(problem.Status)
+	json.NewEncoder(w).Encode(problem)
+}
+
+// NewMTLSConfig returns a client TLS configuration that presents the key pair in certFile
+// and keyFile and trusts only the CAs in caFile.
+func NewMTLSConfig(caFile, certFile, keyFile string) (*tls.Config, error) {
+	caCert, err := os.ReadFile(caFile)
 	if err != nil {
-		return nil, errors.New("creating system cert pool")
+		return nil, fmt.Errorf("reading ca certificate: %w", err)
+	}
+
+	caCertPool := x509.NewCertPool()
+	if !caCertPool.AppendCertsFromPEM(caCert) {
+		return nil, fmt.Errorf("no ca certificates found in %s", caFile)
 	}
-	caCertPool.AppendCertsFromPEM(caCert)
 
 	// Read the new key pair to create the certificate
-	cert, err := tls.LoadX509KeyPair(os.Getenv("mTLS_CERT_FILE_PATH"), os.Getenv("mTLS_CERT_KEY_PATH"))
+	cert, err := tls.LoadX509KeyPair(certFile, keyFile)
 	if err != nil {
-		return nil, errors.New("reading the key pair")
+		return nil, fmt.Errorf("reading the key pair: %w", err)
+	}
+
+	return &tls.Config{
+		RootCAs:      caCertPool,
+		Certificates: []tls.Certificate{cert},
+		MinVersion:   tls.VersionTLS12,
+	}, nil
+}
+
+// MTLSConfigFromEnv is NewMTLSConfig with the files from the mTLS_CERT_FILE_PATH and
+// mTLS_CERT_KEY_PATH environment variables. The CA bundle is read from mTLS_CA_FILE_PATH,
+// falling back to the certificate file.
+func MTLSConfigFromEnv() (*tls.Config, error) {
+	certFile := os.Getenv("mTLS_CERT_FILE_PATH")
+	caFile := os.Getenv("mTLS_CA_FILE_PATH")
+	if caFile == "" {
+		caFile = certFile
+	}
+	return NewMTLSConfig(caFile, certFile, os.Getenv("mTLS_CERT_KEY_PATH"))
+}
+
+// mtlsClient ...
+func mtlsClient() (*http.Client, error) {
+	tlsConfig, err := MTLSConfigFromEnv()
+	if err != nil {
+		return nil, err
 	}
 
 	// Create an HTTPS client and supply the created CA pool and certificate
 	client := &http.Client{
 		Transport: &http.Transport{
-			TLSClientConfig: &tls.Config{
-				RootCAs:      caCertPool,
-				Certificates: []tls.Certificate{cert},
-			},
+			TLSClientConfig: tlsConfig,
 		},
 	}
 	return client, nil
@@ -307,17 +401,13 @@ func MtlsRequest(req *http.Request) (*http.Response, error) {
 	if err != nil {
 		return nil, errors.New("MTLS_client_creation_failed_error")
 	}
-	start := time.Now()
+	setRequestIDHeader(req)
+	setRequestTimeoutHeader(req)
 
 	r, err := client.Do(req)
 	if err != nil {
-		// record the request failed metrics
 		return nil, errors.New("request_failed_error")
 	}
-	duration := time.Since(start)
-	// log the request duration as Info log level
-	fmt.Println("API request duration %v", duration)
-	// record the success request metrics
 	return r, nil
 }
 
@@ -339,15 +429,6 @@ func ExtractBearerToken(r *http.Request) (string, error) {
 	return parts[1], nil
 }
 
-// addCORSHeaders sets the CORS headers for the response
-func addCORSHeaders(w http.ResponseWriter, origin string) {
-	w.Header().Set("Access-Control-Allow-Origin", origin)
-	w.Header().Set("Access-Control-Allow-Methods", "GET, POST, PUT, DELETE, OPTIONS")
-	w.Header().Set("Access-Control-Allow-Headers", "Content-Type, Authorization, X-Requested-With, Accept, Origin")
-	w.Header().Set("Access-Control-Allow-Credentials", "true")
-	w.Header().Set("Access-Control-Max-Age", "86400")
-}
-
 // HTTPMultipartRequest sends an HTTP multipart request and returns the response body
 func HTTPMultipartRequest(ctx context.Context, logger *zap.Logger, method, endpoint, token string, body io.Reader, headers map[string]string) ([]byte, error) {
 	client := NewHTTPClient(180 * time.Second)
@@ -364,6 +445,8 @@ func HTTPMultipartRequest(ctx context.Context, logger *zap.Logger, method, endpo
 	for key, value := range headers {
 		req.Header.Set(key, value)
 	}
+	setRequestIDHeader(req)
+	setRequestTimeoutHeader(req)
 
 	res, err := client.Do(req)
 	if err != nil {
@@ -0,0 +1,48 @@
+package utils
+
+import (
+	"context"
+	"net/http"
+)
+
+// RequestIDHeader carries the request ID on HTTP requests and responses, and on Kafka and
+// SQS messages published while serving a request.
+const RequestIDHeader = "X-Request-ID"
+
+// maxRequestIDLength bounds client-supplied IDs, which end up in every log entry.
+const maxRequestIDLength = 128
+
+type requestIDKey struct{}
+
+// ContextWithRequestID stores the request ID in ctx.
+func ContextWithRequestID(ctx context.Context, id string) context.Context {
+	return context.WithValue(ctx, requestIDKey{}, id)
+}
+
+// RequestIDFromContext returns the request ID stored in ctx, or "" if there is none.
+func RequestIDFromContext(ctx context.Context) string {
+	id, _ := ctx.Value(requestIDKey{}).(string)
+	return id
+}
+
+// ValidRequestID accepts IDs of printable ASCII without spaces, so they are safe to log
+// and forward.
+func ValidRequestID(id string) bool {
+	if id == "" || len(id) > maxRequestIDLength {
+		return false
+	}
+	for i := 0; i < len(id); i++ {
+		if id[i] <= ' ' || id[i] > '~' {
+			return false
+		}
+	}
+	return true
+}
+
+// setRequestIDHeader propagates the request ID in the context of req, unless the caller
+// set the header already.
+func setRequestIDHeader(req *http.Request) {
+	if id := RequestIDFromContext(req.Context()); id != "" && req.Header.Get(RequestIDHeader) == "" {
+		req.Header.Set(RequestIDHeader, id)
+	}
+}
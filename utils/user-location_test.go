@@ -0,0 +1,59 @@
+package utils
+
+import (
+	"errors"
+	"net/http/httptest"
+	"net/netip"
+	"testing"
+
+	"github.com/harphies/go.microservices.io/utils/geoip"
+)
+
+type staticProvider map[netip.Addr]geoip.Location
+
+func (p staticProvider) Lookup(addr netip.Addr) (geoip.Location, error) {
+	if loc, ok := p[addr]; ok {
+		return loc, nil
+	}
+	return geoip.Location{}, geoip.ErrNotFound
+}
+
+func TestGetUserLocationFromIPAddress(t *testing.T) {
+	provider := staticProvider{
+		netip.MustParseAddr("81.2.69.160"): {Country: "GB", CountryName: "United Kingdom", Region: "ENG", RegionName: "England", City: "London"},
+		netip.MustParseAddr("1.130.4.5"):   {Country: "AU", Region: "NSW"},
+		netip.MustParseAddr("1.128.0.1"):   {ASN: 1221},
+	}
+	tests := []struct {
+		remoteAddr string
+		want       string
+		wantErr    error
+	}{
+		{"81.2.69.160:4711", "London, England, United Kingdom", nil},
+		{"1.130.4.5:4711", "NSW, AU", nil},
+		{"1.128.0.1:4711", "", geoip.ErrNotFound},
+		{"10.0.0.1:4711", "", geoip.ErrNotFound},
+	}
+	for _, tt := range tests {
+		r := httptest.NewRequest("GET", "/", nil)
+		r.RemoteAddr = tt.remoteAddr
+		got, err := GetUserLocationFromIPAddress(r, provider)
+		if got != tt.want || !errors.Is(err, tt.wantErr) {
+			t.Errorf("%s: got %q, %v, want %q, %v", tt.remoteAddr, got, err, tt.want, tt.wantErr)
+		}
+	}
+
+	// the address resolved by the ClientIP middleware is preferred over RemoteAddr
+	r := httptest.NewRequest("GET", "/", nil)
+	r.RemoteAddr = "10.0.0.1:4711"
+	r = r.WithContext(ContextWithClientIP(r.Context(), netip.MustParseAddr("81.2.69.160")))
+	if got, err := GetUserLocationFromIPAddress(r, provider); err != nil || got != "London, England, United Kingdom" {
+		t.Errorf("got %q, %v", got, err)
+	}
+
+	r = httptest.NewRequest("GET", "/", nil)
+	r.RemoteAddr = "not an address"
+	if _, err := GetUserLocationFromIPAddress(r, provider); err == nil {
+		t.Error("no error without a client address")
+	}
+}